@@ -2,25 +2,357 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/dhnt/m3/internal"
+	qrcode "github.com/skip2/go-qrcode"
 )
 
 var logger = internal.Logger()
 
+// flags override the configuration file only if given on the command line
+type flags struct {
+	config      *string
+	port        *int
+	listen      *string
+	routes      internal.ListFlags
+	probes      internal.ListFlags
+	socks       *string
+	fallback    *string
+	exitPeers   internal.ListFlags
+	dnsPort     *int
+	dnsListen   *string
+	dnsUpstream *string
+	dnsAddrs    internal.ListFlags
+	cacheDir    *string
+	cacheSize   *int64
+	idle        *time.Duration
+	limits      internal.ListFlags
+	logLevel    *string
+}
+
+func newFlags(fs *flag.FlagSet) *flags {
+	f := &flags{}
+	f.config = fs.String("config", internal.DefaultConfigFile(), "Configuration file, defaults to $MIRR_CONFIG or $DHNT_BASE/etc/mirr.toml")
+	f.port = fs.Int("port", 18080, "Bind port")
+	f.listen = fs.String("listen", ":18080", "Proxy listen address, overrides --port")
+	fs.Var(&f.routes, "route", "Route configuration, may be repeated")
+	fs.Var(&f.probes, "probe", "External URL to check via proxy for health report, may be repeated")
+	f.socks = fs.String("pac-socks", "", "SOCKS host:port offered as alternative in proxy.pac")
+	f.fallback = fs.String("pac-fallback", internal.PACFallbackProxy, "proxy.pac action for unmatched hosts: proxy or direct")
+	fs.Var(&f.exitPeers, "exit-peer", "Peer address to use as web exit for the exit route action, may be repeated")
+	f.dnsPort = fs.Int("dns-port", 0, "DNS port, disabled if 0")
+	f.dnsListen = fs.String("dns-listen", "", "DNS listen address, overrides --dns-port")
+	f.dnsUpstream = fs.String("dns-upstream", "8.8.8.8:53", "DNS resolver for names not routed through mirr")
+	fs.Var(&f.dnsAddrs, "dns-addr", "Address answered for routed names, may be repeated; defaults to local addresses")
+	f.cacheDir = fs.String("cache", "", "HTTP cache directory for peer and local routes, defaults to $DHNT_BASE/cache")
+	f.cacheSize = fs.Int64("cache-size", 256, "HTTP cache size in MB")
+	f.idle = fs.Duration("idle-timeout", internal.DefaultIdleTimeout, "Close WebSocket and other tunnels idle for this long")
+	fs.Var(&f.limits, "limit", "Client limit class:action,rate=1Mbit,quota=2GB,requests=10 for class local or peer, may be repeated")
+	f.logLevel = fs.String("log-level", "", "Log level, overrides $log_level")
+	return f
+}
+
+// load reads the configuration and applies the flags set in fs
+func (f *flags) load(fs *flag.FlagSet) (*internal.Config, error) {
+	cfg, err := internal.LoadConfig(*f.config)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+		switch fl.Name {
+		case "port":
+			cfg.SetListen(fmt.Sprintf(":%v", *f.port))
+		case "route":
+			cfg.RouteFiles = f.routes
+		case "probe":
+			cfg.HealthProbes = f.probes
+		case "pac-socks":
+			cfg.PACSocks = *f.socks
+		case "pac-fallback":
+			cfg.PACFallback = *f.fallback
+		case "exit-peer":
+			cfg.ExitPeers = f.exitPeers
+		case "dns-port":
+			cfg.DNSListen = ""
+			if *f.dnsPort > 0 {
+				cfg.DNSListen = fmt.Sprintf(":%v", *f.dnsPort)
+			}
+		case "dns-upstream":
+			cfg.DNSUpstream = *f.dnsUpstream
+		case "dns-addr":
+			cfg.DNSAddrs = f.dnsAddrs
+		case "cache":
+			cfg.CacheDir = *f.cacheDir
+		case "cache-size":
+			cfg.CacheSize = *f.cacheSize << 20
+		case "idle-timeout":
+			cfg.IdleTimeout = *f.idle
+		case "limit":
+			cfg.Limits = f.limits
+		case "log-level":
+			cfg.LogLevel = *f.logLevel
+		}
+	})
+	// flags are visited by name, the addresses override the ports
+	if set["listen"] {
+		cfg.SetListen(*f.listen)
+	}
+	if set["dns-listen"] {
+		cfg.DNSListen = *f.dnsListen
+	}
+	return cfg, nil
+}
+
+// mirr config check [flags] validates the configuration without starting
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: mirr config check [--config file] [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("mirr config check", flag.ExitOnError)
+	f := newFlags(fs)
+	fs.Parse(args[1:])
+
+	cfg, err := f.load(fs)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *f.config != "" {
+		fmt.Printf("%v: OK\n", *f.config)
+	} else {
+		fmt.Println("OK")
+	}
+}
+
+// mirr admin token [--config file] adds a token to the admin token file
+func adminCommand(args []string) {
+	if len(args) == 0 || args[0] != "token" {
+		fmt.Fprintln(os.Stderr, "usage: mirr admin token [--config file]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("mirr admin token", flag.ExitOnError)
+	f := newFlags(fs)
+	fs.Parse(args[1:])
+
+	cfg, err := f.load(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	path := cfg.AdminTokenFile
+	if path == "" {
+		path = internal.DefaultAdminTokenFile()
+	}
+	token, err := internal.NewAdminToken(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "added to %v\n", path)
+	fmt.Println(token)
+}
+
+// mirr share [--png file] [--qr] prints the address and invite link of this node
+func shareCommand(args []string) {
+	fs := flag.NewFlagSet("mirr share", flag.ExitOnError)
+	f := newFlags(fs)
+	png := fs.String("png", "", "Write the QR code of the invite link to this PNG file")
+	qr := fs.Bool("qr", false, "Print the QR code of the invite link")
+	fs.Parse(args)
+
+	cfg, err := f.load(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	path := cfg.IPFSPath
+	if path == "" {
+		path = internal.IPFSPath()
+	}
+	key, err := internal.LoadIdentityKey(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	base := fmt.Sprintf("http://127.0.0.1:%v", cfg.Port)
+	s := internal.NewShareInfo(key.PeerID, key, cfg.ShareName, cfg.ShareServices, base)
+
+	fmt.Printf("address: %v\n", s.Addr)
+	for _, u := range s.URLs {
+		fmt.Printf("url:     %v\n", u)
+	}
+	if s.InviteError != "" {
+		fmt.Fprintln(os.Stderr, s.InviteError)
+		os.Exit(1)
+	}
+	fmt.Printf("invite:  %v\n", s.Invite)
+
+	if *png != "" {
+		b, err := internal.QRCode(s.QRContent())
+		if err == nil {
+			err = ioutil.WriteFile(*png, b, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *qr {
+		q, err := qrcode.New(s.QRContent(), qrcode.Low)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(q.ToSmallString(false))
+	}
+}
+
+// mirr invite import <link> adds the peer of an invite to the address book
+func inviteCommand(args []string) {
+	if len(args) < 2 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "usage: mirr invite import [--config file] <link>")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("mirr invite import", flag.ExitOnError)
+	f := newFlags(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: mirr invite import [--config file] <link>")
+		os.Exit(2)
+	}
+
+	cfg, err := f.load(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	inv, err := internal.ParseInvite(fs.Arg(0), cfg.InviteMaxAge)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	path := cfg.AddressBook
+	if path == "" {
+		path = internal.DefaultAddressBookFile()
+	}
+	e, err := internal.NewAddressBook(path).Add(inv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("added %v %v to %v\n", e.Name, e.Addr, path)
+}
+
+// mirr connect [--local-port n] [--stdio] <peer> <service> maps the service
+// published by a peer to a local port, or to stdin and stdout as ssh's
+// ProxyCommand: ssh -o ProxyCommand="mirr connect --stdio %h ssh" alice.m3
+func connectCommand(args []string) {
+	fs := flag.NewFlagSet("mirr connect", flag.ExitOnError)
+	f := newFlags(fs)
+	local := fs.Int("local-port", 0, "Local port of the service, a free one if 0")
+	stdio := fs.Bool("stdio", false, "Connect stdin and stdout to the service")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: mirr connect [--config file] [--local-port n] [--stdio] <peer> <service>")
+		os.Exit(2)
+	}
+
+	cfg, err := f.load(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	internal.SetIPFSAPI(cfg.IPFSAPI, cfg.IPFSHost)
+	if *stdio {
+		// stdout carries the stream
+		logger.Logger.SetOutput(os.Stderr)
+	}
+	path := cfg.AddressBook
+	if path == "" {
+		path = internal.DefaultAddressBookFile()
+	}
+	id, err := internal.NewAddressBook(path).Resolve(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sf, err := internal.ConnectService(id, fs.Arg(1), *local)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer sf.Close()
+
+	if !*stdio {
+		fmt.Printf("%v of %v on %v\n", fs.Arg(1), fs.Arg(0), sf.Addr())
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", sf.Addr(), 10*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(*net.TCPConn); ok {
+			cw.CloseWrite()
+		}
+	}()
+	io.Copy(os.Stdout, conn)
+}
+
 func main() {
-	//
-	var port = flag.Int("port", 18080, "Bind port")
-	var route = flag.String("route", "route.conf", "Route configuration")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		case "admin":
+			adminCommand(os.Args[2:])
+			return
+		case "share":
+			shareCommand(os.Args[2:])
+			return
+		case "invite":
+			inviteCommand(os.Args[2:])
+			return
+		case "connect":
+			connectCommand(os.Args[2:])
+			return
+		}
+	}
 
 	// var debug = flag.Bool("debug", false, "Enable debug mode")
+	f := newFlags(flag.CommandLine)
 	flag.Parse()
 
-	//
-	var cfg = &internal.Config{}
-
-	cfg.Port = *port
-	cfg.RouteFile = *route
+	cfg, err := f.load(flag.CommandLine)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	cfg.Apply()
 
 	logger.Info("starting mirr ...")
 	logger.Infof("configration: %v", cfg)
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestFlagsListenOverridesPort(t *testing.T) {
+	fs := flag.NewFlagSet("mirr", flag.ContinueOnError)
+	f := newFlags(fs)
+	if err := fs.Parse([]string{"--config", "", "--listen", "127.0.0.1:18081", "--port", "18082", "--dns-listen", "127.0.0.1:1053", "--dns-port", "1054"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := f.load(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:18081" || cfg.Port != 18081 {
+		t.Errorf("unexpected proxy listen: %v %v", cfg.Listen, cfg.Port)
+	}
+	if cfg.DNSListen != "127.0.0.1:1053" {
+		t.Errorf("unexpected dns listen: %v", cfg.DNSListen)
+	}
+}
@@ -1,6 +1,7 @@
 module github.com/dhnt/m3
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/elazarl/goproxy v0.0.0-20181111060418-2ce16c963a8a
 	github.com/fatih/color v1.7.0
 	github.com/gopherjs/gopherjs v0.0.0-20181103185306-d547d1d9531e // indirect
@@ -19,9 +20,12 @@ require (
 	github.com/peterh/liner v1.1.0
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/sirupsen/logrus v1.4.0
+	github.com/skip2/go-qrcode v0.0.0-20190110000554-dc11ecdae0a9
 	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
 	github.com/smartystreets/goconvey v0.0.0-20181108003508-044398e4856c // indirect
 	github.com/takama/daemon v0.0.0-20180403113744-aa76b0035d12
-	golang.org/x/net v0.0.0-20190301231341-16b79f2e4e95 // indirect
+	golang.org/x/crypto v0.0.0-20190211182817-74369b46fc67
+	golang.org/x/net v0.0.0-20190301231341-16b79f2e4e95
+	golang.org/x/text v0.3.0 // indirect
 	gopkg.in/resty.v1 v1.10.3
 )
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// number of requests kept for the dashboard
+const accessLogSize = 100
+
+// AccessEntry is a proxied request as shown on the dashboard
+type AccessEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Peer     bool      `json:"peer"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration int64     `json:"duration"` // milliseconds
+}
+
+// AccessLog keeps the most recent requests in memory
+type AccessLog struct {
+	entries []AccessEntry
+	next    int
+	full    bool
+	sync.Mutex
+}
+
+// NewAccessLog creates an access log of size entries
+func NewAccessLog(size int) *AccessLog {
+	return &AccessLog{
+		entries: make([]AccessEntry, size),
+	}
+}
+
+// Add records e, replacing the oldest entry when full
+func (r *AccessLog) Add(e AccessEntry) {
+	if r == nil || len(r.entries) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns the entries newest first
+func (r *AccessLog) Recent() []AccessEntry {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	list := make([]AccessEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return list
+}
+
+// accessWriter captures status and size; hijacked connections such as
+// tunnels are logged without a status
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	return hj.Hijack()
+}
+
+// accessHandler records the proxied requests handled by next in log,
+// requests for mirr itself such as the dashboard are not recorded
+func accessHandler(log *AccessLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" && !req.URL.IsAbs() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, req)
+
+		e := AccessEntry{
+			Time:     start,
+			Method:   req.Method,
+			Host:     req.Host,
+			Status:   aw.status,
+			Bytes:    aw.bytes,
+			Duration: int64(time.Since(start) / time.Millisecond),
+		}
+		if req.Method != "CONNECT" {
+			e.Host = req.URL.Host
+			e.Path = req.URL.Path
+		}
+		if c, ok := ClientFromContext(req.Context()); ok {
+			e.Client = c.ID
+			e.Peer = c.IsPeer()
+		}
+		log.Add(e)
+	})
+}
@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default admin token file below $DHNT_BASE
+const adminTokenFile = "etc/admin.tokens"
+
+// minTokenLength rejects guessable admin tokens
+const minTokenLength = 16
+
+// proxyHopHeader marks requests the proxy forwards for peers: should they
+// loop back to this node they come from loopback too
+const proxyHopHeader = "X-Mirr-Hop"
+
+type clientKey struct{}
+
+// WithClient returns req with the client recorded in its context
+func WithClient(req *http.Request, c Client) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientKey{}, c))
+}
+
+// ClientFromContext returns the client recorded by WithClient
+func ClientFromContext(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(clientKey{}).(Client)
+	return c, ok
+}
+
+// IsPeer reports whether the client connected over p2p
+func (c Client) IsPeer() bool {
+	return c.Class == clientPeer
+}
+
+// IsLoopback reports whether the client is a local user on this host
+func (c Client) IsLoopback() bool {
+	if c.Class != clientLocal {
+		return false
+	}
+	ip := net.ParseIP(c.ID)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clientHandler records the client of each request in its context.
+// Connections forwarded by ipfs come from loopback too, only the peer
+// preamble tells them apart.
+func clientHandler(peers *PeerListener, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, WithClient(req, peers.ClientOf(req)))
+	})
+}
+
+// errSelfTarget refuses connections of peers to the listeners of this node
+var errSelfTarget = errors.New("peers may not access this node")
+
+// selfGuard checks the addresses connections for peers are dialed to.
+// Peers reach addresses of this host only where a route maps a name to
+// them, and never the listeners of the node. A name may resolve to another
+// address when dialed than when checked, the address dialed is what counts.
+type selfGuard struct {
+	// ports returns the ports of the listeners of the node
+	ports func() []string
+}
+
+// isLocalIP reports whether ip is an address of this host
+func isLocalIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check refuses address, an IP and port, if it is a listener of this node
+// or on this host and not exposed by a route
+func (g *selfGuard) check(address string, exposed bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !isLocalIP(net.ParseIP(host)) {
+		return nil
+	}
+	if !exposed {
+		return errSelfTarget
+	}
+	for _, p := range g.ports() {
+		if p == port {
+			return errSelfTarget
+		}
+	}
+	return nil
+}
+
+// dial connects to addr unless it is refused, without a guard it just dials
+func (g *selfGuard) dial(network, addr string, exposed bool) (net.Conn, error) {
+	if g == nil {
+		return net.Dial(network, addr)
+	}
+	d := &net.Dialer{
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return g.check(address, exposed)
+		},
+	}
+	c, err := d.Dial(network, addr)
+	if oe, ok := err.(*net.OpError); ok && oe.Err == errSelfTarget {
+		host, _, _ := net.SplitHostPort(addr)
+		return nil, &RouteError{Kind: ErrRefused, Host: host, Err: errSelfTarget}
+	}
+	return c, err
+}
+
+// listenPorts returns the ports the proxy of the node is served on
+func (r *Neighborhood) listenPorts(peers *PeerListener) []string {
+	var ports []string
+	if peers != nil && peers.Listener != nil {
+		if _, p, err := net.SplitHostPort(peers.Addr().String()); err == nil {
+			ports = append(ports, p)
+		}
+	}
+	if r.config != nil {
+		if r.config.Port != 0 {
+			ports = append(ports, strconv.Itoa(r.config.Port))
+		}
+		if _, p, err := net.SplitHostPort(r.config.HTTPSListen); err == nil {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// peerPorts returns the ports peers may not reach on this host: those of
+// the proxy and of the listeners taking the peer ID from loopback, the
+// relays of published services and forwards for peers
+func (r *Neighborhood) peerPorts(peers *PeerListener) []string {
+	ports := r.listenPorts(peers)
+	if r.Published != nil {
+		ports = append(ports, r.Published.Ports()...)
+	}
+	if r.Forwards != nil {
+		ports = append(ports, r.Forwards.PeerPorts()...)
+	}
+	return ports
+}
+
+// DefaultAdminTokenFile returns $DHNT_BASE/etc/admin.tokens or empty if
+// DHNT_BASE is not set
+func DefaultAdminTokenFile() string {
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		return filepath.Join(base, adminTokenFile)
+	}
+	return ""
+}
+
+// AdminAuth guards the management endpoints. Requests need a bearer token
+// from the configuration or the token file; without any token configured
+// only loopback users are admitted, addressing this host by name. Peers are
+// never admitted if LocalOnly.
+type AdminAuth struct {
+	// LocalOnly restricts access to loopback users, excluding p2p connections
+	LocalOnly bool
+
+	tokens []string
+	file   string
+	// hosts are the names of the listeners besides loopback
+	hosts []string
+
+	mu      sync.Mutex
+	modTime time.Time
+	fileTok []string
+}
+
+// NewAdminAuth creates the admin guard from the configuration
+func NewAdminAuth(cfg *Config) *AdminAuth {
+	a := &AdminAuth{
+		LocalOnly: true,
+		file:      DefaultAdminTokenFile(),
+	}
+	if cfg != nil {
+		a.LocalOnly = cfg.AdminLocalOnly
+		a.tokens = cfg.AdminTokens
+		if cfg.AdminTokenFile != "" {
+			a.file = cfg.AdminTokenFile
+		}
+		for _, l := range []string{cfg.Listen, cfg.HTTPSListen} {
+			if host, _, err := net.SplitHostPort(l); err == nil && host != "" {
+				a.hosts = append(a.hosts, host)
+			}
+		}
+	}
+	return a
+}
+
+// localHost reports whether host, the Host of a request, names this host.
+// Pages of other sites may rebind their name to loopback, their requests
+// come from the local user but do not name this host.
+func (a *AdminAuth) localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	for _, h := range a.hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// readTokenFile reads one token per line, # starts a comment
+func readTokenFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		t := strings.TrimSpace(s.Text())
+		if i := strings.Index(t, "#"); i >= 0 {
+			t = strings.TrimSpace(t[:i])
+		}
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, s.Err()
+}
+
+// validTokens returns the configured tokens and those of the token file,
+// which is re-read when it changes
+func (a *AdminAuth) validTokens() []string {
+	if a.file == "" {
+		return a.tokens
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		a.fileTok = nil
+		a.modTime = time.Time{}
+	} else if !fi.ModTime().Equal(a.modTime) {
+		tokens, err := readTokenFile(a.file)
+		if err != nil {
+			logger.Errorf("admin tokens: %v", err)
+		}
+		a.fileTok = tokens
+		a.modTime = fi.ModTime()
+	}
+	return append(append([]string(nil), a.tokens...), a.fileTok...)
+}
+
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}
+
+// Authorize returns the status code rejecting req or 0 if it is allowed
+func (a *AdminAuth) Authorize(req *http.Request) int {
+	client, ok := ClientFromContext(req.Context())
+	if !ok {
+		client = (*PeerListener)(nil).ClientOf(req)
+	}
+	if req.Header.Get(proxyHopHeader) != "" {
+		// proxied for a peer and looped back
+		client.Class = clientPeer
+	}
+	if a.LocalOnly && !client.IsLoopback() {
+		return http.StatusForbidden
+	}
+
+	tokens := a.validTokens()
+	if len(tokens) == 0 {
+		// nothing configured, the local user is trusted
+		if client.IsLoopback() && a.localHost(req.Host) {
+			return 0
+		}
+		return http.StatusForbidden
+	}
+	given := bearerToken(req)
+	if given == "" {
+		return http.StatusUnauthorized
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(given)) == 1 {
+			return 0
+		}
+	}
+	return http.StatusUnauthorized
+}
+
+// sameOrigin reports whether req may change state: it is safe, comes from
+// a page of this node or from a client other than a browser. Browsers tell
+// the site of a request with Sec-Fetch-Site or at least Origin.
+func sameOrigin(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// Wrap guards h, rejecting cross-site requests changing state
+func (a *AdminAuth) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !sameOrigin(req) {
+			logger.Infof("admin %v %v denied: cross-site request from %v", req.Method, req.URL.Path, req.Header.Get("Origin"))
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		switch status := a.Authorize(req); status {
+		case 0:
+			h.ServeHTTP(w, req)
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mirr"`)
+			http.Error(w, "admin token required", status)
+		default:
+			logger.Infof("admin %v %v denied for %v", req.Method, req.URL.Path, req.RemoteAddr)
+			http.Error(w, "admin access denied", status)
+		}
+	})
+}
+
+// NewAdminToken appends a random token to the token file, creating it
+// readable by the owner only
+func NewAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no admin token file, set DHNT_BASE")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	ensureDir(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%v\n", token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
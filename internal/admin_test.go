@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirr-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "etc", "admin.tokens")
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	local := Client{Class: clientLocal, ID: "127.0.0.1"}
+	lan := Client{Class: clientLocal, ID: "192.168.1.2"}
+	peer := Client{Class: clientPeer, ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+
+	check := func(a *AdminAuth, c Client, token string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://127.0.0.1:18080/cache", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.Wrap(ok).ServeHTTP(w, WithClient(req, c))
+		if w.Code != expected {
+			t.Errorf("%v token %q: expected %v, got %v", c, token, expected, w.Code)
+		}
+	}
+
+	// no tokens: loopback users only
+	a := NewAdminAuth(&Config{AdminLocalOnly: true, AdminTokenFile: file})
+	check(a, local, "", 200)
+	check(a, lan, "", 403)
+	check(a, peer, "", 403)
+
+	// pages of other sites rebinding their name to loopback
+	a = NewAdminAuth(&Config{Listen: "mirr.lan:18080", AdminTokenFile: file})
+	for host, expected := range map[string]int{
+		"localhost:18080":    200,
+		"[::1]:18080":        200,
+		"mirr.lan:18080":     200,
+		"evil.example:18080": 403,
+		"evil.example":       403,
+	} {
+		req := httptest.NewRequest("POST", "http://"+host+"/dashboard/api/routes/reload", nil)
+		req.Header.Set("Origin", "http://"+host)
+		w := httptest.NewRecorder()
+		a.Wrap(ok).ServeHTTP(w, WithClient(req, local))
+		if w.Code != expected {
+			t.Errorf("Host %v: expected %v, got %v", host, expected, w.Code)
+		}
+	}
+	a = NewAdminAuth(&Config{AdminLocalOnly: true, AdminTokenFile: file})
+
+	token, err := NewAdminToken(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(a, local, "", 401)
+	check(a, local, "wrong", 401)
+	check(a, local, token, 200)
+	check(a, peer, token, 403)
+
+	// remote access with a token
+	a = NewAdminAuth(&Config{AdminTokens: []string{"0123456789abcdef"}})
+	check(a, lan, "0123456789abcdef", 200)
+	check(a, peer, "0123456789abcdef", 200)
+	check(a, lan, "", 401)
+	check(a, lan, token, 401)
+
+	// requests proxied for peers are never taken for loopback users
+	a = NewAdminAuth(&Config{AdminTokenFile: filepath.Join(dir, "none")})
+	req := httptest.NewRequest("GET", "/cache", nil)
+	req.Header.Set(proxyHopHeader, "peer")
+	if status := a.Authorize(WithClient(req, local)); status != 403 {
+		t.Errorf("proxied request: expected 403, got %v", status)
+	}
+}
+
+func TestAdminSameOrigin(t *testing.T) {
+	a := NewAdminAuth(&Config{AdminTokens: []string{"0123456789abcdef"}})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for _, c := range []struct {
+		method   string
+		headers  map[string]string
+		expected int
+	}{
+		{"POST", nil, 200},
+		{"POST", map[string]string{"Sec-Fetch-Site": "same-origin"}, 200},
+		{"POST", map[string]string{"Origin": "http://mirr.local:18080"}, 200},
+		{"POST", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://evil.example.com"}, 403},
+		{"PUT", map[string]string{"Sec-Fetch-Site": "same-site"}, 403},
+		{"POST", map[string]string{"Origin": "http://evil.example.com"}, 403},
+		{"POST", map[string]string{"Origin": "null"}, 403},
+		{"GET", map[string]string{"Sec-Fetch-Site": "cross-site"}, 200},
+	} {
+		req := httptest.NewRequest(c.method, "http://mirr.local:18080/dashboard/api/routes/reload", nil)
+		req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		a.Wrap(ok).ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Errorf("%v %v: expected %v, got %v", c.method, c.headers, c.expected, w.Code)
+		}
+	}
+}
+
+func TestPeerSelfAccess(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+	_, originPort, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	_, l, stop := startTestNode(t, &Config{}, testPeerID, "127.0.0.1 direct\nlocalhost direct\n*.${myid} localhost", nil)
+	defer stop()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	web := "web." + ToPeerAddr(testPeerID)
+
+	send := func(preamble, method, target string) int {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		host := target
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		fmt.Fprintf(c, "%v%v %v HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", preamble, method, target, host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	peer := "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk\n"
+
+	for _, c := range []struct {
+		preamble, method, target string
+		expected                 int
+	}{
+		{peer, "GET", "http://127.0.0.1:" + port + "/dashboard/api/status", 403},
+		{peer, "GET", "http://localhost:" + port + "/dashboard/api/status", 403},
+		{peer, "GET", "http://" + web + ":" + port + "/dashboard/api/status", 403},
+		{peer, "CONNECT", "127.0.0.1:" + port, 403},
+		{peer, "GET", "http://" + web + ":" + originPort + "/", 200},
+		{peer, "GET", "http://127.0.0.1:" + originPort + "/", 403},
+		{"", "GET", "http://127.0.0.1:" + port + "/dashboard/api/status", 200},
+	} {
+		if status := send(c.preamble, c.method, c.target); status != c.expected {
+			t.Errorf("%q %v %v: expected %v, got %v", c.preamble, c.method, c.target, c.expected, status)
+		}
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	var got Client
+	h := clientHandler(nil, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, _ = ClientFromContext(req.Context())
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !got.IsLoopback() || got.IsPeer() {
+		t.Errorf("expected loopback client, got %v", got)
+	}
+}
+
+func TestPeerDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	nb := NewNeighborhood(&Config{})
+	nb.Router = NewRouteRegistry("")
+	if err := nb.Router.ReadString("self.test localhost\n/.*/ direct"); err != nil {
+		t.Fatal(err)
+	}
+	own := nb.PeerDial(func() []string { return []string{port} })
+	other := nb.PeerDial(func() []string { return []string{"1"} })
+
+	// the address dialed is checked whatever the name, only routes to
+	// this host expose it
+	for _, c := range []struct {
+		dial func(network, addr string) (net.Conn, error)
+		addr string
+		ok   bool
+	}{
+		{own, "127.0.0.1:" + port, false},
+		{own, "localhost:" + port, false},
+		{own, "self.test:" + port, false},
+		{other, "127.0.0.1:" + port, false},
+		{other, "localhost:" + port, false},
+		{other, "self.test:" + port, true},
+	} {
+		conn, err := c.dial("tcp", c.addr)
+		if c.ok {
+			if err != nil {
+				t.Errorf("%v: %v", c.addr, err)
+			} else {
+				conn.Close()
+			}
+			continue
+		}
+		if kind, _ := classifyError(err); kind != ErrRefused {
+			t.Errorf("%v: expected refused, got %v", c.addr, err)
+		}
+	}
+	c, err := nb.Dial("tcp", "self.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
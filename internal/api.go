@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gostones/lib"
@@ -26,6 +27,17 @@ var apiUrl = "http://host.docker.internal"
 //var apiHost = "127.0.0.1"
 var apiHost = "host.docker.internal"
 
+// SetIPFSAPI sets the IPFS HTTP API base URL and the host p2p forwards listen on
+func SetIPFSAPI(base, host string) {
+	if base != "" {
+		apiBase = strings.TrimSuffix(base, "/")
+	}
+	if host != "" {
+		apiHost = host
+		apiUrl = "http://" + host
+	}
+}
+
 const (
 	protocolWWW = "/x/www/1.0"
 )
@@ -44,34 +56,45 @@ type Node struct {
 	ProtocolVersion string
 }
 
-// ipfs p2p listen /x/www/1.0 /ip4/127.0.0.1/tcp/$APP_PORT
+// ipfs p2p listen --report-peer-id /x/www/1.0 /ip4/127.0.0.1/tcp/$APP_PORT
 func P2PListen(appPort int) error {
-	target := fmt.Sprintf(ip4Addr+"/tcp/%v", appPort)
+	return p2pListen(protocolWWW, appPort)
+}
+
+// ipfs p2p listen --report-peer-id $PROTOCOL /ip4/127.0.0.1/tcp/$PORT
+func p2pListen(protocol string, port int) error {
+	target := fmt.Sprintf(ip4Addr+"/tcp/%v", port)
 
 	resp, err := client.R().
 		SetMultiValueQueryParams(url.Values{
-			"arg": []string{protocolWWW, target},
+			"arg":            []string{protocol, target},
+			"report-peer-id": []string{"true"},
 		}).
 		SetHeader("Accept", "application/json").
 		SetAuthToken("").
 		Get(apiBase + "/p2p/listen")
 
-	logger.Printf("Status: %v\n", resp.Status())
-	logger.Println(resp)
+	logger.Printf("p2pListen %v %v response: %v err: %v\n", protocol, target, resp, err)
 
-	return err
+	return p2pError(resp, err)
 }
 
 // ipfs p2p forward /x/www/1.0 /ip4/127.0.0.1/tcp/$SOME_PORT /ipfs/$SERVER_ID
 func p2pForward(port int, serverID string) error {
-	listen := fmt.Sprintf(ip4Addr+"/tcp/%v", port)
+	return P2PForward(protocolWWW, ip4Addr, port, serverID)
+}
+
+// P2PForward maps the service of protocol of the peer serverID to port on
+// the address ip4: ipfs p2p forward $PROTOCOL $IP4/tcp/$PORT /ipfs/$SERVER_ID
+func P2PForward(protocol, ip4 string, port int, serverID string) error {
+	listen := fmt.Sprintf(ip4+"/tcp/%v", port)
 	target := fmt.Sprintf("/ipfs/%v", serverID)
 
-	logger.Printf("p2pForward %v %v\n", listen, target)
+	logger.Printf("p2pForward %v %v %v\n", protocol, listen, target)
 
 	resp, err := client.R().
 		SetMultiValueQueryParams(url.Values{
-			"arg": []string{protocolWWW, listen, target},
+			"arg": []string{protocol, listen, target},
 		}).
 		SetHeader("Accept", "application/json").
 		SetAuthToken("").
@@ -79,16 +102,38 @@ func p2pForward(port int, serverID string) error {
 
 	logger.Printf("p2pForward  %v %v response: %v err: %v\n", listen, target, resp, err)
 
-	return err
+	return p2pError(resp, err)
+}
+
+// p2pError returns err or the message of a failed API call
+func p2pError(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		var e struct {
+			Message string
+		}
+		if json.Unmarshal(resp.Body(), &e) == nil && e.Message != "" {
+			return fmt.Errorf("ipfs: %v", e.Message)
+		}
+		return fmt.Errorf("ipfs: %v", resp.Status())
+	}
+	return nil
 }
 
 func p2pForwardClose(port int, serverID string) error {
-	listen := fmt.Sprintf(ip4Addr+"/tcp/%v", port)
+	return P2PForwardClose(protocolWWW, ip4Addr, port, serverID)
+}
+
+// P2PForwardClose removes the forward of protocol from port on ip4 to serverID
+func P2PForwardClose(protocol, ip4 string, port int, serverID string) error {
+	listen := fmt.Sprintf(ip4+"/tcp/%v", port)
 	target := fmt.Sprintf("/ipfs/%v", serverID)
 
 	resp, err := client.R().
 		SetQueryParams(map[string]string{
-			"protocol":       protocolWWW,
+			"protocol":       protocol,
 			"listen-address": listen,
 			"target-address": target,
 		}).
@@ -102,19 +147,62 @@ func p2pForwardClose(port int, serverID string) error {
 }
 
 func P2PCloseAll() error {
+	return p2pClose(protocolWWW)
+}
+
+// p2pClose removes all listeners and forwards of protocol
+func p2pClose(protocol string) error {
 	resp, err := client.R().
 		SetQueryParams(map[string]string{
-			"protocol": protocolWWW,
+			"protocol": protocol,
 		}).
 		SetHeader("Accept", "application/json").
 		SetAuthToken("").
 		Get(apiBase + "/p2p/close")
 
-	logger.Printf("close all response: %v err: %v\n", resp, err)
+	logger.Printf("close %v response: %v err: %v\n", protocol, resp, err)
 
 	return err
 }
 
+//
+// {
+//     "Listeners": [
+//         {
+//             "Protocol": "<string>"
+//             "ListenAddress": "<string>"
+//             "TargetAddress": "<string>"
+//         }
+//     ]
+// }
+
+// P2PListener is a p2p listener or forward registered with IPFS
+type P2PListener struct {
+	Protocol      string
+	ListenAddress string
+	TargetAddress string
+}
+
+// P2PListeners is
+type P2PListeners struct {
+	Listeners []P2PListener
+}
+
+func p2pLs() ([]P2PListener, error) {
+	resp, err := client.R().
+		SetHeader("Accept", "application/json").
+		SetAuthToken("").
+		Get(apiBase + "/p2p/ls?headers=true")
+	if err != nil {
+		return nil, err
+	}
+
+	l := P2PListeners{}
+	err = json.Unmarshal(resp.Body(), &l)
+
+	return l.Listeners, err
+}
+
 //
 // {
 //     "Peers": [
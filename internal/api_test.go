@@ -34,7 +34,7 @@ func TestIsLive(t *testing.T) {
 	addr := fmt.Sprintf("127.0.0.1:%v", port)
 	target := fmt.Sprintf("127.0.0.1:%v", proxyPort)
 	go HTTPProxy(proxyPort, nb)
-	go Forward(addr, target)
+	go Forward(addr, target, "tcp")
 	go webserver(FreePort())
 	t.Logf("addr: %v target: %v", addr, target)
 
@@ -0,0 +1,495 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry describes a response stored in the HTTP cache
+type CacheEntry struct {
+	Key          string            `json:"key"`
+	URL          string            `json:"url"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	Size         int64             `json:"size"`
+	RequestTime  time.Time         `json:"requestTime"`
+	ResponseTime time.Time         `json:"responseTime"`
+	LastAccess   time.Time         `json:"lastAccess"`
+	Hits         int64             `json:"hits"`
+}
+
+// CacheStats summarizes the HTTP cache
+type CacheStats struct {
+	Dir     string `json:"dir"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"maxSize"`
+	Entries int    `json:"entries"`
+	Hits    int64  `json:"hits"`
+	Misses  int64  `json:"misses"`
+}
+
+// HTTPCache is a size bounded on-disk store of HTTP responses with LRU eviction.
+// Each entry is kept as <key>.meta (JSON CacheEntry) and <key>.resp (raw response).
+// Only one variant per URL is stored.
+type HTTPCache struct {
+	dir     string
+	maxSize int64
+
+	size    int64
+	hits    int64
+	misses  int64
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+
+	sync.Mutex
+}
+
+// NewHTTPCache opens or creates the cache in dir holding up to maxSize bytes
+func NewHTTPCache(dir string, maxSize int64) (*HTTPCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &HTTPCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	return c, c.load()
+}
+
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *HTTPCache) path(key, ext string) string {
+	return filepath.Join(r.dir, key+ext)
+}
+
+// load indexes entries left by a previous run, least recently used first
+func (r *HTTPCache) load() error {
+	metas, err := filepath.Glob(filepath.Join(r.dir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	var el []*CacheEntry
+	for _, m := range metas {
+		e, err := r.readMeta(m)
+		if err != nil {
+			logger.Infof("cache: dropping %v: %v", m, err)
+			r.remove(strings.TrimSuffix(filepath.Base(m), ".meta"))
+			continue
+		}
+		el = append(el, e)
+	}
+	sort.Slice(el, func(i, j int) bool {
+		return el[i].LastAccess.Before(el[j].LastAccess)
+	})
+
+	r.Lock()
+	defer r.Unlock()
+	for _, e := range el {
+		r.entries[e.Key] = r.lru.PushFront(e)
+		r.size += e.Size
+	}
+	r.evict()
+
+	// temporary files of interrupted writes
+	tmps, _ := filepath.Glob(filepath.Join(r.dir, "*.tmp*"))
+	for _, t := range tmps {
+		os.Remove(t)
+	}
+	return nil
+}
+
+func (r *HTTPCache) readMeta(path string) (*CacheEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e CacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(r.path(e.Key, ".resp"))
+	if err != nil {
+		return nil, err
+	}
+	e.Size = fi.Size()
+	return &e, nil
+}
+
+func (r *HTTPCache) writeMeta(e *CacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := r.path(e.Key, fmt.Sprintf(".tmp-meta-%v", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path(e.Key, ".meta"))
+}
+
+func (r *HTTPCache) remove(key string) {
+	os.Remove(r.path(key, ".meta"))
+	os.Remove(r.path(key, ".resp"))
+}
+
+// evict drops least recently used entries until the cache fits; lock must be held
+func (r *HTTPCache) evict() {
+	for r.size > r.maxSize && r.lru.Len() > 0 {
+		el := r.lru.Back()
+		e := el.Value.(*CacheEntry)
+		r.lru.Remove(el)
+		delete(r.entries, e.Key)
+		r.size -= e.Size
+		r.remove(e.Key)
+		logger.Debugf("cache: evicted %v", e.URL)
+	}
+}
+
+// Get returns the stored response for req if one matches its Vary headers
+func (r *HTTPCache) Get(req *http.Request) (*http.Response, *CacheEntry) {
+	key := cacheKey(req.URL.String())
+
+	r.Lock()
+	el, ok := r.entries[key]
+	if !ok {
+		r.misses++
+		r.Unlock()
+		return nil, nil
+	}
+	e := el.Value.(*CacheEntry)
+	for h, v := range e.Vary {
+		if req.Header.Get(h) != v {
+			r.misses++
+			r.Unlock()
+			return nil, nil
+		}
+	}
+	r.lru.MoveToFront(el)
+	r.hits++
+	e.Hits++
+	e.LastAccess = time.Now()
+	entry := *e
+	r.Unlock()
+
+	// removing the file later does not disturb readers that have it open
+	f, err := os.Open(r.path(key, ".resp"))
+	if err != nil {
+		r.Delete(entry.URL)
+		return nil, nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		f.Close()
+		r.Delete(entry.URL)
+		return nil, nil
+	}
+	resp.Body = &fileBody{ReadCloser: resp.Body, f: f}
+	go r.writeMeta(&entry)
+
+	return resp, &entry
+}
+
+type fileBody struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r *fileBody) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+// hop-by-hop headers are not stored
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func writeResponseHead(w io.Writer, resp *http.Response) error {
+	h := make(http.Header, len(resp.Header))
+	for k, v := range resp.Header {
+		h[k] = v
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if resp.ContentLength >= 0 {
+		h.Set("Content-Length", fmt.Sprintf("%v", resp.ContentLength))
+	}
+	// without Content-Length the body is read to end of file
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %v\r\n", statusLine(resp)); err != nil {
+		return err
+	}
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+func statusLine(resp *http.Response) string {
+	if resp.Status != "" {
+		if strings.HasPrefix(resp.Status, fmt.Sprintf("%v ", resp.StatusCode)) {
+			return resp.Status
+		}
+	}
+	return fmt.Sprintf("%v %v", resp.StatusCode, http.StatusText(resp.StatusCode))
+}
+
+// Store returns resp with its body teed into the cache. The entry is
+// committed when the body has been read completely and closed.
+func (r *HTTPCache) Store(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	limit := r.maxSize / 4
+	if resp.ContentLength > limit {
+		return resp
+	}
+	e := &CacheEntry{
+		URL:          req.URL.String(),
+		Key:          cacheKey(req.URL.String()),
+		Vary:         varyValues(req, resp),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	e.LastAccess = e.ResponseTime
+
+	tmp, err := ioutil.TempFile(r.dir, e.Key+".tmp")
+	if err != nil {
+		logger.Infof("cache: %v", err)
+		return resp
+	}
+	if err := writeResponseHead(tmp, resp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return resp
+	}
+	resp.Body = &cacheBody{
+		ReadCloser: resp.Body,
+		cache:      r,
+		entry:      e,
+		tmp:        tmp,
+		limit:      limit,
+		expected:   resp.ContentLength,
+	}
+	return resp
+}
+
+type cacheBody struct {
+	io.ReadCloser
+	cache    *HTTPCache
+	entry    *CacheEntry
+	tmp      *os.File
+	limit    int64
+	expected int64
+	written  int64
+	eof      bool
+	failed   bool
+}
+
+func (r *cacheBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.failed {
+		r.written += int64(n)
+		if r.written > r.limit {
+			r.failed = true
+		} else if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			r.failed = true
+		}
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *cacheBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.tmp.Close()
+
+	complete := r.eof && !r.failed && (r.expected < 0 || r.expected == r.written)
+	if !complete {
+		os.Remove(r.tmp.Name())
+		return err
+	}
+	r.cache.commit(r.entry, r.tmp.Name())
+	return err
+}
+
+func (r *HTTPCache) commit(e *CacheEntry, tmp string) {
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return
+	}
+	e.Size = fi.Size()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if err := os.Rename(tmp, r.path(e.Key, ".resp")); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if err := r.writeMeta(e); err != nil {
+		logger.Infof("cache: %v", err)
+	}
+	if el, ok := r.entries[e.Key]; ok {
+		r.size -= el.Value.(*CacheEntry).Size
+		r.lru.Remove(el)
+	}
+	r.entries[e.Key] = r.lru.PushFront(e)
+	r.size += e.Size
+	logger.Debugf("cache: stored %v size: %v", e.URL, e.Size)
+
+	r.evict()
+}
+
+// Update freshens a stored response with the headers of a 304 response
+func (r *HTTPCache) Update(req *http.Request, notModified *http.Response, requestTime time.Time) (*http.Response, *CacheEntry) {
+	stored, _ := r.Get(req)
+	if stored == nil {
+		return nil, nil
+	}
+	for k, v := range notModified.Header {
+		if k == "Content-Length" {
+			continue
+		}
+		stored.Header[k] = v
+	}
+
+	resp := r.Store(req, stored, requestTime)
+	// write through so the refreshed copy is committed
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	r.Lock()
+	defer r.Unlock()
+	el, ok := r.entries[cacheKey(req.URL.String())]
+	if !ok {
+		return resp, nil
+	}
+	e := *el.Value.(*CacheEntry)
+	return resp, &e
+}
+
+// Delete removes the entry for url
+func (r *HTTPCache) Delete(url string) bool {
+	key := cacheKey(url)
+
+	r.Lock()
+	defer r.Unlock()
+
+	el, ok := r.entries[key]
+	if !ok {
+		return false
+	}
+	r.size -= el.Value.(*CacheEntry).Size
+	r.lru.Remove(el)
+	delete(r.entries, key)
+	r.remove(key)
+	return true
+}
+
+// Purge removes all entries
+func (r *HTTPCache) Purge() int {
+	r.Lock()
+	defer r.Unlock()
+
+	n := len(r.entries)
+	for key := range r.entries {
+		r.remove(key)
+	}
+	r.entries = make(map[string]*list.Element)
+	r.lru.Init()
+	r.size = 0
+	return n
+}
+
+// Entries lists entries, most recently used first
+func (r *HTTPCache) Entries() []CacheEntry {
+	r.Lock()
+	defer r.Unlock()
+
+	el := make([]CacheEntry, 0, r.lru.Len())
+	for e := r.lru.Front(); e != nil; e = e.Next() {
+		el = append(el, *e.Value.(*CacheEntry))
+	}
+	return el
+}
+
+// Stats returns cache usage
+func (r *HTTPCache) Stats() CacheStats {
+	r.Lock()
+	defer r.Unlock()
+
+	return CacheStats{
+		Dir:     r.dir,
+		Size:    r.size,
+		MaxSize: r.maxSize,
+		Entries: len(r.entries),
+		Hits:    r.hits,
+		Misses:  r.misses,
+	}
+}
+
+// CacheHandlerFunc inspects the cache with GET and purges it with DELETE,
+// either completely or the entry given by the url parameter.
+func CacheHandlerFunc(cache *HTTPCache) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if cache == nil {
+			http.Error(w, "cache disabled", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case "GET", "HEAD":
+			json.NewEncoder(w).Encode(struct {
+				CacheStats
+				Items []CacheEntry `json:"items"`
+			}{
+				cache.Stats(),
+				cache.Entries(),
+			})
+		case "DELETE":
+			n := 0
+			if u := req.URL.Query().Get("url"); u != "" {
+				if cache.Delete(u) {
+					n = 1
+				}
+			} else {
+				n = cache.Purge()
+			}
+			json.NewEncoder(w).Encode(map[string]int{"purged": n})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func cacheResponse(req *http.Request, body string, header http.Header) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func storeResponse(t *testing.T, c *HTTPCache, req *http.Request, body string, header http.Header) {
+	resp := c.Store(req, cacheResponse(req, body, header), time.Now())
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if string(b) != body {
+		t.Fatalf("body passed through: %q", b)
+	}
+}
+
+func newTestCache(t *testing.T, size int64) (*HTTPCache, func()) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewHTTPCache(dir, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestHTTPCache(t *testing.T) {
+	c, cleanup := newTestCache(t, 1<<20)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "http://a.home/x", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	storeResponse(t, c, req, "hello", http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Vary":          {"Accept-Encoding"},
+	})
+
+	resp, e := c.Get(req)
+	if resp == nil {
+		t.Fatal("expected cached response")
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello" || e.Size == 0 {
+		t.Fatalf("got %q size: %v", b, e.Size)
+	}
+	if resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("headers not stored: %v", resp.Header)
+	}
+
+	// different variant
+	other := httptest.NewRequest("GET", "http://a.home/x", nil)
+	if resp, _ := c.Get(other); resp != nil {
+		t.Fatal("expected miss for other Vary value")
+	}
+
+	// entries survive reopening
+	reopened, err := NewHTTPCache(c.dir, c.maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := reopened.Stats(); s.Entries != 1 || s.Size != c.Stats().Size {
+		t.Fatalf("reopened stats: %+v", s)
+	}
+
+	if !c.Delete(req.URL.String()) || c.Stats().Entries != 0 {
+		t.Fatal("expected entry deleted")
+	}
+}
+
+func TestHTTPCacheIncomplete(t *testing.T) {
+	c, cleanup := newTestCache(t, 1<<20)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "http://a.home/partial", nil)
+	resp := c.Store(req, cacheResponse(req, "hello", http.Header{"Cache-Control": {"max-age=60"}}), time.Now())
+	resp.Body.Read(make([]byte, 2))
+	resp.Body.Close()
+
+	if c.Stats().Entries != 0 {
+		t.Fatal("partially read body must not be stored")
+	}
+}
+
+func TestHTTPCacheEviction(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	body := strings.Repeat("x", 200)
+	for i := 0; i < 8; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://a.home/%v", i), nil)
+		storeResponse(t, c, req, body, http.Header{"Cache-Control": {"max-age=60"}})
+		if i == 1 {
+			// keep /0 recently used
+			resp, _ := c.Get(httptest.NewRequest("GET", "http://a.home/0", nil))
+			if resp == nil {
+				t.Fatal("expected /0 cached")
+			}
+			resp.Body.Close()
+		}
+	}
+
+	s := c.Stats()
+	if s.Size > s.MaxSize {
+		t.Fatalf("size %v exceeds max %v", s.Size, s.MaxSize)
+	}
+	if resp, _ := c.Get(httptest.NewRequest("GET", "http://a.home/1", nil)); resp != nil {
+		t.Fatal("expected least recently used entry evicted")
+	}
+	if resp, _ := c.Get(httptest.NewRequest("GET", "http://a.home/7", nil)); resp == nil {
+		t.Fatal("expected newest entry cached")
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	get := httptest.NewRequest("GET", "http://a.home/", nil)
+	auth := httptest.NewRequest("GET", "http://a.home/", nil)
+	auth.Header.Set("Authorization", "Basic x")
+
+	tests := []struct {
+		req       *http.Request
+		status    int
+		header    http.Header
+		cacheable bool
+	}{
+		{get, 200, http.Header{"Cache-Control": {"max-age=10"}}, true},
+		{get, 200, http.Header{"Etag": {`"a"`}}, true},
+		{get, 200, http.Header{}, false},
+		{get, 200, http.Header{"Cache-Control": {"private, max-age=10"}}, false},
+		{get, 200, http.Header{"Cache-Control": {"no-store"}}, false},
+		{get, 200, http.Header{"Cache-Control": {"max-age=10"}, "Vary": {"*"}}, false},
+		{get, 200, http.Header{"Cache-Control": {"max-age=10"}, "Set-Cookie": {"a=b"}}, false},
+		{get, 500, http.Header{"Cache-Control": {"max-age=10"}}, false},
+		{auth, 200, http.Header{"Cache-Control": {"max-age=10"}}, false},
+		{auth, 200, http.Header{"Cache-Control": {"public, max-age=10"}}, true},
+		{httptest.NewRequest("POST", "http://a.home/", nil), 200, http.Header{"Cache-Control": {"max-age=10"}}, false},
+	}
+	for i, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: test.header}
+		if got := isCacheable(test.req, resp); got != test.cacheable {
+			t.Errorf("%v: isCacheable(%v %v) = %v", i, test.status, test.header, got)
+		}
+	}
+
+	now := time.Now()
+	e := &CacheEntry{RequestTime: now, ResponseTime: now}
+	date := now.UTC().Format(http.TimeFormat)
+
+	fresh := []struct {
+		reqCC  string
+		header http.Header
+		at     time.Duration
+		want   bool
+	}{
+		{"", http.Header{"Cache-Control": {"max-age=60"}}, 30 * time.Second, true},
+		{"", http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, false},
+		{"", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, 30 * time.Second, false},
+		{"", http.Header{"Cache-Control": {"s-maxage=60, max-age=1"}}, 30 * time.Second, true},
+		{"", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0, false},
+		{"", http.Header{"Date": {date}, "Expires": {now.Add(time.Minute).UTC().Format(http.TimeFormat)}}, 30 * time.Second, true},
+		{"", http.Header{"Date": {date}, "Last-Modified": {now.Add(-100 * time.Minute).UTC().Format(http.TimeFormat)}}, 5 * time.Minute, true},
+		{"", http.Header{"Date": {date}, "Last-Modified": {now.Add(-100 * time.Minute).UTC().Format(http.TimeFormat)}}, 15 * time.Minute, false},
+		{"max-age=10", http.Header{"Cache-Control": {"max-age=60"}}, 30 * time.Second, false},
+		{"no-cache", http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"max-stale", http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, true},
+		{"max-stale=10", http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, false},
+		{"max-stale", http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, 90 * time.Second, false},
+	}
+	for i, test := range fresh {
+		req := httptest.NewRequest("GET", "http://a.home/", nil)
+		if test.reqCC != "" {
+			req.Header.Set("Cache-Control", test.reqCC)
+		}
+		resp := &http.Response{StatusCode: 200, Header: test.header}
+		if got := canServe(req, resp, e, now.Add(test.at)); got != test.want {
+			t.Errorf("%v: canServe(%q, %v) at %v = %v", i, test.reqCC, test.header, test.at, got)
+		}
+	}
+}
+
+func TestCacheHandlerFunc(t *testing.T) {
+	c, cleanup := newTestCache(t, 1<<20)
+	defer cleanup()
+
+	for _, p := range []string{"a", "b"} {
+		req := httptest.NewRequest("GET", "http://a.home/"+p, nil)
+		storeResponse(t, c, req, p, http.Header{"Cache-Control": {"max-age=60"}})
+	}
+	h := CacheHandlerFunc(c)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/cache", nil))
+	var got struct {
+		Entries int          `json:"entries"`
+		Items   []CacheEntry `json:"items"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Entries != 2 || len(got.Items) != 2 {
+		t.Fatalf("unexpected listing: %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("DELETE", "/cache?url=http://a.home/a", nil))
+	if w.Code != 200 || c.Stats().Entries != 1 {
+		t.Fatalf("delete one: %v %v", w.Code, c.Stats())
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("DELETE", "/cache", nil))
+	if w.Code != 200 || c.Stats().Entries != 0 {
+		t.Fatalf("purge: %v %v", w.Code, c.Stats())
+	}
+
+	w = httptest.NewRecorder()
+	CacheHandlerFunc(nil)(w, httptest.NewRequest("GET", "/cache", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("disabled cache: %v", w.Code)
+	}
+}
+
+func TestCacheRevalidateEvicted(t *testing.T) {
+	c, cleanup := newTestCache(t, 1<<20)
+	defer cleanup()
+	h := &CacheHandler{cache: c, match: func(req *http.Request) bool { return true }}
+	header := http.Header{"Etag": {`"a"`}, "Cache-Control": {"no-cache"}}
+
+	for _, evict := range []bool{false, true} {
+		storeResponse(t, c, httptest.NewRequest("GET", "http://a.home/", nil), "stored", header)
+
+		req := httptest.NewRequest("GET", "http://a.home/", nil)
+		ctx := &goproxy.ProxyCtx{Req: req}
+		if _, resp := h.OnRequest(req, ctx); resp != nil || req.Header.Get("If-None-Match") != `"a"` {
+			t.Fatalf("not revalidated: %v %v", resp, req.Header)
+		}
+		if evict {
+			c.Delete(req.URL.String())
+		}
+		var refetched http.Header
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			refetched = cloneHeader(req.Header)
+			return cacheResponse(req, "fetched", http.Header{}), nil
+		})
+
+		// the client did not send a conditional request, it never
+		// gets the 304 of the origin
+		notModified := &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}
+		resp := h.OnResponse(notModified, ctx)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		expected := "stored"
+		if evict {
+			expected = "fetched"
+			if refetched == nil || refetched.Get("If-None-Match") != "" {
+				t.Errorf("refetched with %v", refetched)
+			}
+		}
+		if resp.StatusCode != 200 || string(b) != expected {
+			t.Errorf("evicted %v: got %v %q", evict, resp.StatusCode, b)
+		}
+	}
+}
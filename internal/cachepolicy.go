@@ -0,0 +1,380 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// RFC 7234 shared cache policy
+
+// status codes cacheable by default, RFC 7231 section 6.1
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// maximum heuristic freshness
+const maxHeuristic = 24 * time.Hour
+
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h["Cache-Control"] {
+		for _, d := range strings.Split(line, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			kv := strings.SplitN(d, "=", 2)
+			k := strings.ToLower(strings.TrimSpace(kv[0]))
+			v := ""
+			if len(kv) == 2 {
+				v = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+			cc[k] = v
+		}
+	}
+	// HTTP/1.0 Pragma: no-cache
+	if _, ok := cc["no-cache"]; !ok && len(h["Cache-Control"]) == 0 {
+		if strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+			cc["no-cache"] = ""
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// seconds returns the delta-seconds value of d
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		// invalid values are treated as stale
+		return 0, true
+	}
+	return time.Duration(s) * time.Second, true
+}
+
+// varyValues returns the request headers selected by the response's Vary
+func varyValues(req *http.Request, resp *http.Response) map[string]string {
+	var m map[string]string
+	for _, line := range resp.Header["Vary"] {
+		for _, h := range strings.Split(line, ",") {
+			h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+			if h == "" {
+				continue
+			}
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[h] = req.Header.Get(h)
+		}
+	}
+	return m
+}
+
+// isCacheable decides whether a shared cache may store resp, RFC 7234 section 3
+func isCacheable(req *http.Request, resp *http.Response) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	if !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if strings.Contains(resp.Header.Get("Vary"), "*") {
+		return false
+	}
+	// cookies are specific to the client
+	if len(resp.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+
+	// explicit freshness, a validator or heuristic freshness is required
+	if respCC.has("max-age") || respCC.has("s-maxage") || resp.Header.Get("Expires") != "" ||
+		respCC.has("public") || hasValidator(resp.Header) {
+		return true
+	}
+	return false
+}
+
+func hasValidator(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+func headerTime(h http.Header, k string) (time.Time, bool) {
+	v := h.Get(k)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// freshnessLifetime computes the freshness lifetime, RFC 7234 section 4.2.1
+func freshnessLifetime(resp *http.Response, e *CacheEntry) time.Duration {
+	cc := parseCacheControl(resp.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date, ok := headerTime(resp.Header, "Date")
+	if !ok {
+		date = e.ResponseTime
+	}
+	if v := resp.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// heuristic: 10% of the time since last modification
+	if lm, ok := headerTime(resp.Header, "Last-Modified"); ok && cacheableStatus[resp.StatusCode] {
+		h := date.Sub(lm) / 10
+		if h > maxHeuristic {
+			h = maxHeuristic
+		}
+		return h
+	}
+	return 0
+}
+
+// currentAge computes the age of a stored response, RFC 7234 section 4.2.3
+func currentAge(resp *http.Response, e *CacheEntry, now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, ok := headerTime(resp.Header, "Date"); ok {
+		apparent = e.ResponseTime.Sub(date)
+		if apparent < 0 {
+			apparent = 0
+		}
+	}
+	var age time.Duration
+	if s, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && s > 0 {
+		age = time.Duration(s) * time.Second
+	}
+	corrected := age + e.ResponseTime.Sub(e.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// canServe decides whether the stored response satisfies req without
+// contacting the origin, RFC 7234 section 4
+func canServe(req *http.Request, resp *http.Response, e *CacheEntry, now time.Time) bool {
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+
+	lifetime := freshnessLifetime(resp, e)
+	age := currentAge(resp, e, now)
+
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		lifetime -= d
+	}
+	if age < lifetime {
+		return true
+	}
+
+	// stale
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") {
+		return false
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		if d, _ := reqCC.seconds("max-stale"); age-lifetime <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheHandler hooks the HTTP cache into goproxy for routes selected by match
+type CacheHandler struct {
+	cache *HTTPCache
+	match func(req *http.Request) bool
+}
+
+// NewCacheHandler caches responses of requests routed to peer or localhost
+func NewCacheHandler(cache *HTTPCache, nb *Neighborhood) *CacheHandler {
+	return &CacheHandler{
+		cache: cache,
+		match: func(req *http.Request) bool {
+			if nb.Router == nil {
+				return false
+			}
+			route := nb.Router.MatchRoute(req.URL.Hostname())
+			if route == nil || len(route.Backend) == 0 || route.Proxy {
+				return false
+			}
+			switch route.Backend[0].Hostname {
+			case "peer", "localhost":
+				return true
+			}
+			return false
+		},
+	}
+}
+
+type cacheState struct {
+	requestTime time.Time
+	hit         bool
+	// stored response being revalidated
+	revalidate bool
+}
+
+func isUnsafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
+
+// OnRequest serves fresh stored responses and revalidates stale ones
+func (r *CacheHandler) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !r.match(req) {
+		return req, nil
+	}
+	st := &cacheState{
+		requestTime: time.Now(),
+	}
+	stateOf(ctx).cache = st
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return req, nil
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") {
+		return req, nil
+	}
+	// leave conditional requests of the client to the origin
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return req, nil
+	}
+
+	stored, e := r.cache.Get(req)
+	if stored == nil {
+		if reqCC.has("only-if-cached") {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, "not cached")
+		}
+		return req, nil
+	}
+
+	now := time.Now()
+	if canServe(req, stored, e, now) {
+		st.hit = true
+		return req, serveStored(req, stored, e, now, "HIT")
+	}
+
+	if !hasValidator(stored.Header) {
+		stored.Body.Close()
+		return req, nil
+	}
+	if etag := stored.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := stored.Header.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+	stored.Body.Close()
+	st.revalidate = true
+
+	return req, nil
+}
+
+func serveStored(req *http.Request, resp *http.Response, e *CacheEntry, now time.Time, status string) *http.Response {
+	resp.Request = req
+	// responses no longer stored keep the age the origin sent
+	if e != nil {
+		resp.Header.Set("Age", fmt.Sprintf("%v", int64(currentAge(resp, e, now)/time.Second)))
+	}
+	resp.Header.Set("X-Cache", status)
+	if req.Method == "HEAD" {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	return resp
+}
+
+// OnResponse stores cacheable responses and completes revalidation
+func (r *CacheHandler) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) (out *http.Response) {
+	st := stateOf(ctx).cache
+	if resp == nil || st == nil || st.hit || stateOf(ctx).handled("cache", resp) {
+		return resp
+	}
+	defer func(in *http.Response) {
+		stateOf(ctx).handle("cache", in, out)
+	}(resp)
+	req := ctx.Req
+
+	if isUnsafe(req.Method) {
+		if resp.StatusCode < 400 {
+			r.cache.Delete(req.URL.String())
+			for _, h := range []string{"Location", "Content-Location"} {
+				if u, err := req.URL.Parse(resp.Header.Get(h)); err == nil && u.Host == req.URL.Host {
+					r.cache.Delete(u.String())
+				}
+			}
+		}
+		return resp
+	}
+
+	if st.revalidate && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated, e := r.cache.Update(req, resp, st.requestTime)
+		if updated != nil {
+			return serveStored(req, updated, e, time.Now(), "REVALIDATED")
+		}
+		// the stored response is gone and the client did not ask
+		// for a 304, fetch it again
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		st.requestTime = time.Now()
+		var err error
+		if resp, err = ctx.RoundTrip(req); err != nil {
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+		}
+	}
+
+	if isCacheable(req, resp) {
+		resp = r.cache.Store(req, resp, st.requestTime)
+		resp.Header.Set("X-Cache", "MISS")
+	}
+	return resp
+}
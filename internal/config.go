@@ -0,0 +1,554 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+// default location of the configuration file below $DHNT_BASE
+const configFile = "etc/mirr.toml"
+
+// duration is a time.Duration read from strings such as "10m"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// fileConfig is the layout of the configuration file:
+//
+//	[listen]
+//	proxy = ":18080"
+//	dns = ":1053"
+//
+//	[routes]
+//	files = ["/opt/dhnt/etc/route.conf"]
+//
+// See dhnt/etc/mirr.toml for all settings.
+type fileConfig struct {
+	Listen struct {
+		Proxy string
+		HTTPS string
+		DNS   string
+	}
+	TLS struct {
+		Cert string
+		Key  string
+	}
+	IPFS struct {
+		API  string
+		Host string
+		Path string
+	}
+	Share struct {
+		Name         string
+		Services     []string
+		InviteMaxAge *duration `toml:"invite_max_age"`
+	}
+	Routes struct {
+		Files []string
+	}
+	Log struct {
+		Level string
+		File  string
+	}
+	Admin struct {
+		Tokens    []string
+		TokenFile string `toml:"token_file"`
+		LocalOnly *bool  `toml:"local_only"`
+	}
+	Peer struct {
+		Exits       []string
+		Allow       []string
+		Deny        []string
+		Limits      []string
+		Book        string
+		Pool        string
+		MaxConns    int       `toml:"max_conns"`
+		IdleTimeout *duration `toml:"idle_timeout"`
+	}
+	DNS struct {
+		Upstream string
+		Answer   []string
+		Clients  []string
+	}
+	Cache struct {
+		Dir string
+		// Size is in MB
+		Size *int64
+	}
+	PAC struct {
+		Socks    string
+		Fallback string
+	}
+	Health struct {
+		Probes []string
+	}
+	Tunnel struct {
+		IdleTimeout *duration `toml:"idle_timeout"`
+	}
+	Forward []struct {
+		Listen         string
+		Target         string
+		Proto          string
+		SendProxy      int      `toml:"send_proxy"`
+		AcceptProxy    bool     `toml:"accept_proxy"`
+		TrustedProxies []string `toml:"trusted_proxies"`
+		Peers          bool
+		IdleTimeout    *duration `toml:"idle_timeout"`
+	}
+	Publish []struct {
+		Name   string
+		Target string
+		Allow  []string
+	}
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() *Config {
+	c := &Config{
+		Listen:          ":18080",
+		Port:            18080,
+		RouteFiles:      []string{"route.conf"},
+		IPFSAPI:         apiBase,
+		IPFSHost:        apiHost,
+		AdminLocalOnly:  true,
+		PeerPool:        PeerPoolH2C,
+		PeerMaxConns:    DefaultPeerMaxConns,
+		PeerIdleTimeout: DefaultPeerIdleTimeout,
+		PACFallback:     PACFallbackProxy,
+		DNSUpstream:     "8.8.8.8:53",
+		CacheSize:       256 << 20,
+		IdleTimeout:     DefaultIdleTimeout,
+		InviteMaxAge:    DefaultInviteMaxAge,
+	}
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		c.RouteFiles = []string{filepath.Join(base, "etc", "route.conf")}
+		c.CacheDir = filepath.Join(base, "cache")
+	}
+	return c
+}
+
+// DefaultConfigFile returns the configuration file used if none is given:
+// $MIRR_CONFIG or $DHNT_BASE/etc/mirr.toml if it exists
+func DefaultConfigFile() string {
+	if p := os.Getenv("MIRR_CONFIG"); p != "" {
+		return p
+	}
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		p := filepath.Join(base, configFile)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads the configuration file at path on top of the defaults,
+// then applies environment overrides. Command line flags are applied by
+// the caller, followed by Validate.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.ReadEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadFile applies the settings of a TOML configuration file
+func (c *Config) ReadFile(path string) error {
+	var f fileConfig
+	md, err := toml.DecodeFile(path, &f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		var ks []string
+		for _, k := range keys {
+			ks = append(ks, k.String())
+		}
+		return fmt.Errorf("%v: unknown settings: %v", path, strings.Join(ks, ", "))
+	}
+
+	// relative paths are relative to the configuration file
+	dir := filepath.Dir(path)
+	rel := func(p string) string {
+		p = os.ExpandEnv(p)
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	setString := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setList := func(dst *[]string, v []string) {
+		if v != nil {
+			*dst = v
+		}
+	}
+
+	if f.Listen.Proxy != "" {
+		c.SetListen(f.Listen.Proxy)
+	}
+	setString(&c.HTTPSListen, f.Listen.HTTPS)
+	setString(&c.DNSListen, f.Listen.DNS)
+	setString(&c.TLSCert, rel(f.TLS.Cert))
+	setString(&c.TLSKey, rel(f.TLS.Key))
+	setString(&c.IPFSAPI, f.IPFS.API)
+	setString(&c.IPFSHost, f.IPFS.Host)
+	setString(&c.IPFSPath, rel(f.IPFS.Path))
+	setString(&c.ShareName, f.Share.Name)
+	setList(&c.ShareServices, f.Share.Services)
+	if f.Share.InviteMaxAge != nil {
+		c.InviteMaxAge = f.Share.InviteMaxAge.Duration
+	}
+	setString(&c.AddressBook, rel(f.Peer.Book))
+	setString(&c.PeerPool, f.Peer.Pool)
+	if f.Peer.MaxConns != 0 {
+		c.PeerMaxConns = f.Peer.MaxConns
+	}
+	if f.Peer.IdleTimeout != nil {
+		c.PeerIdleTimeout = f.Peer.IdleTimeout.Duration
+	}
+	if f.Routes.Files != nil {
+		c.RouteFiles = nil
+		for _, p := range f.Routes.Files {
+			c.RouteFiles = append(c.RouteFiles, rel(p))
+		}
+	}
+	setString(&c.LogLevel, f.Log.Level)
+	setString(&c.LogFile, rel(f.Log.File))
+	setList(&c.AdminTokens, f.Admin.Tokens)
+	setString(&c.AdminTokenFile, rel(f.Admin.TokenFile))
+	if f.Admin.LocalOnly != nil {
+		c.AdminLocalOnly = *f.Admin.LocalOnly
+	}
+	setList(&c.ExitPeers, f.Peer.Exits)
+	setList(&c.AllowPeers, f.Peer.Allow)
+	setList(&c.DenyPeers, f.Peer.Deny)
+	setList(&c.Limits, f.Peer.Limits)
+	setString(&c.DNSUpstream, f.DNS.Upstream)
+	setList(&c.DNSAddrs, f.DNS.Answer)
+	setList(&c.DNSClients, f.DNS.Clients)
+	setString(&c.CacheDir, rel(f.Cache.Dir))
+	if f.Cache.Size != nil {
+		c.CacheSize = *f.Cache.Size << 20
+	}
+	setString(&c.PACSocks, f.PAC.Socks)
+	setString(&c.PACFallback, f.PAC.Fallback)
+	setList(&c.HealthProbes, f.Health.Probes)
+	if f.Tunnel.IdleTimeout != nil {
+		c.IdleTimeout = f.Tunnel.IdleTimeout.Duration
+	}
+	if f.Forward != nil {
+		c.Forwards = nil
+		for _, fw := range f.Forward {
+			spec := ForwardSpec{Listen: fw.Listen, Target: fw.Target}
+			spec.Proto = fw.Proto
+			spec.SendProxy = fw.SendProxy
+			spec.AcceptProxy = fw.AcceptProxy
+			spec.TrustedProxies = fw.TrustedProxies
+			spec.Peers = fw.Peers
+			if fw.IdleTimeout != nil {
+				spec.IdleTimeout = fw.IdleTimeout.Duration
+			}
+			c.Forwards = append(c.Forwards, spec)
+		}
+	}
+	if f.Publish != nil {
+		c.Publish = nil
+		for _, p := range f.Publish {
+			c.Publish = append(c.Publish, PublishSpec{Name: p.Name, Target: p.Target, Allow: p.Allow})
+		}
+	}
+	return nil
+}
+
+// SetListen sets the proxy address, a bare port listens on all interfaces
+func (c *Config) SetListen(addr string) {
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+	c.Listen = addr
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		c.Port, _ = strconv.Atoi(p)
+	}
+}
+
+// environment overrides
+var configEnv = []struct {
+	name string
+	set  func(c *Config, v string) error
+}{
+	{"MIRR_LISTEN", func(c *Config, v string) error { c.SetListen(v); return nil }},
+	{"MIRR_HTTPS_LISTEN", func(c *Config, v string) error { c.HTTPSListen = v; return nil }},
+	{"MIRR_DNS_LISTEN", func(c *Config, v string) error { c.DNSListen = v; return nil }},
+	{"MIRR_ROUTES", func(c *Config, v string) error { c.RouteFiles = filepath.SplitList(v); return nil }},
+	{"MIRR_IPFS_API", func(c *Config, v string) error { c.IPFSAPI = v; return nil }},
+	{"MIRR_IPFS_HOST", func(c *Config, v string) error { c.IPFSHost = v; return nil }},
+	{"IPFS_PATH", func(c *Config, v string) error { c.IPFSPath = v; return nil }},
+	{"log_level", func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"log_file", func(c *Config, v string) error { c.LogFile = v; return nil }},
+	{"MIRR_LOG_LEVEL", func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"MIRR_LOG_FILE", func(c *Config, v string) error { c.LogFile = v; return nil }},
+	{"MIRR_ADMIN_TOKEN_FILE", func(c *Config, v string) error { c.AdminTokenFile = v; return nil }},
+	{"MIRR_CACHE_DIR", func(c *Config, v string) error { c.CacheDir = v; return nil }},
+	{"MIRR_IDLE_TIMEOUT", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.IdleTimeout = d
+		return err
+	}},
+}
+
+// ReadEnv applies the MIRR_* environment overrides looked up with getenv
+func (c *Config) ReadEnv(getenv func(string) string) error {
+	for _, e := range configEnv {
+		v := getenv(e.name)
+		if v == "" {
+			continue
+		}
+		if err := e.set(c, v); err != nil {
+			return fmt.Errorf("%v: %v", e.name, err)
+		}
+	}
+	return nil
+}
+
+// ConfigError lists all problems found in a configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+func checkListen(addr string) error {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", p)
+	}
+	return nil
+}
+
+func checkPeers(ids []string) []string {
+	var bad []string
+	for _, id := range ids {
+		if ToPeerID(id) == "" {
+			bad = append(bad, id)
+		}
+	}
+	return bad
+}
+
+// Validate checks the settings and returns a ConfigError describing all problems
+func (c *Config) Validate() error {
+	var errs ConfigError
+	add := func(key string, format string, args ...interface{}) {
+		errs = append(errs, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if err := checkListen(c.Listen); err != nil {
+		add("listen.proxy", "%v", err)
+	} else if c.Port <= 0 {
+		add("listen.proxy", "a port is required for p2p: %q", c.Listen)
+	}
+	if c.HTTPSListen != "" {
+		if err := checkListen(c.HTTPSListen); err != nil {
+			add("listen.https", "%v", err)
+		}
+		if c.TLSCert == "" || c.TLSKey == "" {
+			add("listen.https", "requires tls.cert and tls.key")
+		}
+	}
+	for key, p := range map[string]string{"tls.cert": c.TLSCert, "tls.key": c.TLSKey} {
+		if p == "" {
+			continue
+		}
+		if _, err := os.Stat(p); err != nil {
+			add(key, "%v", err)
+		}
+	}
+	if c.DNSListen != "" {
+		if err := checkListen(c.DNSListen); err != nil {
+			add("listen.dns", "%v", err)
+		}
+	}
+
+	if u, err := url.Parse(c.IPFSAPI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("ipfs.api", "not an http URL: %q", c.IPFSAPI)
+	}
+	if c.IPFSHost == "" {
+		add("ipfs.host", "required")
+	}
+
+	if len(c.RouteFiles) == 0 {
+		add("routes.files", "at least one route file is required")
+	} else if err := NewRouteRegistry("").ReadFiles(c.RouteFiles); err != nil {
+		add("routes.files", "%v", err)
+	}
+
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			add("log.level", "%v", err)
+		}
+	}
+
+	for _, t := range c.AdminTokens {
+		if len(t) < minTokenLength {
+			add("admin.tokens", "tokens must have at least %v characters", minTokenLength)
+			break
+		}
+	}
+	if c.AdminTokenFile != "" {
+		if _, err := readTokenFile(c.AdminTokenFile); err != nil {
+			add("admin.token_file", "%v", err)
+		}
+	}
+
+	if bad := checkPeers(c.ExitPeers); bad != nil {
+		add("peer.exits", "invalid peer addresses: %v", bad)
+	}
+	if bad := checkPeers(c.AllowPeers); bad != nil {
+		add("peer.allow", "invalid peer addresses: %v", bad)
+	}
+	if bad := checkPeers(c.DenyPeers); bad != nil {
+		add("peer.deny", "invalid peer addresses: %v", bad)
+	}
+	if _, err := NewLimiter(c.Limits); err != nil {
+		add("peer.limits", "%v", err)
+	}
+
+	switch c.PeerPool {
+	case "", PeerPoolH2C, PeerPoolHTTP1, PeerPoolOff:
+	default:
+		add("peer.pool", "must be %v, %v or %v: %q", PeerPoolH2C, PeerPoolHTTP1, PeerPoolOff, c.PeerPool)
+	}
+	if c.PeerMaxConns < 0 {
+		add("peer.max_conns", "must not be negative")
+	}
+
+	if c.DNSListen != "" && c.DNSUpstream == "" {
+		add("dns.upstream", "required with listen.dns")
+	}
+	for _, a := range c.DNSAddrs {
+		if net.ParseIP(a) == nil {
+			add("dns.answer", "invalid address: %q", a)
+		}
+	}
+	if _, err := parseNetworks(c.DNSClients); err != nil {
+		add("dns.clients", "%v", err)
+	}
+
+	if c.CacheSize < 0 {
+		add("cache.size", "must not be negative")
+	}
+	if c.PACFallback != PACFallbackProxy && c.PACFallback != PACFallbackDirect {
+		add("pac.fallback", "must be %v or %v: %q", PACFallbackProxy, PACFallbackDirect, c.PACFallback)
+	}
+	if c.PACSocks != "" {
+		if _, _, err := net.SplitHostPort(c.PACSocks); err != nil {
+			add("pac.socks", "%v", err)
+		}
+	}
+	for _, p := range c.HealthProbes {
+		if u, err := url.Parse(p); err != nil || !u.IsAbs() || u.Host == "" {
+			add("health.probes", "not an absolute URL: %q", p)
+		}
+	}
+	if c.IdleTimeout <= 0 {
+		add("tunnel.idle_timeout", "must be positive")
+	}
+	if c.InviteMaxAge < 0 {
+		add("share.invite_max_age", "must not be negative")
+	}
+	listens := make(map[string]bool)
+	for _, fw := range c.Forwards {
+		if err := fw.Validate(); err != nil {
+			add("forward", "%v", err)
+			continue
+		}
+		if listens[fw.key()] {
+			add("forward", "%v listened on twice", fw.Listen)
+		}
+		listens[fw.key()] = true
+	}
+	names := make(map[string]bool)
+	for _, p := range c.Publish {
+		if err := p.Validate(); err != nil {
+			add("publish", "%v", err)
+			continue
+		}
+		if names[p.Name] {
+			add("publish", "%v published twice", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// PeerAllowed reports whether the peer may use this node
+func (c *Config) PeerAllowed(id string) bool {
+	if c == nil {
+		return true
+	}
+	for _, d := range c.DenyPeers {
+		if ToPeerID(d) == id {
+			return false
+		}
+	}
+	if len(c.AllowPeers) == 0 {
+		return true
+	}
+	for _, a := range c.AllowPeers {
+		if ToPeerID(a) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the process wide settings: logging and the IPFS API
+func (c *Config) Apply() {
+	if c.LogLevel != "" || c.LogFile != "" {
+		SetLogging(c.LogLevel, c.LogFile)
+	}
+	SetIPFSAPI(c.IPFSAPI, c.IPFSHost)
+}
+
+// String formats the settings for logs with admin tokens redacted
+func (c *Config) String() string {
+	r := *c
+	if len(r.AdminTokens) > 0 {
+		r.AdminTokens = []string{fmt.Sprintf("<%v redacted>", len(c.AdminTokens))}
+	}
+	type plain Config
+	return fmt.Sprintf("%+v", plain(r))
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirr-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, dir, "route.conf", "home 127.0.0.1:8080\n")
+	p := writeTestFile(t, dir, "mirr.toml", `
+[listen]
+proxy = "127.0.0.1:19090"
+dns = ":1053"
+
+[ipfs]
+api = "http://127.0.0.1:5001/api/v0"
+
+[routes]
+files = ["route.conf"]
+
+[peer]
+deny = ["QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"]
+limits = ["peer:exit,rate=1Mbit"]
+
+[cache]
+size = 16
+
+[tunnel]
+idle_timeout = "30s"
+
+[[forward]]
+listen = "127.0.0.1:2222"
+target = "git.home:22"
+send_proxy = 2
+accept_proxy = true
+trusted_proxies = ["10.0.0.0/24"]
+
+[[forward]]
+listen = "127.0.0.1:5353"
+target = "dns.home:53"
+proto = "udp"
+idle_timeout = "1m"
+
+[[publish]]
+name = "ssh"
+target = "127.0.0.1:22"
+allow = ["QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N"]
+`)
+
+	c := DefaultConfig()
+	if err := c.ReadFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "127.0.0.1:19090" || c.Port != 19090 {
+		t.Errorf("listen: %v %v", c.Listen, c.Port)
+	}
+	if len(c.RouteFiles) != 1 || c.RouteFiles[0] != filepath.Join(dir, "route.conf") {
+		t.Errorf("route files: %v", c.RouteFiles)
+	}
+	if c.CacheSize != 16<<20 || c.IdleTimeout != 30*time.Second {
+		t.Errorf("cache size %v idle timeout %v", c.CacheSize, c.IdleTimeout)
+	}
+	if c.DNSUpstream != "8.8.8.8:53" {
+		t.Errorf("default not kept: %v", c.DNSUpstream)
+	}
+	if len(c.Forwards) != 2 || c.Forwards[0].SendProxy != 2 || len(c.Forwards[0].TrustedProxies) != 1 || c.Forwards[1].Proto != "udp" || c.Forwards[1].IdleTimeout != time.Minute {
+		t.Errorf("forwards: %+v", c.Forwards)
+	}
+	if len(c.Publish) != 1 || c.Publish[0].Name != "ssh" || len(c.Publish[0].Allow) != 1 {
+		t.Errorf("publish: %+v", c.Publish)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.PeerAllowed("QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk") {
+		t.Error("denied peer allowed")
+	}
+
+	env := map[string]string{
+		"MIRR_LISTEN":    "18081",
+		"MIRR_LOG_LEVEL": "warn",
+	}
+	if err := c.ReadEnv(func(k string) string { return env[k] }); err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":18081" || c.Port != 18081 || c.LogLevel != "warn" {
+		t.Errorf("env: %v %v %v", c.Listen, c.Port, c.LogLevel)
+	}
+
+	bad := writeTestFile(t, dir, "bad.toml", "[listen]\nproxi = \":1\"\n")
+	if err := DefaultConfig().ReadFile(bad); err == nil || !strings.Contains(err.Error(), "listen.proxi") {
+		t.Errorf("expected unknown setting error, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirr-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	routes := writeTestFile(t, dir, "route.conf", "home 127.0.0.1:8080\nbroken\n")
+
+	c := DefaultConfig()
+	c.SetListen("localhost:http-alt")
+	c.HTTPSListen = ":18443"
+	c.RouteFiles = []string{routes}
+	c.IPFSAPI = "127.0.0.1:5001"
+	c.LogLevel = "loud"
+	c.ExitPeers = []string{"nobody"}
+	c.Limits = []string{"peer:exit,rate=fast"}
+	c.DNSAddrs = []string{"10.0.0.256"}
+	c.PACFallback = "maybe"
+	c.InviteMaxAge = -time.Hour
+	c.Forwards = []ForwardSpec{
+		{Listen: ":2222", Target: "git.home"},
+		{Listen: ":8443", Target: "127.0.0.1:443", ForwardOptions: ForwardOptions{AcceptProxy: true, TrustedProxies: []string{"lb.home"}}},
+	}
+	c.Publish = []PublishSpec{{Name: "git", Target: "127.0.0.1:9418"}, {Name: "www", Target: "127.0.0.1:80", Allow: []string{"*"}}}
+
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	msg := err.Error()
+	for _, key := range []string{
+		"listen.proxy:",
+		"listen.https: requires tls.cert",
+		"ipfs.api:",
+		"routes.files: " + routes + ":2:",
+		"log.level:",
+		"peer.exits:",
+		"peer.limits:",
+		"dns.answer:",
+		"pac.fallback:",
+		"share.invite_max_age:",
+		"forward: target",
+		`forward: :8443: invalid trusted proxy "lb.home"`,
+		"publish: git: allow is required",
+		"publish: www: reserved",
+	} {
+		if !strings.Contains(msg, key) {
+			t.Errorf("missing %q in:\n%v", key, msg)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression
+type CronSchedule struct {
+	expr string
+	loc  *time.Location
+
+	// bit i is set if value i matches
+	second, minute, hour, dom, month, dow uint64
+	// a day matches either day field if both are restricted
+	domStar, dowStar bool
+}
+
+// CronError reports a syntax error of a cron expression
+type CronError struct {
+	Expr  string
+	Field string
+	// Pos is the byte offset of the error in Expr
+	Pos int
+	Msg string
+}
+
+func (e *CronError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("cron %q: column %v: %v", e.Expr, e.Pos+1, e.Msg)
+	}
+	return fmt.Sprintf("cron %q: %v at column %v: %v", e.Expr, e.Field, e.Pos+1, e.Msg)
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+	// anyOK allows ? for no specific value
+	anyOK bool
+}
+
+var cronFields = []cronField{
+	{name: "second", min: 0, max: 59},
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31, anyOK: true},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, anyOK: true, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronToken is a word of an expression and its offset
+type cronToken struct {
+	s   string
+	pos int
+}
+
+func cronTokens(expr string) []cronToken {
+	var list []cronToken
+	start := -1
+	for i, c := range expr + " " {
+		if c == ' ' || c == '\t' {
+			if start >= 0 {
+				list = append(list, cronToken{expr[start:i], start})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	return list
+}
+
+// ParseCron parses a cron expression in the local time zone. Expressions
+// have 5 fields, minute hour day-of-month month day-of-week, or 6 with
+// leading seconds. Fields are lists of values, ranges as in 1-5, and steps
+// as in */15 or 8-18/2; months and days of week may be given by their
+// first three letters. @yearly, @annually, @monthly, @weekly, @daily,
+// @midnight and @hourly are short for the usual expressions. A leading
+// CRON_TZ=Europe/Berlin or TZ=... selects the time zone.
+func ParseCron(expr string) (*CronSchedule, error) {
+	return ParseCronIn(expr, time.Local)
+}
+
+// ParseCronIn parses a cron expression in the time zone loc
+func ParseCronIn(expr string, loc *time.Location) (*CronSchedule, error) {
+	s := &CronSchedule{expr: expr, loc: loc}
+	tokens := cronTokens(expr)
+	if len(tokens) > 0 && (strings.HasPrefix(tokens[0].s, "CRON_TZ=") || strings.HasPrefix(tokens[0].s, "TZ=")) {
+		name := tokens[0].s[strings.IndexByte(tokens[0].s, '=')+1:]
+		l, err := time.LoadLocation(name)
+		if err != nil || name == "" {
+			return nil, &CronError{Expr: expr, Pos: tokens[0].pos, Msg: fmt.Sprintf("unknown time zone %q", name)}
+		}
+		s.loc = l
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil, &CronError{Expr: expr, Pos: len(expr), Msg: "empty expression"}
+	}
+
+	if strings.HasPrefix(tokens[0].s, "@") {
+		alias, ok := cronAliases[strings.ToLower(tokens[0].s)]
+		if !ok {
+			return nil, &CronError{Expr: expr, Pos: tokens[0].pos, Msg: fmt.Sprintf("unknown alias %q", tokens[0].s)}
+		}
+		if len(tokens) > 1 {
+			return nil, &CronError{Expr: expr, Pos: tokens[1].pos, Msg: "unexpected field after alias"}
+		}
+		a, err := ParseCronIn(alias, s.loc)
+		if err != nil {
+			return nil, err
+		}
+		a.expr = expr
+		return a, nil
+	}
+
+	fields := cronFields
+	switch len(tokens) {
+	case 5:
+		fields = fields[1:]
+		s.second = 1
+	case 6:
+	default:
+		end := len(expr)
+		if len(tokens) > 6 {
+			end = tokens[6].pos
+		}
+		return nil, &CronError{Expr: expr, Pos: end, Msg: fmt.Sprintf("expected 5 or 6 fields, got %v", len(tokens))}
+	}
+	bits := []*uint64{&s.second, &s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	bits = bits[len(bits)-len(fields):]
+	for i, f := range fields {
+		b, err := f.parse(expr, tokens[i])
+		if err != nil {
+			return nil, err
+		}
+		*bits[i] = b
+	}
+	// Sunday is 0 or 7
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domStar = isCronStar(tokens[len(tokens)-3].s)
+	s.dowStar = isCronStar(tokens[len(tokens)-1].s)
+	return s, nil
+}
+
+func isCronStar(s string) bool {
+	return strings.HasPrefix(s, "*") || strings.HasPrefix(s, "?")
+}
+
+// parse returns the bits of the values of the field in t
+func (f *cronField) parse(expr string, t cronToken) (uint64, error) {
+	fail := func(pos int, format string, args ...interface{}) (uint64, error) {
+		return 0, &CronError{Expr: expr, Field: f.name, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	var bits uint64
+	pos := t.pos
+	for _, item := range strings.Split(t.s, ",") {
+		if item == "" {
+			return fail(pos, "empty list item")
+		}
+		span, step := item, ""
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			span, step = item[:i], item[i+1:]
+		}
+
+		var lo, hi int
+		switch {
+		case span == "*" || span == "?":
+			if span == "?" && !f.anyOK {
+				return fail(pos, "? is only allowed for days")
+			}
+			lo, hi = f.min, f.max
+		default:
+			from, to := span, ""
+			if i := strings.IndexByte(span, '-'); i >= 0 {
+				from, to = span[:i], span[i+1:]
+			}
+			var err error
+			if lo, err = f.value(from); err != nil {
+				return fail(pos, "%v", err)
+			}
+			hi = lo
+			if to != "" || len(from) < len(span) {
+				if hi, err = f.value(to); err != nil {
+					return fail(pos+len(from)+1, "%v", err)
+				}
+				if hi < lo {
+					return fail(pos, "range %v is backwards", span)
+				}
+			} else if step != "" {
+				// 5/15 starts at 5
+				hi = f.max
+			}
+		}
+
+		n := 1
+		if step != "" || len(span) < len(item) {
+			var err error
+			n, err = strconv.Atoi(step)
+			if err != nil || n <= 0 {
+				return fail(pos+len(span)+1, "invalid step %q", step)
+			}
+		}
+		for v := lo; v <= hi; v += n {
+			bits |= 1 << uint(v)
+		}
+		pos += len(item) + 1
+	}
+	return bits, nil
+}
+
+// value parses a number or name of the field
+func (f *cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%v out of range %v-%v", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// String returns the expression
+func (s *CronSchedule) String() string {
+	return s.expr
+}
+
+// Location returns the time zone of the schedule
+func (s *CronSchedule) Location() *time.Location {
+	return s.loc
+}
+
+// In returns the schedule in the time zone loc
+func (s *CronSchedule) In(loc *time.Location) *CronSchedule {
+	c := *s
+	c.loc = loc
+	return &c
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// cronYears bounds the search of Next for expressions that never match,
+// such as February 30
+const cronYears = 5
+
+// Next returns the first time after t matching the schedule, the zero time
+// if there is none. Times skipped by daylight saving changes do not match,
+// repeated ones match twice.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	limit := t.Year() + cronYears
+
+wrap:
+	if t.Year() > limit {
+		return time.Time{}
+	}
+	for s.month&(1<<uint(t.Month())) == 0 {
+		t = cronDate(t.Year(), t.Month()+1, 1, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+	for !s.dayMatches(t) {
+		t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+	for s.hour&(1<<uint(t.Hour())) == 0 {
+		// step in elapsed time so that an hour repeated when clocks go back
+		// is visited both times
+		day := t.Day()
+		t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+		if t.Day() != day {
+			goto wrap
+		}
+	}
+	for s.minute&(1<<uint(t.Minute())) == 0 {
+		hour := t.Hour()
+		t = t.Truncate(time.Minute).Add(time.Minute)
+		if t.Hour() != hour {
+			goto wrap
+		}
+	}
+	for s.second&(1<<uint(t.Second())) == 0 {
+		min := t.Minute()
+		t = t.Truncate(time.Second).Add(time.Second)
+		if t.Minute() != min {
+			goto wrap
+		}
+	}
+	return t
+}
+
+// cronDate is time.Date in loc moving times skipped by daylight saving
+// forward by the length of the skip rather than back
+func cronDate(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	wall := time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	if d := wall.Sub(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)); d > 0 {
+		t = t.Add(d)
+	}
+	return t
+}
+
+func (s *CronSchedule) nextRun() (time.Duration, error) {
+	now := time.Now()
+	next := s.Next(now)
+	if next.IsZero() {
+		return 0, fmt.Errorf("cron %q never runs", s.expr)
+	}
+	return next.Sub(now), nil
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expr, from, next string
+	}{
+		{"* * * * *", "2024-03-10T10:20:30Z", "2024-03-10T10:21:00Z"},
+		{"*/15 * * * *", "2024-03-10T10:20:30Z", "2024-03-10T10:30:00Z"},
+		{"0 9-17/4 * * *", "2024-03-10T13:00:00Z", "2024-03-10T17:00:00Z"},
+		{"0 9-17/4 * * *", "2024-03-10T17:00:00Z", "2024-03-11T09:00:00Z"},
+		{"30 8,12,18 * * *", "2024-03-10T12:30:00Z", "2024-03-10T18:30:00Z"},
+		{"0 0 1 * *", "2024-01-31T12:00:00Z", "2024-02-01T00:00:00Z"},
+		{"0 0 31 * *", "2024-04-01T00:00:00Z", "2024-05-31T00:00:00Z"},
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 12 * * mon-fri", "2024-03-08T12:00:00Z", "2024-03-11T12:00:00Z"},
+		{"0 12 * * 7", "2024-03-08T12:00:00Z", "2024-03-10T12:00:00Z"},
+		{"0 0 * JAN,jul *", "2024-03-08T12:00:00Z", "2024-07-01T00:00:00Z"},
+		// either day field matches if both are restricted
+		{"0 0 13 * 5", "2024-03-10T00:00:00Z", "2024-03-13T00:00:00Z"},
+		{"0 0 13 * 5", "2024-03-13T00:00:00Z", "2024-03-15T00:00:00Z"},
+		{"0 0 ? * 5", "2024-03-10T00:00:00Z", "2024-03-15T00:00:00Z"},
+		{"*/20 * * * * *", "2024-03-10T10:20:30.5Z", "2024-03-10T10:20:40Z"},
+		{"5/20 0 0 * * *", "2024-03-10T00:00:25Z", "2024-03-10T00:00:45Z"},
+		{"@hourly", "2024-12-31T23:59:59Z", "2025-01-01T00:00:00Z"},
+		{"@weekly", "2024-03-10T00:00:00Z", "2024-03-17T00:00:00Z"},
+		{"@yearly", "2024-03-10T00:00:00Z", "2025-01-01T00:00:00Z"},
+		{"0 0 30 2 *", "2024-03-10T00:00:00Z", ""},
+	}
+	for _, c := range cases {
+		s, err := ParseCronIn(c.expr, time.UTC)
+		if err != nil {
+			t.Errorf("%v: %v", c.expr, err)
+			continue
+		}
+		from, _ := time.Parse(time.RFC3339Nano, c.from)
+		next := s.Next(from)
+		got := ""
+		if !next.IsZero() {
+			got = next.Format(time.RFC3339)
+		}
+		if got != c.next {
+			t.Errorf("%v after %v: expected %v, got %v", c.expr, c.from, c.next, got)
+		}
+	}
+}
+
+func TestCronTimeZone(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := ParseCron("CRON_TZ=America/New_York 0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Location().String() != "America/New_York" {
+		t.Errorf("location: %v", s.Location())
+	}
+	from := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	if next := s.Next(from); !next.Equal(time.Date(2024, 3, 9, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("before DST: %v", next)
+	}
+	if next := s.Next(time.Date(2024, 3, 9, 14, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2024, 3, 10, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("after DST: %v", next)
+	}
+
+	// 02:30 does not exist on the day clocks go forward
+	s, _ = ParseCronIn("30 2 * * *", ny)
+	if next := s.Next(time.Date(2024, 3, 10, 0, 0, 0, 0, ny)); !next.Equal(time.Date(2024, 3, 11, 2, 30, 0, 0, ny)) {
+		t.Errorf("skipped time: %v", next)
+	}
+
+	// 02:30 happens twice on the day clocks go back
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, _ = ParseCronIn("30 2 * * *", berlin)
+	next := s.Next(time.Date(2026, 10, 25, 1, 0, 0, 0, berlin))
+	if !next.Equal(time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC)) {
+		t.Errorf("repeated time, first: %v", next)
+	}
+	if next = s.Next(next); !next.Equal(time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC)) {
+		t.Errorf("repeated time, second: %v", next)
+	}
+	if next = s.Next(next); !next.Equal(time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC)) {
+		t.Errorf("after repeated time: %v", next)
+	}
+
+	s, _ = ParseCronIn("0 9 * * *", time.UTC)
+	if next := s.In(ny).Next(from); !next.Equal(time.Date(2024, 3, 9, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("In: %v", next)
+	}
+}
+
+func TestCronErrors(t *testing.T) {
+	cases := []struct {
+		expr, err string
+	}{
+		{"", `cron "": column 1: empty expression`},
+		{"* * * *", `cron "* * * *": column 8: expected 5 or 6 fields, got 4`},
+		{"* * * * * * *", `cron "* * * * * * *": column 13: expected 5 or 6 fields, got 7`},
+		{"60 * * * *", `cron "60 * * * *": minute at column 1: 60 out of range 0-59`},
+		{"* * * * * 8", `cron "* * * * * 8": day of week at column 11: 8 out of range 0-7`},
+		{"0 1-x * * *", `cron "0 1-x * * *": hour at column 5: invalid value "x"`},
+		{"0 5-1 * * *", `cron "0 5-1 * * *": hour at column 3: range 5-1 is backwards`},
+		{"0 0 1,,2 * *", `cron "0 0 1,,2 * *": day of month at column 7: empty list item`},
+		{"*/0 * * * *", `cron "*/0 * * * *": minute at column 3: invalid step "0"`},
+		{"0 0 * foo *", `cron "0 0 * foo *": month at column 7: invalid value "foo"`},
+		{"? * * * *", `cron "? * * * *": minute at column 1: ? is only allowed for days`},
+		{"@often", `cron "@often": column 1: unknown alias "@often"`},
+		{"@daily 5", `cron "@daily 5": column 8: unexpected field after alias`},
+		{"TZ=Mars/Olympus * * * * *", `cron "TZ=Mars/Olympus * * * * *": column 1: unknown time zone "Mars/Olympus"`},
+	}
+	for _, c := range cases {
+		_, err := ParseCron(c.expr)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: expected %v, got %v", c.expr, c.err, err)
+		}
+		if _, ok := err.(*CronError); err != nil && !ok {
+			t.Errorf("%q: not a CronError: %T", c.expr, err)
+		}
+	}
+}
+
+func TestCronJob(t *testing.T) {
+	if _, err := Cron("61 * * * *").Run(func() {}); err == nil {
+		t.Error("invalid expression accepted")
+	}
+	if _, err := Cron("0 0 30 2 *").Run(func() {}); err == nil {
+		t.Error("expression never running accepted")
+	}
+	if _, err := Every(5).Seconds().In(time.UTC).Run(func() {}); err == nil {
+		t.Error("time zone of a recurrent job accepted")
+	}
+	j, err := Cron("@daily").In(time.UTC).Run(func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Quit <- true
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/gostones/gpm"
+)
+
+// DashboardStatus is the node overview shown on the dashboard
+type DashboardStatus struct {
+	Node struct {
+		ID   string `json:"id"`
+		Addr string `json:"addr"`
+	} `json:"node"`
+	Routes    []DashboardRoute   `json:"routes"`
+	Peers     []DashboardPeer    `json:"peers"`
+	Processes []DashboardProcess `json:"processes"`
+	Forwards  []ForwardStatus    `json:"forwards"`
+	Published []PublishStatus    `json:"published"`
+	Health    *Health            `json:"health,omitempty"`
+	Access    []AccessEntry      `json:"access"`
+}
+
+// DashboardRoute is a route table entry
+type DashboardRoute struct {
+	Domain  string   `json:"domain"`
+	Action  string   `json:"action"`
+	Backend []string `json:"backend"`
+}
+
+// DashboardPeer is a connected peer
+type DashboardPeer struct {
+	ID      string `json:"id"`
+	Addr    string `json:"addr"`
+	Port    int    `json:"port"`
+	Rank    int    `json:"rank"`
+	Latency int64  `json:"latency"` // milliseconds
+}
+
+// DashboardProcess is a process managed by gpm
+type DashboardProcess struct {
+	Name        string `json:"name"`
+	Command     string `json:"command"`
+	AutoRestart bool   `json:"autoRestart"`
+	Status      string `json:"status"`
+}
+
+// Dashboard serves the embedded landing page and its API. The API is
+// guarded by admin, the page itself holds no data.
+type Dashboard struct {
+	nb     *Neighborhood
+	hc     *HealthChecker
+	access *AccessLog
+	admin  *AdminAuth
+	base   string
+}
+
+// NewDashboard creates the dashboard for the node
+func NewDashboard(nb *Neighborhood, hc *HealthChecker, access *AccessLog, admin *AdminAuth) *Dashboard {
+	return &Dashboard{
+		nb:     nb,
+		hc:     hc,
+		access: access,
+		admin:  admin,
+		base:   os.Getenv("DHNT_BASE"),
+	}
+}
+
+// Register adds the dashboard handlers to mux
+func (r *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/", r.serveIndex)
+	mux.Handle("/dashboard/api/status", r.admin.Wrap(http.HandlerFunc(r.serveStatus)))
+	mux.Handle("/dashboard/api/routes/reload", r.admin.Wrap(http.HandlerFunc(r.serveReload)))
+	mux.Handle("/dashboard/api/processes/restart", r.admin.Wrap(http.HandlerFunc(r.serveRestart)))
+	mux.Handle("/dashboard/api/forwards", r.admin.Wrap(http.HandlerFunc(r.serveForwards)))
+}
+
+func (r *Dashboard) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+// Status collects the node overview
+func (r *Dashboard) Status() *DashboardStatus {
+	s := &DashboardStatus{}
+	if r.nb.My != nil {
+		s.Node.ID = r.nb.My.ID
+		s.Node.Addr = ToPeerAddr(r.nb.My.ID)
+	}
+	s.Routes = r.routes()
+	s.Peers = r.peers()
+	s.Processes = r.processes()
+	s.Forwards = []ForwardStatus{}
+	if r.nb.Forwards != nil {
+		s.Forwards = r.nb.Forwards.Status()
+	}
+	s.Published = []PublishStatus{}
+	if r.nb.Published != nil {
+		s.Published = r.nb.Published.Status()
+	}
+	if r.hc != nil {
+		s.Health = r.hc.Check()
+	}
+	s.Access = r.access.Recent()
+	return s
+}
+
+func (r *Dashboard) routes() []DashboardRoute {
+	list := []DashboardRoute{}
+	if r.nb.Router == nil {
+		return list
+	}
+	r.nb.Router.mu.Lock()
+	defer r.nb.Router.mu.Unlock()
+
+	for _, rt := range r.nb.Router.Routes {
+		d := DashboardRoute{
+			Domain: rt.pattern,
+			Action: rt.Action(),
+		}
+		if d.Domain == "" && rt.re != nil {
+			d.Domain = rt.re.String()
+		}
+		for _, be := range rt.Backend {
+			if be.Port > 0 {
+				d.Backend = append(d.Backend, fmt.Sprintf("%v:%v", be.Hostname, be.Port))
+			} else {
+				d.Backend = append(d.Backend, be.Hostname)
+			}
+		}
+		for _, e := range rt.Exits {
+			d.Backend = append(d.Backend, e.String())
+		}
+		list = append(list, d)
+	}
+	return list
+}
+
+func (r *Dashboard) peers() []DashboardPeer {
+	r.nb.Lock()
+	defer r.nb.Unlock()
+
+	list := []DashboardPeer{}
+	for id, p := range r.nb.Peers {
+		list = append(list, DashboardPeer{
+			ID:      id,
+			Addr:    ToPeerAddr(id),
+			Port:    p.Port,
+			Rank:    p.Rank,
+			Latency: int64(p.latency / time.Millisecond),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Rank != list[j].Rank {
+			return list[i].Rank > list[j].Rank
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+func (r *Dashboard) apps() []AppDesc {
+	if r.base == "" {
+		return nil
+	}
+	apps, err := loadGPMConf(r.base)
+	if err != nil {
+		logger.Infof("dashboard: gpm processes: %v", err)
+	}
+	return apps
+}
+
+func (r *Dashboard) processes() []DashboardProcess {
+	list := []DashboardProcess{}
+	for _, app := range r.apps() {
+		st := StatusUp
+		switch err := checkProcess(app.Command)(); err {
+		case nil:
+		case errUnknown:
+			st = StatusUnknown
+		default:
+			st = StatusDown
+		}
+		list = append(list, DashboardProcess{
+			Name:        app.Name,
+			Command:     app.Command,
+			AutoRestart: app.AutoRestart,
+			Status:      st,
+		})
+	}
+	return list
+}
+
+// ReloadRoutes re-reads the configured route files
+func (r *Dashboard) ReloadRoutes() error {
+	if r.nb.Router == nil || r.nb.config == nil {
+		return fmt.Errorf("route table not loaded")
+	}
+	return r.nb.Router.ReadFiles(r.nb.config.RouteFiles)
+}
+
+// RestartProcess terminates the gpm process name, gpm starts it again
+// if it is configured with autoRestart
+func (r *Dashboard) RestartProcess(name string) error {
+	for _, app := range r.apps() {
+		if app.Name != name {
+			continue
+		}
+		if !app.AutoRestart {
+			return fmt.Errorf("%v is not restarted by gpm", name)
+		}
+		pids, err := processIDs(gpm.Tokenize(app.Command))
+		if err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return fmt.Errorf("%v is not running", name)
+		}
+		for _, pid := range pids {
+			p, err := os.FindProcess(pid)
+			if err != nil {
+				continue
+			}
+			if pid == os.Getpid() {
+				// answer the request before mirr itself goes down
+				go func() {
+					time.Sleep(time.Second)
+					p.Signal(syscall.SIGTERM)
+				}()
+				continue
+			}
+			p.Signal(syscall.SIGTERM)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown process: %v", name)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (r *Dashboard) serveStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.Status())
+}
+
+func (r *Dashboard) serveReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ReloadRoutes(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	logger.Infof("dashboard: routes reloaded")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (r *Dashboard) serveRestart(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.PostFormValue("name")
+	if err := r.RestartProcess(name); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	logger.Infof("dashboard: restarting %v", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "restarting"})
+}
+
+// serveForwards lists the forwards, PUT replaces them with a JSON list
+func (r *Dashboard) serveForwards(w http.ResponseWriter, req *http.Request) {
+	if r.nb.Forwards == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "forwarding not started"})
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		var specs []ForwardSpec
+		if err := json.NewDecoder(req.Body).Decode(&specs); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := r.nb.Forwards.Apply(specs); err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		logger.Infof("dashboard: %v forwards applied", len(specs))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, r.nb.Forwards.Status())
+}
@@ -0,0 +1,200 @@
+package internal
+
+// adminScript calls the admin API, asking for a token when needed
+const adminScript = `var api = "/dashboard/api/";
+
+function token() {
+	return localStorage.getItem("mirr-admin-token") || "";
+}
+
+// call sends the form fields of params in the body
+function call(method, path, params) {
+	var headers = {};
+	if (token()) {
+		headers["Authorization"] = "Bearer " + token();
+	}
+	var init = {method: method, headers: headers};
+	if (params) {
+		init.body = new URLSearchParams(params);
+	}
+	return fetch(api + path, init).then(function (resp) {
+		if (resp.status == 401) {
+			var t = prompt("Admin token (mirr admin token):");
+			if (t) {
+				localStorage.setItem("mirr-admin-token", t);
+				return call(method, path, params);
+			}
+		}
+		return resp.json().catch(function () {
+			return {error: resp.status + " " + resp.statusText};
+		}).then(function (body) {
+			if (!resp.ok) {
+				throw new Error(body.error || resp.status + " " + resp.statusText);
+			}
+			return body;
+		});
+	});
+}
+
+function text(s) {
+	var d = document.createElement("div");
+	d.textContent = s == null ? "" : String(s);
+	return d.innerHTML;
+}
+`
+
+// dashboardHTML is the landing page, data is loaded from /dashboard/api
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Home</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #333; }
+h1 { font-size: 1.6em; margin-bottom: .2em; }
+h2 { font-size: 1.1em; margin-top: 2em; border-bottom: 1px solid #ddd; }
+table { border-collapse: collapse; width: 100%; font-size: small; }
+th, td { text-align: left; padding: .3em .5em; border-bottom: 1px solid #eee; }
+code { background: #eee; padding: 0 .2em; word-break: break-all; }
+button { font-size: small; }
+.up { color: #080; }
+.down { color: #c00; }
+.unknown { color: #888; }
+.muted { color: #888; font-size: small; }
+#message { min-height: 1.5em; color: #c60; }
+</style>
+</head>
+<body>
+<h1>My node</h1>
+<p><a href="/share">Share my address</a></p>
+<p>
+Address: <code id="addr">&hellip;</code><br>
+Peer ID: <code id="peerid">&hellip;</code>
+</p>
+<p>Status: <strong id="health">&hellip;</strong></p>
+<div id="message"></div>
+
+<h2>Health</h2>
+<table><thead><tr><th>Component</th><th>Status</th><th>Detail</th></tr></thead><tbody id="components"></tbody></table>
+
+<h2>Services</h2>
+<table><thead><tr><th>Name</th><th>Status</th><th>Command</th><th></th></tr></thead><tbody id="processes"></tbody></table>
+
+<h2>Forwards</h2>
+<table><thead><tr><th>Listen</th><th>Target</th><th>Status</th><th>Active</th><th>Total</th><th>Failed</th></tr></thead><tbody id="forwards"></tbody></table>
+
+<h2>Published</h2>
+<table><thead><tr><th>Protocol</th><th>Target</th><th>Allow</th><th>Status</th><th>Active</th><th>Total</th><th>Failed</th></tr></thead><tbody id="published"></tbody></table>
+
+<h2>Routes <button id="reload">Reload</button></h2>
+<table><thead><tr><th>Domain</th><th>Action</th><th>Backend</th></tr></thead><tbody id="routes"></tbody></table>
+
+<h2>Peers</h2>
+<table><thead><tr><th>Address</th><th>Rank</th><th>Latency</th><th>Port</th></tr></thead><tbody id="peers"></tbody></table>
+
+<h2>Recent requests</h2>
+<table><thead><tr><th>Time</th><th>Client</th><th>Request</th><th>Status</th><th>Size</th><th>Duration</th></tr></thead><tbody id="access"></tbody></table>
+
+<p class="muted">Refreshed every 10 seconds.</p>
+
+<script>
+` + adminScript + `
+function rows(id, list, render) {
+	var html = "";
+	(list || []).forEach(function (item) {
+		html += "<tr>" + render(item).map(function (c) { return "<td>" + c + "</td>"; }).join("") + "</tr>";
+	});
+	document.getElementById(id).innerHTML = html || "<tr><td class=\"muted\">none</td></tr>";
+}
+
+function status(s) {
+	return "<span class=\"" + text(s) + "\">" + text(s) + "</span>";
+}
+
+function message(s) {
+	document.getElementById("message").textContent = s || "";
+}
+
+function refresh() {
+	call("GET", "status").then(function (s) {
+		document.getElementById("addr").textContent = s.node.addr ? s.node.addr + ".m3" : "not connected";
+		document.getElementById("peerid").textContent = s.node.id || "-";
+		var h = s.health || {};
+		document.getElementById("health").innerHTML = status(h.status || "unknown");
+		rows("components", h.components, function (c) {
+			return [text(c.name), status(c.status), text(c.error || (c.latency + " ms"))];
+		});
+		rows("processes", s.processes, function (p) {
+			var restart = p.autoRestart ? "<button onclick=\"restart('" + text(p.name) + "')\">Restart</button>" : "";
+			return [text(p.name), status(p.status), "<code>" + text(p.command) + "</code>", restart];
+		});
+		rows("forwards", s.forwards, function (f) {
+			return [
+				text((f.proto || "tcp") + " " + f.listen),
+				text(f.target),
+				status(f.running ? "up" : "down") + (f.lastError ? " <span class=\"muted\">" + text(f.lastError) + "</span>" : ""),
+				text(f.active),
+				text(f.total),
+				text(f.failed)
+			];
+		});
+		rows("published", s.published, function (p) {
+			return [
+				text(p.protocol),
+				text(p.target),
+				text((p.allow || []).join(", ")),
+				status(p.running ? "up" : "down") + (p.lastError ? " <span class=\"muted\">" + text(p.lastError) + "</span>" : ""),
+				text(p.active),
+				text(p.total),
+				text(p.failed)
+			];
+		});
+		rows("routes", s.routes, function (r) {
+			return [text(r.domain), text(r.action), text((r.backend || []).join(", "))];
+		});
+		rows("peers", s.peers, function (p) {
+			return ["<code>" + text(p.addr) + "</code>", text(p.rank), text(p.latency ? p.latency + " ms" : "-"), text(p.port)];
+		});
+		rows("access", s.access, function (a) {
+			return [
+				text(new Date(a.time).toLocaleTimeString()),
+				text(a.peer ? "peer " + a.client.substring(0, 12) : a.client),
+				text(a.method + " " + a.host + (a.path || "")),
+				text(a.status || "-"),
+				text(a.bytes),
+				text(a.duration + " ms")
+			];
+		});
+	}).catch(function (e) {
+		message(e.message);
+	});
+}
+
+function restart(name) {
+	if (!confirm("Restart " + name + "?")) {
+		return;
+	}
+	call("POST", "processes/restart", {name: name}).then(function () {
+		message(name + " is restarting");
+		setTimeout(refresh, 2000);
+	}).catch(function (e) {
+		message(e.message);
+	});
+}
+
+document.getElementById("reload").onclick = function () {
+	call("POST", "routes/reload").then(function () {
+		message("Routes reloaded");
+		refresh();
+	}).catch(function (e) {
+		message(e.message);
+	});
+};
+
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
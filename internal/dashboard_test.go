@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	log := NewAccessLog(3)
+	for i := 0; i < 5; i++ {
+		log.Add(AccessEntry{Path: fmt.Sprintf("/%v", i)})
+	}
+	var paths []string
+	for _, e := range log.Recent() {
+		paths = append(paths, e.Path)
+	}
+	if strings.Join(paths, " ") != "/4 /3 /2" {
+		t.Errorf("unexpected entries: %v", paths)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+
+	proxyAddr, stop := startTestProxy(t, fmt.Sprintf("web.home %v", u.Host), time.Second)
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://web.home/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + proxyAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("landing page: %v %v", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	resp, err = http.Get("http://" + proxyAddr + "/dashboard/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var s DashboardStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Node.Addr != ToPeerAddr(s.Node.ID) || s.Node.Addr == "" {
+		t.Errorf("node: %+v", s.Node)
+	}
+	if len(s.Routes) != 1 || s.Routes[0].Domain != "web.home" || s.Routes[0].Backend[0] != u.Host {
+		t.Errorf("routes: %+v", s.Routes)
+	}
+	if len(s.Access) != 1 || s.Access[0].Host != "web.home" || s.Access[0].Status != 200 || s.Access[0].Bytes != 5 {
+		t.Errorf("access log: %+v", s.Access)
+	}
+}
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTTL     = 60
+	dnsTimeout = 5 * time.Second
+	dnsMaxUDP  = 4096
+)
+
+// privateNets are the networks of local clients, whose queries are
+// forwarded unless configured otherwise
+var privateNets = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"fc00::/7", "fe80::/10",
+}
+
+// parseNetworks parses CIDRs or single addresses
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", strings.TrimSuffix(strings.TrimSuffix(s, "/32"), "/128"))
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// DNSServer answers A/AAAA queries for names routed through mirr with the
+// node's own addresses and forwards other queries of its clients to an
+// upstream resolver. A name is answered locally if its route is not direct,
+// the same rule that sends it to the proxy in proxy.pac.
+type DNSServer struct {
+	Router   *RouteRegistry
+	Upstream string
+	IPv4     []net.IP
+	IPv6     []net.IP
+	// Clients may have queries forwarded, others are refused so that the
+	// server is no open resolver
+	Clients []*net.IPNet
+}
+
+// NewDNSServer creates a DNS server answering with addrs, or with the
+// addresses of the local interfaces if addrs is empty. Queries of clients
+// on loopback and private networks are forwarded if clients is empty.
+func NewDNSServer(router *RouteRegistry, upstream string, addrs, clients []string) (*DNSServer, error) {
+	s := &DNSServer{
+		Router:   router,
+		Upstream: upstream,
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		s.Upstream = net.JoinHostPort(upstream, "53")
+	}
+	if len(clients) == 0 {
+		clients = privateNets
+	}
+	var err error
+	if s.Clients, err = parseNetworks(clients); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS answer address: %q", a)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		local, err := getLocalAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range local {
+			if !ip.IsLoopback() {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			s.IPv4 = append(s.IPv4, ip4)
+		} else {
+			s.IPv6 = append(s.IPv6, ip)
+		}
+	}
+	if len(s.IPv4) == 0 && len(s.IPv6) == 0 {
+		return nil, fmt.Errorf("no address to answer DNS queries with")
+	}
+	return s, nil
+}
+
+// ListenAndServe serves DNS on addr over UDP and TCP
+func (r *DNSServer) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	logger.Infof("DNS listening on: %v upstream: %v answer: %v %v", addr, r.Upstream, r.IPv4, r.IPv6)
+
+	done := make(chan error, 2)
+	go func() {
+		done <- r.serveUDP(pc)
+	}()
+	go func() {
+		done <- r.serveTCP(l)
+	}()
+	return <-done
+}
+
+func (r *DNSServer) serveUDP(pc net.PacketConn) error {
+	for {
+		buf := make([]byte, dnsMaxUDP)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		go func() {
+			resp, err := r.Resolve(buf[:n], "udp", addrIP(addr))
+			if err != nil {
+				logger.Debugf("DNS query from %v: %v", addr, err)
+				return
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (r *DNSServer) serveTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(2 * dnsTimeout))
+				req, err := readTCPMsg(c)
+				if err != nil {
+					return
+				}
+				resp, err := r.Resolve(req, "tcp", addrIP(c.RemoteAddr()))
+				if err != nil {
+					logger.Debugf("DNS query from %v: %v", c.RemoteAddr(), err)
+					return
+				}
+				if err := writeTCPMsg(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readTCPMsg(c io.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(c, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(c, msg)
+	return msg, err
+}
+
+func writeTCPMsg(c io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := c.Write(b)
+	return err
+}
+
+// addrIP returns the IP of a UDP or TCP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// errDNSResponse drops responses sent to the server, they would loop
+var errDNSResponse = errors.New("response sent as query")
+
+// Resolve answers a DNS query message of the client from locally or by
+// forwarding it upstream
+func (r *DNSServer) Resolve(req []byte, network string, from net.IP) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	if h.Response {
+		return nil, errDNSResponse
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if h.OpCode == 0 && q.Class == dnsmessage.ClassINET && r.IsLocal(q.Name.String()) {
+		return r.answer(h, q)
+	}
+	if !r.forwards(from) {
+		return r.reply(h, q, dnsmessage.RCodeRefused, nil)
+	}
+
+	resp, err := r.forward(req, network)
+	if err != nil {
+		logger.Infof("DNS forward %v to %v: %v", q.Name, r.Upstream, err)
+		return r.reply(h, q, dnsmessage.RCodeServerFailure, nil)
+	}
+	return resp, nil
+}
+
+// forwards reports whether queries of the client at ip are forwarded
+func (r *DNSServer) forwards(ip net.IP) bool {
+	for _, n := range r.Clients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocal reports whether name is answered with the node's own address
+func (r *DNSServer) IsLocal(name string) bool {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	route := r.Router.MatchRoute(host)
+	return route != nil && !route.IsDirect()
+}
+
+func (r *DNSServer) answer(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	var ips []net.IP
+	switch q.Type {
+	case dnsmessage.TypeA:
+		ips = r.IPv4
+	case dnsmessage.TypeAAAA:
+		ips = r.IPv6
+	case dnsmessage.TypeALL:
+		ips = append(append(ips, r.IPv4...), r.IPv6...)
+	}
+	// other types get an empty answer, the name exists
+	return r.reply(h, q, dnsmessage.RCodeSuccess, ips)
+}
+
+func (r *DNSServer) reply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      rcode == dnsmessage.RCodeSuccess,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		rh := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   dnsTTL,
+		}
+		var err error
+		if ip4 := ip.To4(); ip4 != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(rh, a)
+		} else {
+			var a dnsmessage.AAAAResource
+			copy(a.AAAA[:], ip.To16())
+			err = b.AAAAResource(rh, a)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func (r *DNSServer) forward(req []byte, network string) ([]byte, error) {
+	c, err := net.DialTimeout(network, r.Upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMsg(c, req); err != nil {
+			return nil, err
+		}
+		return readTCPMsg(c)
+	}
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDP)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// StartDNS runs the DNS server if a DNS address is configured
+func StartDNS(cfg *Config, router *RouteRegistry) {
+	if cfg.DNSListen == "" {
+		return
+	}
+	s, err := NewDNSServer(router, cfg.DNSUpstream, cfg.DNSAddrs, cfg.DNSClients)
+	if err != nil {
+		logger.Errorf("DNS server not started: %v", err)
+		return
+	}
+	err = s.ListenAndServe(cfg.DNSListen)
+	logger.Errorf("DNS server exited: %v", err)
+}
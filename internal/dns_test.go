@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDNSServer(t *testing.T) {
+	// fake upstream echoing every query back as an empty reply
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := append([]byte{}, buf[:n]...)
+			resp[2] |= 0x80 // QR
+			upstream.WriteTo(resp, addr)
+		}
+	}()
+
+	router := NewRouteRegistry("")
+	router.ReadString(`
+localhost direct
+*.home    localhost
+/.*/      direct
+`)
+	s, err := NewDNSServer(router, upstream.LocalAddr().String(), []string{"10.1.2.3", "fd00::1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		answers int
+		auth    bool
+		from    string
+		rcode   dnsmessage.RCode
+	}{
+		{"git.home.", dnsmessage.TypeA, 1, true, "127.0.0.1", dnsmessage.RCodeSuccess},
+		{"GIT.Home.", dnsmessage.TypeAAAA, 1, true, "::1", dnsmessage.RCodeSuccess},
+		{"git.home.", dnsmessage.TypeMX, 0, true, "192.168.1.2", dnsmessage.RCodeSuccess},
+		{"git.home.", dnsmessage.TypeA, 1, true, "203.0.113.1", dnsmessage.RCodeSuccess},
+		{"example.com.", dnsmessage.TypeA, 0, false, "10.0.0.2", dnsmessage.RCodeSuccess},
+		{"example.com.", dnsmessage.TypeA, 0, false, "203.0.113.1", dnsmessage.RCodeRefused},
+	}
+	for _, test := range tests {
+		resp, err := s.Resolve(dnsQuery(t, test.name, test.qtype), "udp", net.ParseIP(test.from))
+		if err != nil {
+			t.Fatalf("Resolve(%v): %v", test.name, err)
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SkipAllQuestions()
+		answers, _ := p.AllAnswers()
+		if h.ID != 42 || !h.Response || h.Authoritative != test.auth || h.RCode != test.rcode || len(answers) != test.answers {
+			t.Errorf("Resolve(%v %v) = %+v %v", test.name, test.qtype, h, answers)
+		}
+		if test.answers == 1 && test.qtype == dnsmessage.TypeA {
+			a := answers[0].Body.(*dnsmessage.AResource)
+			if net.IP(a.A[:]).String() != "10.1.2.3" {
+				t.Errorf("Resolve(%v) answer is %v", test.name, a)
+			}
+		}
+	}
+
+	// a response sent to the server is dropped, not forwarded back upstream
+	resp := dnsQuery(t, "example.com.", dnsmessage.TypeA)
+	resp[2] |= 0x80 // QR
+	if got, err := s.Resolve(resp, "udp", net.ParseIP("127.0.0.1")); err == nil {
+		t.Errorf("Resolve(response) = %v", got)
+	}
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// failure categories of proxied requests
+const (
+	ErrNoRoute         = "no_route"
+	ErrPeerInvalid     = "peer_invalid"
+	ErrPeerUnreachable = "peer_unreachable"
+	ErrExitFailed      = "exit_failed"
+	ErrUpstream        = "upstream"
+	ErrTimeout         = "timeout"
+	ErrRefused         = "refused"
+)
+
+// RouteError is a dial failure of the proxy
+type RouteError struct {
+	Kind   string
+	Host   string
+	PeerID string
+	Err    error
+}
+
+func (e *RouteError) Error() string {
+	return e.Err.Error()
+}
+
+// classifyError returns the failure category of err
+func classifyError(err error) (string, *RouteError) {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if re, ok := err.(*RouteError); ok {
+		return re.Kind, re
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrTimeout, nil
+	}
+	return ErrUpstream, nil
+}
+
+var errorCategories = map[string]struct {
+	status int
+	title  string
+	advice string
+	retry  bool
+}{
+	ErrNoRoute: {http.StatusBadGateway, "No route",
+		"No route matches this host. Check the route configuration of your node.", false},
+	ErrPeerInvalid: {http.StatusNotFound, "Unknown peer",
+		"The host name does not contain a valid peer address. Check the address for typos.", false},
+	ErrPeerUnreachable: {http.StatusServiceUnavailable, "Peer not reachable",
+		"The peer is offline or still connecting. Connections to new peers may take a minute, the page retries automatically.", true},
+	ErrExitFailed: {http.StatusBadGateway, "No exit available",
+		"None of the upstream exits of this route could reach the site. Try again later or choose other exits.", true},
+	ErrUpstream: {http.StatusBadGateway, "Connection failed",
+		"The site refused or dropped the connection. The service may be down.", true},
+	ErrTimeout: {http.StatusGatewayTimeout, "Connection timed out",
+		"The site did not answer in time. Try again later.", true},
+	ErrRefused: {http.StatusForbidden, "Access refused",
+		"Peers may not reach this address through the node.", false},
+}
+
+// ErrorPage is the data error page templates are rendered with
+type ErrorPage struct {
+	Status     int       `json:"status"`
+	Category   string    `json:"category"`
+	Title      string    `json:"title"`
+	Advice     string    `json:"advice"`
+	Error      string    `json:"error"`
+	URL        string    `json:"url"`
+	Host       string    `json:"host"`
+	Route      string    `json:"route,omitempty"`
+	PeerID     string    `json:"peerId,omitempty"`
+	Retry      bool      `json:"retry"`
+	RetryAfter int       `json:"retryAfter,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// seconds before a peer that is still connecting is retried
+const peerRetryAfter = 5
+
+const errorPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}</title>
+{{if .RetryAfter}}<meta http-equiv="refresh" content="{{.RetryAfter}}">{{end}}
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #333; }
+code { background: #eee; padding: 0 .2em; }
+.detail { color: #777; font-size: small; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Advice}}</p>
+<p>Could not load <code>{{.URL}}</code>.</p>
+{{if .Retry}}<p><button onclick="location.reload()">Retry</button></p>{{end}}
+<p class="detail">
+{{if .Route}}Route: {{.Route}}<br>{{end}}
+{{if .PeerID}}Peer: {{.PeerID}}<br>{{end}}
+Error: {{.Error}}<br>
+{{.Time.Format "2006-01-02 15:04:05 MST"}}
+</p>
+</body>
+</html>
+`
+
+// ErrorPages renders proxy failures as HTML for browsers and JSON for API
+// clients. The templates error.html and error.json in dir replace the
+// built-in pages and are read on each use.
+type ErrorPages struct {
+	dir string
+}
+
+// NewErrorPages creates error pages with templates overridable from dir
+func NewErrorPages(dir string) *ErrorPages {
+	return &ErrorPages{
+		dir: dir,
+	}
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML
+func wantsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	j := strings.Index(accept, "application/json")
+	if j < 0 {
+		return false
+	}
+	h := strings.Index(accept, "text/html")
+	return h < 0 || j < h
+}
+
+func (r *ErrorPages) readTemplate(name string) (string, bool) {
+	if r.dir == "" {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Infof("error page template: %v", err)
+		}
+		return "", false
+	}
+	return string(b), true
+}
+
+func (r *ErrorPages) render(page *ErrorPage, asJSON bool) ([]byte, string) {
+	var buf bytes.Buffer
+	if asJSON {
+		if s, ok := r.readTemplate("error.json"); ok {
+			t, err := texttemplate.New("error.json").Funcs(texttemplate.FuncMap{
+				"json": func(v interface{}) (string, error) {
+					b, err := json.Marshal(v)
+					return string(b), err
+				},
+			}).Parse(s)
+			if err == nil {
+				err = t.Execute(&buf, page)
+			}
+			if err == nil {
+				return buf.Bytes(), "application/json"
+			}
+			logger.Infof("error page template: %v", err)
+			buf.Reset()
+		}
+		json.NewEncoder(&buf).Encode(page)
+		return buf.Bytes(), "application/json"
+	}
+
+	if s, ok := r.readTemplate("error.html"); ok {
+		t, err := htmltemplate.New("error.html").Parse(s)
+		if err == nil {
+			err = t.Execute(&buf, page)
+		}
+		if err == nil {
+			return buf.Bytes(), "text/html; charset=utf-8"
+		}
+		logger.Infof("error page template: %v", err)
+		buf.Reset()
+	}
+	htmltemplate.Must(htmltemplate.New("error.html").Parse(errorPageHTML)).Execute(&buf, page)
+	return buf.Bytes(), "text/html; charset=utf-8"
+}
+
+// Page describes the failure of req with err
+func (r *ErrorPages) Page(req *http.Request, err error, route *Route) *ErrorPage {
+	kind, re := classifyError(err)
+	c := errorCategories[kind]
+	page := &ErrorPage{
+		Status:   c.status,
+		Category: kind,
+		Title:    c.title,
+		Advice:   c.advice,
+		Error:    err.Error(),
+		URL:      req.URL.String(),
+		Host:     req.URL.Hostname(),
+		Retry:    c.retry,
+		Time:     time.Now(),
+	}
+	if route != nil {
+		page.Route = route.Action()
+		if page.Route == "peer" {
+			page.PeerID = ToPeerID(PeerTLD(page.Host))
+		}
+	}
+	if re != nil && re.PeerID != "" {
+		page.PeerID = re.PeerID
+	}
+	if kind == ErrPeerUnreachable {
+		page.RetryAfter = peerRetryAfter
+	}
+	return page
+}
+
+// Response renders the failure of req with err
+func (r *ErrorPages) Response(req *http.Request, err error, route *Route) *http.Response {
+	page := r.Page(req, err, route)
+	body, ct := r.render(page, wantsJSON(req))
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%v %v", page.Status, http.StatusText(page.Status)),
+		StatusCode:    page.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", ct)
+	resp.Header.Set("Cache-Control", "no-store")
+	if page.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", fmt.Sprintf("%v", page.RetryAfter))
+	}
+	return resp
+}
+
+// ErrorHandler replaces failed round trips in goproxy with error pages
+type ErrorHandler struct {
+	pages *ErrorPages
+	nb    *Neighborhood
+}
+
+// NewErrorHandler creates an error handler using pages
+func NewErrorHandler(pages *ErrorPages, nb *Neighborhood) *ErrorHandler {
+	return &ErrorHandler{
+		pages: pages,
+		nb:    nb,
+	}
+}
+
+// OnResponse renders the error page if there is no response
+func (r *ErrorHandler) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp != nil || ctx.Error == nil {
+		return resp
+	}
+	var route *Route
+	if r.nb.Router != nil {
+		route = r.nb.Router.MatchRoute(ctx.Req.URL.Hostname())
+	}
+	logger.Infof("proxy error: %v %v", ctx.Req.URL, ctx.Error)
+	return r.pages.Response(ctx.Req, ctx.Error, route)
+}
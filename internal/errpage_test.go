@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{&RouteError{Kind: ErrPeerUnreachable, Err: errors.New("Peer not reachable: x")}, ErrPeerUnreachable},
+		{&url.Error{Op: "Get", URL: "http://x", Err: &RouteError{Kind: ErrNoRoute, Err: errors.New("x")}}, ErrNoRoute},
+		{&RouteError{Kind: ErrExitFailed, Err: errors.New("Proxy routing error: all exits failed for a:80: office: refused")}, ErrExitFailed},
+		{errors.New("Peer not reachable: abc"), ErrUpstream},
+		{errors.New("dial tcp 127.0.0.1:1: connect: connection refused"), ErrUpstream},
+	}
+	for _, test := range tests {
+		if kind, _ := classifyError(test.err); kind != test.kind {
+			t.Errorf("%v: got %v, expected %v", test.err, kind, test.kind)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pages := NewErrorPages(dir)
+
+	perr := &RouteError{
+		Kind:   ErrPeerUnreachable,
+		Host:   "app.peer.m3",
+		PeerID: "QmPeer",
+		Err:    errors.New("Peer not reachable: app.peer.m3"),
+	}
+
+	// browsers get HTML with a retry button
+	req := httptest.NewRequest("GET", "http://app.peer.m3/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp := pages.Response(req, perr, nil)
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected response: %v %v", resp.Status, resp.Header)
+	}
+	for _, s := range []string{"Peer not reachable", "QmPeer", "<button", "http-equiv=\"refresh\""} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("page is missing %q: %s", s, b)
+		}
+	}
+
+	// API clients get JSON
+	req = httptest.NewRequest("GET", "http://app.peer.m3/api", nil)
+	req.Header.Set("Accept", "application/json")
+	resp = pages.Response(req, perr, nil)
+	var page ErrorPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Category != ErrPeerUnreachable || page.PeerID != "QmPeer" || !page.Retry || page.Status != 503 {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	// templates from the etc directory replace the built-in ones
+	err = ioutil.WriteFile(filepath.Join(dir, "error.html"), []byte(`<p>{{.Category}} {{.Host}}</p>`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "http://x.home/", nil)
+	resp = pages.Response(req, &RouteError{Kind: ErrNoRoute, Host: "x.home", Err: errors.New("Proxy routing error: tcp x.home:80")}, nil)
+	b, _ = ioutil.ReadAll(resp.Body)
+	if string(b) != "<p>no_route x.home</p>" || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected custom page: %v %s", resp.StatusCode, b)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "error.json"), []byte(`{"message": {{json .Advice}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp = pages.Response(req, &RouteError{Kind: ErrNoRoute, Host: "x.home", Err: errors.New("Proxy routing error: tcp x.home:80")}, nil)
+	var custom map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&custom); err != nil {
+		t.Fatal(err)
+	}
+	if custom["message"] != errorCategories[ErrNoRoute].advice {
+		t.Fatalf("unexpected custom JSON: %v", custom)
+	}
+}
+
+func TestDialPeerUnreachable(t *testing.T) {
+	nb := NewNeighborhood(&Config{})
+	nb.My = &Node{ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	nb.Router = NewRouteRegistry(nb.My.ID)
+	if err := nb.Router.ReadString(`/[a-zA-Z0-9]{25,}/ peer`); err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the forward port of the peer
+	nb.Peers[testPeerID] = &Peer{Peer: testPeerID, Port: FreePort(), Rank: 1}
+	host := apiHost
+	apiHost = "127.0.0.1"
+	defer func() { apiHost = host }()
+
+	_, err := nb.Dial("tcp", "web."+ToPeerAddr(testPeerID)+":80")
+	if err == nil {
+		t.Fatal("dial succeeded")
+	}
+	kind, re := classifyError(err)
+	if kind != ErrPeerUnreachable || re == nil || re.PeerID != testPeerID {
+		t.Errorf("unexpected error: %v %+v", kind, re)
+	}
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route action sending web traffic through a peer
+const actionExit = "exit"
+
+// how long a destination host sticks to the peer exit that served it
+var stickyExitTTL = 30 * time.Minute
+
+type stickyExit struct {
+	id      string
+	expires time.Time
+}
+
+// peerExits remembers which peer served a destination host
+type peerExits struct {
+	sticky map[string]*stickyExit
+
+	sync.Mutex
+}
+
+func newPeerExits() *peerExits {
+	return &peerExits{
+		sticky: make(map[string]*stickyExit),
+	}
+}
+
+func (r *peerExits) get(host string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.sticky[host]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(s.expires) {
+		delete(r.sticky, host)
+		return ""
+	}
+	return s.id
+}
+
+func (r *peerExits) set(host, id string) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for h, s := range r.sticky {
+		if now.After(s.expires) {
+			delete(r.sticky, h)
+		}
+	}
+	r.sticky[host] = &stickyExit{
+		id:      id,
+		expires: now.Add(stickyExitTTL),
+	}
+}
+
+func (r *peerExits) remove(host string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sticky, host)
+}
+
+// ExitPeers returns IDs of peers usable as web exits, best first.
+// Configured exit peers are always candidates, other known peers only if
+// healthy. Peers are ranked by rank then latency; unknown latency sorts last.
+func (r *Neighborhood) ExitPeers() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	candidates := make(map[string]*Peer)
+	if r.config != nil {
+		for _, addr := range r.config.ExitPeers {
+			id := ToPeerID(addr)
+			if id == "" || (r.My != nil && id == r.My.ID) {
+				continue
+			}
+			p, ok := r.Peers[id]
+			if !ok {
+				p = &Peer{Peer: id}
+			}
+			candidates[id] = p
+		}
+	}
+	for id, p := range r.Peers {
+		if p.Rank > 0 {
+			candidates[id] = p
+		}
+	}
+
+	peers := make([]*Peer, 0, len(candidates))
+	for _, p := range candidates {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		if a.latency != b.latency {
+			if a.latency == 0 || b.latency == 0 {
+				return b.latency == 0
+			}
+			return a.latency < b.latency
+		}
+		return a.Peer < b.Peer
+	})
+
+	ids := make([]string, len(peers))
+	for i, p := range peers {
+		ids[i] = p.Peer
+	}
+	return ids
+}
+
+// DialPeerExit connects to addr through a peer's proxy. The peer that last
+// served the destination host is preferred, the others are tried in rank order.
+func (r *Neighborhood) DialPeerExit(network, addr string) (net.Conn, error) {
+	host := strings.Split(addr, ":")[0]
+
+	ids := r.ExitPeers()
+	if len(ids) == 0 {
+		return nil, &RouteError{
+			Kind: ErrExitFailed,
+			Host: host,
+			Err:  fmt.Errorf("Proxy routing error: no peer exit available for %v", addr),
+		}
+	}
+	if sticky := r.exits.get(host); sticky != "" {
+		for i, id := range ids {
+			if id == sticky {
+				ids = append([]string{id}, append(ids[:i:i], ids[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	var errs []string
+	for _, id := range ids {
+		target := r.GetPeerTarget(id)
+		c, err := connectDial(&url.URL{Scheme: "http", Host: target}, network, addr)
+		if err == nil {
+			r.exits.set(host, id)
+			return c, nil
+		}
+		logger.Infof("peer exit %v failed for %v: %v", id, addr, err)
+		errs = append(errs, fmt.Sprintf("%v: %v", id, err))
+		r.demotePeer(id)
+	}
+	r.exits.remove(host)
+
+	return nil, &RouteError{
+		Kind: ErrExitFailed,
+		Host: host,
+		Err:  fmt.Errorf("Peer not reachable: all peer exits failed for %v: %v", addr, strings.Join(errs, "; ")),
+	}
+}
+
+// demotePeer marks a peer unhealthy so the next use reconnects it
+func (r *Neighborhood) demotePeer(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if p, ok := r.Peers[id]; ok {
+		p.Rank = -1
+	}
+}
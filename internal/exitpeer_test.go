@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExitPeers(t *testing.T) {
+	nb := NewNeighborhood(&Config{
+		ExitPeers: []string{"92114bmb5wjn6hfz0qb2jdr1qc2a5j3hqcr7efsfe2gj09yjmj5eg8"},
+	})
+	nb.My = &Node{ID: "QmSelf"}
+	nb.setPeer(&Peer{Peer: "QmSlow", Port: 1, Rank: 1, latency: 300 * time.Millisecond})
+	nb.setPeer(&Peer{Peer: "QmFast", Port: 2, Rank: 1, latency: 20 * time.Millisecond})
+	nb.setPeer(&Peer{Peer: "QmUnknown", Port: 3, Rank: 1})
+	nb.setPeer(&Peer{Peer: "QmDown", Port: 4, Rank: -1, latency: time.Millisecond})
+
+	expected := []string{"QmFast", "QmSlow", "QmUnknown", "QmXG428k4Aa6Fchp7buub2pK4Fa2nbhcTfznL7oVSGWRRZ"}
+	if ids := nb.ExitPeers(); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("ExitPeers() = %v, want %v", ids, expected)
+	}
+
+	nb.demotePeer("QmFast")
+	if ids := nb.ExitPeers(); ids[0] != "QmSlow" {
+		t.Errorf("ExitPeers() after demote = %v", ids)
+	}
+}
+
+func TestPeerExitsSticky(t *testing.T) {
+	ttl := stickyExitTTL
+	defer func() { stickyExitTTL = ttl }()
+
+	e := newPeerExits()
+	e.set("example.com", "QmFast")
+	if id := e.get("example.com"); id != "QmFast" {
+		t.Errorf("get() = %q", id)
+	}
+	e.remove("example.com")
+	if id := e.get("example.com"); id != "" {
+		t.Errorf("get() after remove = %q", id)
+	}
+
+	stickyExitTTL = -time.Second
+	e.set("example.com", "QmFast")
+	if id := e.get("example.com"); id != "" {
+		t.Errorf("get() after expiry = %q", id)
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dhnt/m3/internal/lb"
+)
+
+// Validate checks the addresses and options of the forward
+func (r *ForwardSpec) Validate() error {
+	if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+		return fmt.Errorf("listen %q: %v", r.Listen, err)
+	}
+	if host, port, err := net.SplitHostPort(r.Target); err != nil || host == "" || port == "" {
+		return fmt.Errorf("target %q: must be host:port", r.Target)
+	}
+	switch r.Proto {
+	case "", "tcp":
+	case "udp":
+		if r.SendProxy != 0 || r.AcceptProxy || r.Peers {
+			return fmt.Errorf("%v: PROXY protocol and peers are tcp only", r.Listen)
+		}
+	default:
+		return fmt.Errorf("%v: unknown protocol %q", r.Listen, r.Proto)
+	}
+	if len(r.TrustedProxies) > 0 && !r.AcceptProxy {
+		return fmt.Errorf("%v: trusted proxies require accept_proxy", r.Listen)
+	}
+	if _, err := lb.ParseTrustedProxies(r.TrustedProxies); err != nil {
+		return fmt.Errorf("%v: %v", r.Listen, err)
+	}
+	switch r.SendProxy {
+	case 0, lb.ProxyV1, lb.ProxyV2:
+	default:
+		return fmt.Errorf("%v: unknown PROXY protocol version %v", r.Listen, r.SendProxy)
+	}
+	return nil
+}
+
+// key identifies the listener of the forward
+func (r *ForwardSpec) key() string {
+	proto := r.Proto
+	if proto == "" {
+		proto = "tcp"
+	}
+	return proto + "/" + r.Listen
+}
+
+// ForwardService runs the forwards of the node. Targets are dialed as
+// routed, reaching *.home names at their backends and peers over p2p.
+type ForwardService struct {
+	nb *Neighborhood
+
+	forwards map[string]*forward
+	sync.Mutex
+}
+
+// NewForwardService creates the forwarding service of nb
+func NewForwardService(nb *Neighborhood) *ForwardService {
+	return &ForwardService{
+		nb:       nb,
+		forwards: make(map[string]*forward),
+	}
+}
+
+// Apply runs the forwards of specs: new ones are started, changed ones
+// restarted and missing ones stopped with their connections. Forwards
+// failing to start are reported in the returned error and the status.
+func (r *ForwardService) Apply(specs []ForwardSpec) error {
+	for i := range specs {
+		if err := specs[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	want := make(map[string]ForwardSpec, len(specs))
+	for _, spec := range specs {
+		want[spec.key()] = spec
+	}
+	for key, f := range r.forwards {
+		if spec, ok := want[key]; ok && reflect.DeepEqual(spec, f.spec) && f.status().Running {
+			delete(want, key)
+			continue
+		}
+		f.close()
+		delete(r.forwards, key)
+	}
+
+	var errs []string
+	for key, spec := range want {
+		f := newForward(spec, r.dial)
+		target, err := r.udpTarget(spec)
+		if err == nil {
+			err = f.start(target)
+		}
+		if err != nil {
+			f.stats.fail(err)
+			close(f.done)
+			errs = append(errs, fmt.Sprintf("%v: %v", spec.Listen, err))
+		}
+		r.forwards[key] = f
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("forwards failed: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// dial connects to addr as the proxy does, directly if no route matches
+func (r *ForwardService) dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.nb.Router != nil && r.nb.Router.MatchRoute(host) != nil {
+		return r.nb.Dial(network, addr)
+	}
+	return net.DialTimeout(network, addr, dialTimeout)
+}
+
+// udpTarget resolves the routed target of UDP forwards, datagrams can only
+// go to a host
+func (r *ForwardService) udpTarget(spec ForwardSpec) (string, error) {
+	if spec.Proto != "udp" || r.nb.Router == nil {
+		return spec.Target, nil
+	}
+	host, port, _ := net.SplitHostPort(spec.Target)
+	route := r.nb.Router.MatchRoute(host)
+	if route == nil || len(route.Backend) == 0 {
+		return spec.Target, nil
+	}
+	switch route.Action() {
+	case "direct":
+		return spec.Target, nil
+	case "host", "localhost":
+		be := route.Backend[0]
+		if be.Port > 0 {
+			port = fmt.Sprintf("%v", be.Port)
+		}
+		return net.JoinHostPort(be.Hostname, port), nil
+	}
+	return "", fmt.Errorf("udp can not be forwarded to %v route of %v", route.Action(), host)
+}
+
+// Status reports the forwards ordered by listen address
+func (r *ForwardService) Status() []ForwardStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	list := []ForwardStatus{}
+	for _, f := range r.forwards {
+		list = append(list, f.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+	return list
+}
+
+// PeerPorts returns the ports of the forwards taking peer IDs
+func (r *ForwardService) PeerPorts() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var ports []string
+	for _, f := range r.forwards {
+		if p := f.peerPort(); p != "" {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// Close stops all forwards
+func (r *ForwardService) Close() {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, f := range r.forwards {
+		f.close()
+		delete(r.forwards, key)
+	}
+}
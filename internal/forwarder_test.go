@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoServer echoes lines prefixed with name
+func startEchoServer(t *testing.T, name string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					s, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(c, "%v %v", name, s)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func echo(t *testing.T, c net.Conn, msg string) string {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "%v\n", msg)
+	s, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatalf("echo %q: %v", msg, err)
+	}
+	return strings.TrimSpace(s)
+}
+
+func dialForward(t *testing.T, addr string) net.Conn {
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			return c
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+// waitForward waits for cond on the status of the forwards by listen address
+func waitForward(t *testing.T, fs *ForwardService, cond func(map[string]ForwardStatus) bool) map[string]ForwardStatus {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		st := make(map[string]ForwardStatus)
+		for _, f := range fs.Status() {
+			st[f.key()] = f
+		}
+		if cond(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardService(t *testing.T) {
+	plain, stopPlain := startEchoServer(t, "plain")
+	defer stopPlain()
+	git, stopGit := startEchoServer(t, "git")
+	defer stopGit()
+
+	nb := NewNeighborhood(&Config{})
+	nb.My = &Node{ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	nb.Router = NewRouteRegistry(nb.My.ID)
+	if err := nb.Router.ReadString("git.home " + git); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewForwardService(nb)
+	defer fs.Close()
+
+	a := fmt.Sprintf("127.0.0.1:%v", FreePort())
+	b := fmt.Sprintf("127.0.0.1:%v", FreePort())
+	specs := []ForwardSpec{
+		{Listen: a, Target: plain},
+		{Listen: b, Target: "git.home:22"},
+	}
+	if err := fs.Apply(specs); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := dialForward(t, a)
+	if got := echo(t, ca, "hi"); got != "plain hi" {
+		t.Errorf("expected plain hi, got %q", got)
+	}
+	cb := dialForward(t, b)
+	defer cb.Close()
+	if got := echo(t, cb, "hi"); got != "git hi" {
+		t.Errorf("expected git hi, got %q", got)
+	}
+	waitForward(t, fs, func(st map[string]ForwardStatus) bool {
+		return len(st) == 2 && st["tcp/"+a].Active == 1 && st["tcp/"+b].Active == 1
+	})
+
+	// closing the client closes the target side too
+	ca.Close()
+	waitForward(t, fs, func(st map[string]ForwardStatus) bool {
+		return st["tcp/"+a].Active == 0 && st["tcp/"+a].Total == 1
+	})
+
+	// a removed forward stops listening and closes its connections
+	if err := fs.Apply(specs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	cb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cb.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if c, err := net.Dial("tcp", b); err == nil {
+		c.Close()
+		t.Error("removed forward still listening")
+	}
+
+	// unreachable targets and busy ports are reported
+	down := fmt.Sprintf("127.0.0.1:%v", FreePort())
+	specs = append(specs[:1], ForwardSpec{Listen: b, Target: down}, ForwardSpec{Listen: a, Target: plain, ForwardOptions: ForwardOptions{Proto: "udp"}})
+	l, err := net.ListenPacket("udp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := fs.Apply(specs); err == nil || !strings.Contains(err.Error(), a) {
+		t.Errorf("expected failure of %v, got %v", a, err)
+	}
+	c := dialForward(t, b)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.Read(make([]byte, 1))
+	c.Close()
+	st := waitForward(t, fs, func(st map[string]ForwardStatus) bool {
+		return len(st) == 3 && st["tcp/"+b].Failed == 1
+	})
+	if st["tcp/"+b].LastError == "" || st["udp/"+a].Running || st["udp/"+a].LastError == "" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	if err := fs.Apply([]ForwardSpec{{Listen: a, Target: "git.home"}}); err == nil {
+		t.Error("target without port accepted")
+	}
+}
+
+func TestForwardPeer(t *testing.T) {
+	ssh, stopSSH := startEchoServer(t, "ssh")
+	defer stopSSH()
+	_, port, _ := net.SplitHostPort(ssh)
+
+	// the peer serves its own address
+	_, remote, stopRemote := startTestNode(t, &Config{}, testPeerID, "${myid} 127.0.0.1", nil)
+	defer stopRemote()
+
+	nb := NewNeighborhood(&Config{})
+	nb.My = &Node{ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	nb.Router = NewRouteRegistry(nb.My.ID)
+	if err := nb.Router.ReadString(`/[a-zA-Z0-9]{25,}/ peer`); err != nil {
+		t.Fatal(err)
+	}
+	nb.Peers[testPeerID] = &Peer{Peer: testPeerID, Port: remote.Addr().(*net.TCPAddr).Port, Rank: 1}
+	host := apiHost
+	apiHost = "127.0.0.1"
+	defer func() { apiHost = host }()
+
+	fs := NewForwardService(nb)
+	defer fs.Close()
+	listen := fmt.Sprintf("127.0.0.1:%v", FreePort())
+	if err := fs.Apply([]ForwardSpec{{Listen: listen, Target: ToPeerAddr(testPeerID) + ":" + port}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialForward(t, listen)
+	defer c.Close()
+	if got := echo(t, c, "hi"); got != "ssh hi" {
+		t.Errorf("expected ssh hi, got %q", got)
+	}
+}
@@ -3,14 +3,84 @@ package internal
 
 import (
 	"fmt"
+	"github.com/dhnt/m3/internal/lb"
 	"github.com/fatih/color"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// ForwardOptions configure a forward
+type ForwardOptions struct {
+	// Proto is tcp, the default, or udp
+	Proto string `json:"proto,omitempty"`
+	// IdleTimeout expires UDP sessions, DefaultUDPIdleTimeout if zero
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+
+	// SendProxy sends a PROXY header of version 1 or 2 to the TCP target
+	SendProxy int `json:"sendProxy,omitempty"`
+	// AcceptProxy reads the PROXY header of clients behind the upstream
+	// proxies in TrustedProxies, CIDRs or addresses, or on loopback if
+	// there are none. Trusted proxies must send a header.
+	AcceptProxy    bool     `json:"acceptProxy,omitempty"`
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// Peers takes the connections for streams of ipfs p2p listen
+	// --report-peer-id, the peer ID is sent in a v2 header
+	Peers bool `json:"peers,omitempty"`
+}
+
+// ForwardSpec declares a forward of a local address to a target
+type ForwardSpec struct {
+	Listen string `json:"listen"`
+	// Target is host:port, a routed name such as git.home:22 or a peer
+	// address and port tunnelled over p2p
+	Target string `json:"target"`
+	ForwardOptions
+}
+
+// ForwardStatus reports a forward and its connections, UDP sessions
+// count as connections
+type ForwardStatus struct {
+	ForwardSpec
+	Running   bool   `json:"running"`
+	Active    int64  `json:"active"`
+	Total     int64  `json:"total"`
+	Failed    int64  `json:"failed"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// forwardStats counts the connections of a forward
+type forwardStats struct {
+	active int64
+	total  int64
+	failed int64
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+func (r *forwardStats) opened() {
+	atomic.AddInt64(&r.active, 1)
+	atomic.AddInt64(&r.total, 1)
+}
+
+func (r *forwardStats) closed() {
+	atomic.AddInt64(&r.active, -1)
+}
+
+func (r *forwardStats) fail(err error) {
+	atomic.AddInt64(&r.failed, 1)
+	r.mu.Lock()
+	r.lastErr = err.Error()
+	r.mu.Unlock()
+}
+
 func getLocalAddrs() ([]net.IP, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -26,21 +96,247 @@ func getLocalAddrs() ([]net.IP, error) {
 	return list, nil
 }
 
-func fwd(src net.Conn, remote string, proto string) {
-	dst, err := net.Dial(proto, remote)
-	//errHandler(err)
+// forward relays the traffic of a local address to its target
+type forward struct {
+	spec ForwardSpec
+	dial func(network, addr string) (net.Conn, error)
+	// allow admits peers of a Peers forward, which then refuses local
+	// connections too
+	allow func(id string) bool
+
+	listener net.Listener
+	udp      *udpForwarder
+	done     chan struct{}
+	stats    forwardStats
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newForward(spec ForwardSpec, dial func(network, addr string) (net.Conn, error)) *forward {
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, dialTimeout)
+		}
+	}
+	return &forward{
+		spec:  spec,
+		dial:  dial,
+		done:  make(chan struct{}),
+		conns: make(map[net.Conn]bool),
+	}
+}
+
+// start listens and serves in the background, target is the UDP address
+// to send datagrams to
+func (f *forward) start(target string) error {
+	if f.spec.Proto == "udp" {
+		remote, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			return err
+		}
+		local, err := net.ResolveUDPAddr("udp", f.spec.Listen)
+		if err != nil {
+			return err
+		}
+		listener, err := net.ListenUDP("udp", local)
+		if err != nil {
+			return err
+		}
+		idle := f.spec.IdleTimeout
+		if idle <= 0 {
+			idle = DefaultUDPIdleTimeout
+		}
+		f.udp = &udpForwarder{
+			listener: listener,
+			remote:   remote,
+			idle:     idle,
+			stats:    &f.stats,
+			sessions: make(map[string]*udpSession),
+		}
+		logger.Infof("forwarding udp from %v to %v", f.spec.Listen, remote)
+		go func() {
+			f.udp.serve()
+			close(f.done)
+		}()
+		return nil
+	}
+
+	l, err := net.Listen("tcp", f.spec.Listen)
 	if err != nil {
-		logger.Printf("fwd: remote: %v err: %v\n", remote, err)
+		return err
+	}
+	f.listener = l
+	if f.spec.AcceptProxy {
+		trusted, _ := lb.ParseTrustedProxies(f.spec.TrustedProxies)
+		f.listener = lb.NewProxyListener(f.listener, trusted...)
+	}
+	if f.spec.Peers {
+		peers := NewPeerListener(f.listener)
+		peers.Allow = f.allow
+		f.listener = peers
+	}
+	logger.Infof("forwarding tcp from %v to %v", f.spec.Listen, f.spec.Target)
+	go f.serve()
+	return nil
+}
+
+func (f *forward) serve() {
+	defer close(f.done)
+	for {
+		src, err := f.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Printf("forward %v accept err: %v\n", f.spec.Listen, err)
+				continue
+			}
+			return
+		}
+		go f.relay(src)
+	}
+}
+
+// track remembers conn to close it with the forward
+func (f *forward) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		conn.Close()
+		return false
+	}
+	f.conns[conn] = true
+	return true
+}
+
+func (f *forward) untrack(conn net.Conn) {
+	f.mu.Lock()
+	delete(f.conns, conn)
+	f.mu.Unlock()
+	conn.Close()
+}
+
+// relay copies between src and the target until both are done, closing
+// both connections
+func (f *forward) relay(src net.Conn) {
+	if !f.track(src) {
 		return
 	}
-	go func() {
-		_, err = io.Copy(src, dst)
-		errPrinter(err)
-	}()
-	go func() {
-		_, err = io.Copy(dst, src)
-		errPrinter(err)
-	}()
+	defer f.untrack(src)
+
+	if f.allow != nil && !f.fromPeer(src) {
+		f.stats.fail(errPeerDenied)
+		return
+	}
+
+	dst, err := f.dial("tcp", f.spec.Target)
+	if err != nil {
+		logger.Printf("forward %v: remote: %v err: %v\n", f.spec.Listen, f.spec.Target, err)
+		f.stats.fail(err)
+		return
+	}
+	if !f.track(dst) {
+		return
+	}
+	defer f.untrack(dst)
+
+	if f.spec.SendProxy != 0 {
+		if err := lb.WriteProxyHeader(dst, f.spec.SendProxy, src.RemoteAddr(), src.LocalAddr(), proxyTLVs(src)...); err != nil {
+			logger.Printf("forward %v: remote: %v PROXY header err: %v\n", f.spec.Listen, f.spec.Target, err)
+			f.stats.fail(err)
+			return
+		}
+	}
+
+	f.stats.opened()
+	defer f.stats.closed()
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(to, from net.Conn) {
+		_, err := io.Copy(to, from)
+		// pass the end of the stream on, the other direction may go on
+		if cw, ok := to.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			to.Close()
+			from.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(src, dst)
+	go copyHalf(dst, src)
+	<-done
+	<-done
+}
+
+// fromPeer waits for the peer ID ahead of the stream of src. Only ipfs on
+// this host reports peers: the ID sent by clients connecting from elsewhere
+// is not taken.
+func (f *forward) fromPeer(src net.Conn) bool {
+	c, ok := src.(*peerConn)
+	if !ok {
+		return false
+	}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+		logger.Infof("forward %v: peer reported by %v refused", f.spec.Listen, c.RemoteAddr())
+		return false
+	}
+	c.SetReadDeadline(time.Now().Add(peerPreambleTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	return c.PeerID() != ""
+}
+
+// peerPort returns the listen port of a forward taking peer IDs, empty
+// for other forwards
+func (f *forward) peerPort() string {
+	if !f.spec.Peers || f.listener == nil {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	return port
+}
+
+// close stops listening and closes the connections of the forward
+func (f *forward) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.udp != nil {
+		f.udp.close()
+	}
+	<-f.done
+}
+
+func (f *forward) status() ForwardStatus {
+	f.stats.mu.Lock()
+	lastErr := f.stats.lastErr
+	f.stats.mu.Unlock()
+
+	running := true
+	select {
+	case <-f.done:
+		running = false
+	default:
+	}
+	return ForwardStatus{
+		ForwardSpec: f.spec,
+		Running:     running,
+		Active:      atomic.LoadInt64(&f.stats.active),
+		Total:       atomic.LoadInt64(&f.stats.total),
+		Failed:      atomic.LoadInt64(&f.stats.failed),
+		LastError:   lastErr,
+	}
 }
 
 // func errHandler(err error) {
@@ -61,82 +357,152 @@ func errPrinter(err error) {
 	}
 }
 
-func tcpStart(from string, to string) {
-	fmt.Printf("tcpStart from '%v' to '%v'\n", from, to)
-
-	proto := "tcp"
-
-	localAddress, err := net.ResolveTCPAddr(proto, from)
-	if err != nil {
-		fmt.Printf("tcpStart localAddress: '%v' err: '%v'\n", localAddress, err)
-		return
+// proxyTLVs passes the peer ID of src on
+func proxyTLVs(src net.Conn) []lb.TLV {
+	var id string
+	switch c := src.(type) {
+	case *peerConn:
+		id = c.PeerID()
+	case *lb.ProxyConn:
+		if h, _ := c.Header(); h != nil {
+			id = h.PeerID()
+		}
 	}
-
-	remoteAddress, err := net.ResolveTCPAddr(proto, to)
-	if err != nil {
-		fmt.Printf("tcpStart remoteAddress: '%v' err: '%v'\n", remoteAddress, err)
-		return
+	if id == "" {
+		return nil
 	}
+	return []lb.TLV{{Type: lb.TLVPeerID, Value: []byte(id)}}
+}
 
-	listener, err := net.ListenTCP(proto, localAddress)
-	if err != nil {
-		fmt.Printf("tcpStart listener err: '%v'\n", err)
-		return
-	}
+// DefaultUDPIdleTimeout expires UDP sessions without traffic
+const DefaultUDPIdleTimeout = 2 * time.Minute
 
-	defer listener.Close()
+// maxUDPSessions caps the clients forwarded at once
+const maxUDPSessions = 4096
 
-	fmt.Printf("tcpStart forwarding %s traffic from '%v' to '%v'\n", proto, localAddress, remoteAddress)
-	// color.Set(color.FgYellow)
-	// fmt.Println("<CTRL+C> to exit")
-	// fmt.Println()
-	// color.Unset()
+// udpSession is the NAT entry of a client, replies of the target to the
+// session socket go back to the client
+type udpSession struct {
+	client *net.UDPAddr
+	conn   *net.UDPConn
+	last   int64
+}
 
-	for {
-		src, err := listener.Accept()
-		if err != nil {
-			logger.Printf("tcpStart listener accept err: %v\n", err)
-			continue
-		}
-		fmt.Printf("tcpStart new connection established from '%v'\n", src.RemoteAddr())
-		go fwd(src, to, proto)
-	}
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
 }
 
-// func udpStart(from string, to string) {
-// 	proto := "udp"
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.last)))
+}
 
-// 	localAddress, err := net.ResolveUDPAddr(proto, from)
-// 	errHandler(err)
+// udpForwarder relays datagrams between clients and the target
+type udpForwarder struct {
+	listener *net.UDPConn
+	remote   *net.UDPAddr
+	idle     time.Duration
+	stats    *forwardStats
 
-// 	remoteAddress, err := net.ResolveUDPAddr(proto, to)
-// 	errHandler(err)
+	sessions map[string]*udpSession
+	sync.Mutex
+}
 
-// 	listener, err := net.ListenUDP(proto, localAddress)
-// 	errHandler(err)
-// 	defer listener.Close()
+// session returns the NAT entry of client, creating it as needed
+func (r *udpForwarder) session(client *net.UDPAddr) (*udpSession, error) {
+	key := client.String()
 
-// 	dst, err := net.DialUDP(proto, nil, remoteAddress)
-// 	errHandler(err)
-// 	defer dst.Close()
+	r.Lock()
+	defer r.Unlock()
+	if s, ok := r.sessions[key]; ok {
+		return s, nil
+	}
+	if len(r.sessions) >= maxUDPSessions {
+		return nil, fmt.Errorf("too many sessions")
+	}
+	conn, err := net.DialUDP("udp", nil, r.remote)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{client: client, conn: conn}
+	s.touch()
+	r.sessions[key] = s
+	r.stats.opened()
+	go r.reply(s)
+	return s, nil
+}
 
-// 	fmt.Printf("Forwarding %s traffic from '%v' to '%v'\n", proto, localAddress, remoteAddress)
-// 	color.Set(color.FgYellow)
-// 	fmt.Println("<CTRL+C> to exit")
-// 	fmt.Println()
-// 	color.Unset()
+// reply sends the datagrams of the target back to the client until the
+// session expires
+func (r *udpForwarder) reply(s *udpSession) {
+	defer func() {
+		r.Lock()
+		delete(r.sessions, s.client.String())
+		r.Unlock()
+		s.conn.Close()
+		r.stats.closed()
+	}()
 
-// 	buf := make([]byte, 512)
-// 	for {
-// 		rnum, err := listener.Read(buf[0:])
-// 		errHandler(err)
+	buf := make([]byte, 64*1024)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(r.idle - s.idle()))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && s.idle() < r.idle {
+				continue
+			}
+			// ICMP port unreachable of a target not listening yet
+			if isConnRefused(err) && s.idle() < r.idle {
+				continue
+			}
+			return
+		}
+		s.touch()
+		if _, err := r.listener.WriteToUDP(buf[:n], s.client); err != nil {
+			logger.Printf("udpForward reply to %v err: %v\n", s.client, err)
+		}
+	}
+}
 
-// 		_, err = dst.Write(buf[:rnum])
-// 		errHandler(err)
+// close stops reading and ends the sessions
+func (r *udpForwarder) close() {
+	r.listener.Close()
+	r.Lock()
+	defer r.Unlock()
+	for _, s := range r.sessions {
+		s.conn.Close()
+	}
+}
 
-// 		fmt.Printf("%d bytes forwared\n", rnum)
-// 	}
-// }
+func isConnRefused(err error) bool {
+	op, ok := err.(*net.OpError)
+	return ok && op.Op == "read" && strings.Contains(op.Err.Error(), "connection refused")
+}
+
+// serve reads the datagrams of clients until the listener is closed
+func (r *udpForwarder) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := r.listener.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			logger.Printf("udpForward listener err: %v\n", err)
+			return
+		}
+		s, err := r.session(client)
+		if err != nil {
+			logger.Printf("udpForward client: %v err: %v\n", client, err)
+			r.stats.fail(err)
+			continue
+		}
+		s.touch()
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			logger.Printf("udpForward remote: %v err: %v\n", r.remote, err)
+			r.stats.fail(err)
+		}
+	}
+}
 
 func ctrlc() {
 	sigs := make(chan os.Signal, 1)
@@ -150,8 +516,25 @@ func ctrlc() {
 	}()
 }
 
-func Forward(from, to string) {
-	tcpStart(from, to)
+// Forward forwards proto, tcp or udp, from one address to another
+func Forward(from, to, proto string) {
+	ForwardWith(from, to, ForwardOptions{Proto: proto})
+}
+
+// ForwardWith forwards from one address to another with o until the
+// listener fails
+func ForwardWith(from, to string, o ForwardOptions) {
+	spec := ForwardSpec{Listen: from, Target: to, ForwardOptions: o}
+	if err := spec.Validate(); err != nil {
+		logger.Errorf("forward: %v", err)
+		return
+	}
+	f := newForward(spec, nil)
+	if err := f.start(to); err != nil {
+		logger.Errorf("forward %v: %v", from, err)
+		return
+	}
+	<-f.done
 }
 
 // func main() {
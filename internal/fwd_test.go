@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dhnt/m3/internal/lb"
+)
+
+func TestForwardProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		pl := lb.NewProxyListener(backend)
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				h, err := c.(*lb.ProxyConn).Header()
+				if err != nil || h == nil {
+					fmt.Fprintf(c, "no header: %v", err)
+					return
+				}
+				b := make([]byte, 2)
+				c.Read(b)
+				fmt.Fprintf(c, "%v %v %s", h.Version, h.PeerID(), b)
+			}()
+		}
+	}()
+
+	from := fmt.Sprintf("127.0.0.1:%v", FreePort())
+	go ForwardWith(from, backend.Addr().String(), ForwardOptions{SendProxy: lb.ProxyV2, Peers: true})
+
+	id := "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"
+	var c net.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", from); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the stream of a peer as ipfs p2p listen reports it
+	fmt.Fprintf(c, "%v\nhi", id)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := ioutil.ReadAll(c)
+	if expected := "2 " + id + " hi"; string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	// the target answers with its view of the client
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP([]byte(fmt.Sprintf("%s from %v", buf[:n], addr.Port)), addr)
+		}
+	}()
+
+	spec := ForwardSpec{Listen: "127.0.0.1:0", Target: target.LocalAddr().String()}
+	spec.Proto = "udp"
+	spec.IdleTimeout = 200 * time.Millisecond
+	f := newForward(spec, nil)
+	if err := f.start(spec.Target); err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	listener := f.udp.listener
+	r := f.udp
+
+	ports := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		c, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// replies go back to the client of the session
+		var port string
+		for j := 0; j < 3; j++ {
+			msg := fmt.Sprintf("ping %v %v", i, j)
+			c.Write([]byte(msg))
+			buf := make([]byte, 1500)
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(buf[:n]), msg+" from ") {
+				t.Fatalf("expected reply to %q, got %q", msg, buf[:n])
+			}
+			p := strings.TrimPrefix(string(buf[:n]), msg+" from ")
+			if port != "" && p != port {
+				t.Errorf("client %v moved from port %v to %v", i, port, p)
+			}
+			port = p
+		}
+		ports[port] = true
+	}
+	if len(ports) != 2 {
+		t.Errorf("expected a session per client, got %v", ports)
+	}
+	if st := f.status(); st.Active != 2 || st.Total != 2 || !st.Running {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	// idle sessions expire
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		r.Lock()
+		n := len(r.sessions)
+		r.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v sessions left", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
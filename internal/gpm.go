@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -100,6 +101,10 @@ func readOrCreateConf(base string) (string, error) {
 		}
 	}
 
+	return expandBase(string(data), base), nil
+}
+
+func expandBase(s, base string) string {
 	mapper := func(placeholder string) string {
 		switch placeholder {
 		case "DHNT_BASE":
@@ -107,7 +112,18 @@ func readOrCreateConf(base string) (string, error) {
 		}
 		return ""
 	}
-	return os.Expand(string(data), mapper), nil
+	return os.Expand(s, mapper)
+}
+
+// loadGPMConf reads the process list without creating a default config
+func loadGPMConf(base string) ([]AppDesc, error) {
+	data, err := ioutil.ReadFile(filepath.Join(base, "etc/gpm.json"))
+	if err != nil {
+		return nil, err
+	}
+	var apps []AppDesc
+	err = json.Unmarshal([]byte(expandBase(string(data), base)), &apps)
+	return apps, err
 }
 
 type GPM struct {
@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// CORS profiles
+const (
+	// corsNone leaves CORS headers to the origin
+	corsNone = "none"
+	// corsPublic allows any origin without credentials
+	corsPublic = "public"
+	// corsCredentials allows the requesting origin with credentials
+	corsCredentials = "credentials"
+)
+
+// HeaderOp adds, sets or removes a request or response header
+type HeaderOp struct {
+	Response bool
+	Op       string
+	Name     string
+	Value    string
+}
+
+func (h *HeaderOp) apply(header http.Header) {
+	switch h.Op {
+	case "add":
+		header.Add(h.Name, h.Value)
+	case "set":
+		header.Set(h.Name, h.Value)
+	case "remove":
+		header.Del(h.Name)
+	}
+}
+
+// headerRule is a header directive of the route file for a domain
+type headerRule struct {
+	re        *regexp.Regexp
+	pattern   string
+	op        *HeaderOp
+	cors      string
+	forwarded string
+}
+
+// parseHeaderRule parses the header directives:
+//
+//	header <domain> request|response add|set <name> <value>
+//	header <domain> request|response remove <name>
+//	cors <domain> none|public|credentials
+//	forwarded <domain> on|off
+func (c *RouteRegistry) parseHeaderRule(fs []string) (*headerRule, error) {
+	line := strings.Join(fs, " ")
+	if len(fs) < 3 {
+		return nil, fmt.Errorf("invalid entry: %q", line)
+	}
+	re, pa, err := c.parseDomain(fs[1])
+	if err != nil {
+		return nil, err
+	}
+	rule := &headerRule{
+		re:      re,
+		pattern: pa,
+	}
+
+	switch fs[0] {
+	case "cors":
+		switch fs[2] {
+		case corsNone, corsPublic, corsCredentials:
+		default:
+			return nil, fmt.Errorf("invalid CORS profile: %q", line)
+		}
+		rule.cors = fs[2]
+	case "forwarded":
+		if fs[2] != "on" && fs[2] != "off" {
+			return nil, fmt.Errorf("invalid forwarded flag: %q", line)
+		}
+		rule.forwarded = fs[2]
+	case "header":
+		if len(fs) < 5 {
+			return nil, fmt.Errorf("invalid header entry: %q", line)
+		}
+		op := &HeaderOp{
+			Op:   fs[3],
+			Name: http.CanonicalHeaderKey(fs[4]),
+		}
+		switch fs[2] {
+		case "request":
+		case "response":
+			op.Response = true
+		default:
+			return nil, fmt.Errorf("invalid header direction: %q", line)
+		}
+		switch op.Op {
+		case "add", "set":
+			if len(fs) < 6 {
+				return nil, fmt.Errorf("missing header value: %q", line)
+			}
+			op.Value = c.expandVar(strings.Join(fs[5:], " "))
+		case "remove":
+			if len(fs) > 5 {
+				return nil, fmt.Errorf("unexpected header value: %q", line)
+			}
+		default:
+			return nil, fmt.Errorf("invalid header operation: %q", line)
+		}
+		rule.op = op
+	}
+	return rule, nil
+}
+
+// HeaderPolicy is the header manipulation for requests to a host
+type HeaderPolicy struct {
+	// External hosts are reached outside of mirr's network
+	External bool
+	CORS     string
+	// Forwarded injects Forwarded and X-Forwarded-For request headers
+	Forwarded bool
+	Ops       []*HeaderOp
+}
+
+// HeaderPolicy returns the policy for hostname. External routes (direct,
+// exit, via) default to no CORS and no X-Peer-Id, the others to public CORS.
+// Matching header directives are applied in order on top.
+func (c *RouteRegistry) HeaderPolicy(hostname string) *HeaderPolicy {
+	p := &HeaderPolicy{
+		External: true,
+		CORS:     corsNone,
+	}
+	if r := c.MatchRoute(hostname); r != nil {
+		switch r.Action() {
+		case "direct", actionExit, "via":
+		default:
+			p.External = false
+			p.CORS = corsPublic
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, h := range c.Headers {
+		if !matchHost(h.re, h.pattern, hostname) {
+			continue
+		}
+		if h.cors != "" {
+			p.CORS = h.cors
+		}
+		if h.forwarded != "" {
+			p.Forwarded = h.forwarded == "on"
+		}
+		if h.op != nil {
+			p.Ops = append(p.Ops, h.op)
+		}
+	}
+	return p
+}
+
+// ApplyRequest rewrites the headers of a request from client
+func (p *HeaderPolicy) ApplyRequest(req *http.Request, client Client) {
+	// only the proxy marks requests of peers
+	req.Header.Del(proxyHopHeader)
+	if client.IsPeer() {
+		req.Header.Set(proxyHopHeader, "peer")
+	}
+	if p.External {
+		req.Header.Del("X-Peer-Id")
+	}
+	if p.Forwarded {
+		forwarded(req, client)
+	}
+	for _, op := range p.Ops {
+		if !op.Response {
+			op.apply(req.Header)
+		}
+	}
+}
+
+// forwarded identifies local clients by IP and peers by an obfuscated
+// identifier, RFC 7239 section 6.3
+func forwarded(req *http.Request, client Client) {
+	node := "_" + client.ID
+	if client.Class == clientLocal {
+		node = client.ID
+		if ip := net.ParseIP(client.ID); ip != nil && ip.To4() == nil {
+			node = `"[` + client.ID + `]"`
+		}
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+client.ID)
+		} else {
+			req.Header.Set("X-Forwarded-For", client.ID)
+		}
+	}
+	v := fmt.Sprintf("for=%v;host=%v;proto=%v", node, req.Host, req.URL.Scheme)
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		v = prior + ", " + v
+	}
+	req.Header.Set("Forwarded", v)
+}
+
+// ApplyResponse rewrites the headers of the response to req
+func (p *HeaderPolicy) ApplyResponse(resp *http.Response, req *http.Request, myID string) {
+	h := resp.Header
+	if p.External {
+		h.Del("X-Peer-Id")
+	} else {
+		h.Set("X-Peer-Id", myID)
+	}
+
+	switch p.CORS {
+	case corsPublic:
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", "*")
+		h.Set("Access-Control-Allow-Headers", "*")
+		h.Del("Access-Control-Allow-Credentials")
+	case corsCredentials:
+		// wildcards are not honored with credentials
+		if origin := req.Header.Get("Origin"); origin != "" {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+			h.Add("Vary", "Origin")
+			if m := req.Header.Get("Access-Control-Request-Method"); m != "" {
+				h.Set("Access-Control-Allow-Methods", m)
+			}
+			if rh := req.Header.Get("Access-Control-Request-Headers"); rh != "" {
+				h.Set("Access-Control-Allow-Headers", rh)
+			}
+		}
+	}
+
+	for _, op := range p.Ops {
+		if op.Response {
+			op.apply(h)
+		}
+	}
+}
+
+type headerState struct {
+	policy *HeaderPolicy
+	req    *http.Request
+}
+
+// HeaderHandler applies the route header policies in goproxy
+type HeaderHandler struct {
+	nb    *Neighborhood
+	peers *PeerListener
+}
+
+// NewHeaderHandler creates a header handler, clients are identified by peers
+func NewHeaderHandler(nb *Neighborhood, peers *PeerListener) *HeaderHandler {
+	return &HeaderHandler{
+		nb:    nb,
+		peers: peers,
+	}
+}
+
+// Apply rewrites the headers of req and returns the policy for its response
+func (r *HeaderHandler) Apply(req *http.Request) *HeaderPolicy {
+	if r.nb.Router == nil {
+		return &HeaderPolicy{}
+	}
+	p := r.nb.Router.HeaderPolicy(req.URL.Hostname())
+	p.ApplyRequest(req, r.peers.ClientOf(req))
+	return p
+}
+
+// OnRequest rewrites request headers
+func (r *HeaderHandler) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.nb.Router == nil {
+		return req, nil
+	}
+	p := r.nb.Router.HeaderPolicy(req.URL.Hostname())
+	// the response handler needs the headers as the client sent them
+	orig := &http.Request{
+		Header: req.Header,
+	}
+	req.Header = cloneHeader(req.Header)
+	p.ApplyRequest(req, r.peers.ClientOf(req))
+	stateOf(ctx).header = &headerState{
+		policy: p,
+		req:    orig,
+	}
+	return req, nil
+}
+
+// OnResponse rewrites response headers
+func (r *HeaderHandler) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || stateOf(ctx).handled("header", resp) {
+		return resp
+	}
+	stateOf(ctx).handle("header", resp, resp)
+	st := stateOf(ctx).header
+	if st == nil {
+		// short-circuited before the policy was looked up
+		if r.nb.Router == nil {
+			return resp
+		}
+		st = &headerState{
+			policy: r.nb.Router.HeaderPolicy(ctx.Req.URL.Hostname()),
+			req:    ctx.Req,
+		}
+	}
+	st.policy.ApplyResponse(resp, st.req, r.nb.My.ID)
+	return resp
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
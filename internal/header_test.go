@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	rr := NewRouteRegistry("")
+	err := rr.ReadString(`
+*.home       localhost
+*.example.com direct
+/.*/         direct
+
+cors      api.home         credentials
+forwarded *.home           on
+header    *.home           response set X-Frame-Options SAMEORIGIN
+header    *.home           request remove Cookie
+header    www.example.com  response add X-Note hello world
+cors      www.example.com  public
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// external site keeps its headers, X-Peer-Id is stripped
+	p := rr.HeaderPolicy("news.example.com")
+	if !p.External || p.CORS != corsNone || p.Forwarded || len(p.Ops) != 0 {
+		t.Fatalf("unexpected external policy: %+v", p)
+	}
+	req := httptest.NewRequest("GET", "http://news.example.com/", nil)
+	req.Header.Set("X-Peer-Id", "me")
+	req.Header.Set("Origin", "http://evil.test")
+	p.ApplyRequest(req, Client{Class: clientLocal, ID: "10.0.0.2"})
+	if req.Header.Get("X-Peer-Id") != "" || req.Header.Get("Forwarded") != "" {
+		t.Fatalf("unexpected request headers: %v", req.Header)
+	}
+	resp := &http.Response{Header: http.Header{"X-Peer-Id": {"other"}}}
+	p.ApplyResponse(resp, req, "me")
+	if len(resp.Header) != 0 {
+		t.Fatalf("unexpected response headers: %v", resp.Header)
+	}
+
+	// local service
+	p = rr.HeaderPolicy("app.home")
+	if p.External || p.CORS != corsPublic || !p.Forwarded || len(p.Ops) != 2 {
+		t.Fatalf("unexpected home policy: %+v", p)
+	}
+	req = httptest.NewRequest("GET", "http://app.home/", nil)
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Set("X-Forwarded-For", "192.168.1.5")
+	p.ApplyRequest(req, Client{Class: clientLocal, ID: "10.0.0.2"})
+	if req.Header.Get("Cookie") != "" {
+		t.Fatal("expected cookie removed")
+	}
+	if v := req.Header.Get("X-Forwarded-For"); v != "192.168.1.5, 10.0.0.2" {
+		t.Fatalf("X-Forwarded-For: %v", v)
+	}
+	if v := req.Header.Get("Forwarded"); v != "for=10.0.0.2;host=app.home;proto=http" {
+		t.Fatalf("Forwarded: %v", v)
+	}
+	resp = &http.Response{Header: http.Header{}}
+	p.ApplyResponse(resp, req, "me")
+	if resp.Header.Get("X-Peer-Id") != "me" ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "*" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "" ||
+		resp.Header.Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Fatalf("unexpected response headers: %v", resp.Header)
+	}
+
+	// peers are identified by an obfuscated node
+	req = httptest.NewRequest("GET", "http://app.home/", nil)
+	p.ApplyRequest(req, Client{Class: clientPeer, ID: "QmPeer"})
+	if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != "for=_QmPeer;host=app.home;proto=http" {
+		t.Fatalf("unexpected peer forwarding headers: %v", req.Header)
+	}
+
+	// credentials profile reflects the origin
+	p = rr.HeaderPolicy("api.home")
+	req = httptest.NewRequest("OPTIONS", "http://api.home/", nil)
+	req.Header.Set("Origin", "http://app.home")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	resp = &http.Response{Header: http.Header{}}
+	p.ApplyResponse(resp, req, "me")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://app.home" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "PUT" {
+		t.Fatalf("unexpected CORS headers: %v", resp.Header)
+	}
+
+	// explicit profile and values with spaces for an external site
+	p = rr.HeaderPolicy("www.example.com")
+	resp = &http.Response{Header: http.Header{}}
+	p.ApplyResponse(resp, httptest.NewRequest("GET", "http://www.example.com/", nil), "me")
+	if resp.Header.Get("X-Note") != "hello world" || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("unexpected response headers: %v", resp.Header)
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	for _, cfg := range []string{
+		"cors *.home",
+		"cors *.home open",
+		"forwarded *.home yes",
+		"header *.home request set X-A",
+		"header *.home request remove X-A b",
+		"header *.home both set X-A b",
+		"header *.home request append X-A b",
+	} {
+		if err := NewRouteRegistry("").ReadString(cfg); err == nil {
+			t.Errorf("%q: expected error", cfg)
+		}
+	}
+}
+
+func TestErrorPageHeaders(t *testing.T) {
+	down := FreePort()
+	_, l, stop := startTestNode(t, &Config{}, testPeerID, fmt.Sprintf("down.home 127.0.0.1:%v", down), nil)
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://down.home/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// goproxy filters error pages twice
+	if resp.StatusCode != http.StatusBadGateway || len(resp.Header["X-Peer-Id"]) != 1 {
+		t.Errorf("unexpected response: %v %v", resp.Status, resp.Header)
+	}
+}
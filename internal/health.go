@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gostones/gpm"
+)
+
+// component status
+const (
+	StatusUp      = "up"
+	StatusDown    = "down"
+	StatusUnknown = "unknown"
+)
+
+// errUnknown signals a check could not determine the component state
+var errUnknown = fmt.Errorf("status unknown")
+
+// ComponentHealth is the result of a single component check
+type ComponentHealth struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Latency  int64  `json:"latency"` // milliseconds
+}
+
+// Health is the aggregated health report of the node
+type Health struct {
+	Status     string            `json:"status"`
+	Healthy    bool              `json:"healthy"`
+	Ready      bool              `json:"ready"`
+	Timestamp  int64             `json:"timestamp"`
+	Components []ComponentHealth `json:"components"`
+}
+
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func() error
+}
+
+// HealthChecker runs component checks and caches the last report.
+// Critical components decide readiness, all components decide overall health.
+type HealthChecker struct {
+	checks  []*healthCheck
+	ttl     time.Duration
+	last    *Health
+	checked time.Time
+
+	mu sync.Mutex
+}
+
+// NewHealthChecker creates a checker that caches reports for ttl
+func NewHealthChecker(ttl time.Duration) *HealthChecker {
+	return &HealthChecker{
+		ttl: ttl,
+	}
+}
+
+// Add registers a component check. A nil error from check means up.
+func (r *HealthChecker) Add(name string, critical bool, check func() error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, &healthCheck{
+		name:     name,
+		critical: critical,
+		check:    check,
+	})
+	r.last = nil
+}
+
+// Check returns the cached report or runs all checks if it has expired
+func (r *HealthChecker) Check() *Health {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.last != nil && now.Sub(r.checked) < r.ttl {
+		return r.last
+	}
+
+	h := &Health{
+		Status:     StatusUp,
+		Healthy:    true,
+		Ready:      true,
+		Timestamp:  ToTimestamp(now),
+		Components: make([]ComponentHealth, len(r.checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range r.checks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			defer wg.Done()
+			h.Components[i] = runCheck(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range h.Components {
+		if c.Status != StatusDown {
+			continue
+		}
+		h.Healthy = false
+		h.Status = StatusDown
+		if c.Critical {
+			h.Ready = false
+		}
+	}
+	r.last = h
+	r.checked = now
+
+	return h
+}
+
+func runCheck(c *healthCheck) ComponentHealth {
+	start := time.Now()
+	err := c.check()
+	ch := ComponentHealth{
+		Name:     c.name,
+		Status:   StatusUp,
+		Critical: c.critical,
+		Latency:  int64(time.Since(start) / time.Millisecond),
+	}
+	switch err {
+	case nil:
+	case errUnknown:
+		ch.Status = StatusUnknown
+	default:
+		ch.Status = StatusDown
+		ch.Error = err.Error()
+	}
+	return ch
+}
+
+// HealthHandlerFunc reports all components; 503 if any is down
+func (r *HealthChecker) HealthHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := r.Check()
+		writeHealth(w, h, h.Healthy)
+	})
+}
+
+// ReadyHandlerFunc is for readiness probes; 503 if any critical component is down
+func (r *HealthChecker) ReadyHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := r.Check()
+		writeHealth(w, h, h.Ready)
+	})
+}
+
+// LiveHandlerFunc is for liveness probes; it succeeds as long as mirr serves requests
+func (r *HealthChecker) LiveHandlerFunc() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := &Health{
+			Status:    StatusUp,
+			Healthy:   true,
+			Ready:     true,
+			Timestamp: ToTimestamp(time.Now()),
+		}
+		writeHealth(w, h, true)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, h *Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// NewNodeHealthChecker sets up checks for route table, IPFS, p2p listener,
+// gpm processes and the optional external probe targets of the config.
+func NewNodeHealthChecker(nb *Neighborhood, proxyURL string) *HealthChecker {
+	hc := NewHealthChecker(15 * time.Second)
+
+	hc.Add("routes", true, checkRoutes(nb))
+	hc.Add("ipfs", true, checkIPFS)
+	hc.Add("p2p", true, checkP2PListener)
+
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		apps, err := loadGPMConf(base)
+		if err != nil {
+			logger.Infof("health: gpm processes not checked: %v", err)
+		}
+		for _, app := range apps {
+			hc.Add("process:"+app.Name, false, checkProcess(app.Command))
+		}
+	}
+
+	if nb.config != nil {
+		for _, target := range nb.config.HealthProbes {
+			hc.Add("probe:"+target, false, checkProbe(proxyURL, target))
+		}
+	}
+
+	return hc
+}
+
+func checkRoutes(nb *Neighborhood) func() error {
+	return func() error {
+		if nb.Router == nil {
+			return fmt.Errorf("route table not loaded")
+		}
+		nb.Router.mu.Lock()
+		defer nb.Router.mu.Unlock()
+		if len(nb.Router.Routes) == 0 {
+			return fmt.Errorf("route table empty")
+		}
+		return nil
+	}
+}
+
+func checkIPFS() error {
+	n, err := p2pID()
+	if err != nil {
+		return err
+	}
+	if n.ID == "" {
+		return fmt.Errorf("IPFS API returned no peer ID")
+	}
+	return nil
+}
+
+func checkP2PListener() error {
+	ls, err := p2pLs()
+	if err != nil {
+		return err
+	}
+	for _, l := range ls {
+		if l.Protocol == protocolWWW && strings.HasPrefix(l.ListenAddress, "/ipfs/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("p2p listener not registered: %v", protocolWWW)
+}
+
+// checkListener connects to the local port
+func checkListener(port int) func() error {
+	addr := fmt.Sprintf("127.0.0.1:%v", port)
+	return func() error {
+		c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// checkProbe requests target through the proxy; any response counts as up.
+func checkProbe(proxyURL, target string) func() error {
+	pu, _ := url.Parse(proxyURL)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(pu),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func() error {
+		resp, err := client.Head(target)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%v: %v", target, resp.Status)
+		}
+		return nil
+	}
+}
+
+// checkProcess looks for a running process with the given gpm command line.
+// Process tables are read from /proc; elsewhere the status is unknown.
+func checkProcess(command string) func() error {
+	tokens := gpm.Tokenize(command)
+	return func() error {
+		if len(tokens) == 0 {
+			return errUnknown
+		}
+		found, err := processRunning(tokens)
+		if err != nil {
+			return errUnknown
+		}
+		if !found {
+			return fmt.Errorf("not running: %v", tokens[0])
+		}
+		return nil
+	}
+}
+
+func processRunning(tokens []string) (bool, error) {
+	pids, err := processIDs(tokens)
+	return len(pids) > 0, err
+}
+
+// processIDs returns the processes running the command line tokens
+func processIDs(tokens []string) ([]int, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil || len(dirs) == 0 {
+		return nil, errUnknown
+	}
+	var pids []int
+	for _, d := range dirs {
+		b, err := ioutil.ReadFile(d)
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+		if matchCommand(args, tokens) {
+			if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(d))); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids, nil
+}
+
+// matchCommand compares the executable base name and the arguments
+func matchCommand(args, tokens []string) bool {
+	if len(args) != len(tokens) {
+		return false
+	}
+	if filepath.Base(args[0]) != filepath.Base(tokens[0]) {
+		return false
+	}
+	for i := 1; i < len(args); i++ {
+		if args[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	hc := NewHealthChecker(time.Minute)
+	hc.Add("critical", true, func() error { return nil })
+	hc.Add("optional", false, func() error { return fmt.Errorf("down") })
+	hc.Add("unknown", false, func() error { return errUnknown })
+
+	h := hc.Check()
+	if h.Healthy || !h.Ready || h.Status != StatusDown {
+		t.Errorf("Check() is %+v, want unhealthy but ready", h)
+	}
+	if h.Components[1].Error != "down" || h.Components[2].Status != StatusUnknown {
+		t.Errorf("Check() components are %+v", h.Components)
+	}
+
+	tests := []struct {
+		handler http.HandlerFunc
+		code    int
+	}{
+		{hc.HealthHandlerFunc(), http.StatusServiceUnavailable},
+		{hc.ReadyHandlerFunc(), http.StatusOK},
+		{hc.LiveHandlerFunc(), http.StatusOK},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		test.handler(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != test.code {
+			t.Errorf("handler %v status is %v, want %v", i, w.Code, test.code)
+		}
+		var r Health
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Errorf("handler %v body: %v", i, err)
+		}
+	}
+
+	hc.Add("failing", true, func() error { return fmt.Errorf("down") })
+	if h := hc.Check(); h.Ready {
+		t.Errorf("Check() is %+v, want not ready", h)
+	}
+}
+
+func TestMatchCommand(t *testing.T) {
+	tokens := []string{"gotty", "--port", "50022"}
+	if !matchCommand([]string{"/usr/bin/gotty", "--port", "50022"}, tokens) {
+		t.Fail()
+	}
+	if matchCommand([]string{"/usr/bin/gotty", "--port", "50023"}, tokens) {
+		t.Fail()
+	}
+	if matchCommand([]string{"gotty"}, tokens) {
+		t.Fail()
+	}
+}
+
+func TestCheckListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := checkListener(l.Addr().(*net.TCPAddr).Port)
+	if err := check(); err != nil {
+		t.Errorf("listener down: %v", err)
+	}
+	l.Close()
+	if err := check(); err == nil {
+		t.Error("closed listener up")
+	}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/ed25519"
+)
+
+// libp2p key types
+const (
+	keyTypeRSA     = 0
+	keyTypeEd25519 = 1
+)
+
+// public keys up to this size are inlined in the peer ID
+const maxInlineKeyLength = 42
+
+// IdentityKey signs on behalf of this node with the private key of its
+// IPFS identity. Signatures can be checked against the peer ID alone.
+type IdentityKey struct {
+	PeerID string
+
+	typ int
+	rsa *rsa.PrivateKey
+	ed  ed25519.PrivateKey
+	// pub is the libp2p protobuf encoded public key
+	pub []byte
+}
+
+// IPFSPath returns the IPFS repository, $IPFS_PATH or ~/.ipfs
+func IPFSPath() string {
+	if p := os.Getenv("IPFS_PATH"); p != "" {
+		return p
+	}
+	return filepath.Join(os.Getenv("HOME"), ".ipfs")
+}
+
+// marshalKey encodes a libp2p key: message { KeyType Type = 1; bytes Data = 2; }
+func marshalKey(typ int, data []byte) []byte {
+	b := []byte{0x08, byte(typ), 0x12}
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(data)))]...)
+	return append(b, data...)
+}
+
+// unmarshalKey decodes a libp2p key
+func unmarshalKey(b []byte) (int, []byte, error) {
+	typ := -1
+	var data []byte
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, fmt.Errorf("invalid key encoding")
+		}
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, fmt.Errorf("invalid key encoding")
+		}
+		b = b[n:]
+		switch tag {
+		case 0x08:
+			typ = int(v)
+		case 0x12:
+			if uint64(len(b)) < v {
+				return 0, nil, fmt.Errorf("invalid key encoding")
+			}
+			data = b[:v]
+			b = b[v:]
+		default:
+			return 0, nil, fmt.Errorf("invalid key field: %v", tag)
+		}
+	}
+	if typ < 0 || data == nil {
+		return 0, nil, fmt.Errorf("incomplete key")
+	}
+	return typ, data, nil
+}
+
+// LoadIdentityKey reads the identity of the IPFS repository at path
+func LoadIdentityKey(path string) (*IdentityKey, error) {
+	b, err := ioutil.ReadFile(filepath.Join(path, "config"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Identity struct {
+			PeerID  string
+			PrivKey string
+		}
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("IPFS config: %v", err)
+	}
+	priv, err := base64.StdEncoding.DecodeString(cfg.Identity.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("IPFS identity: %v", err)
+	}
+	typ, data, err := unmarshalKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("IPFS identity: %v", err)
+	}
+
+	k := &IdentityKey{
+		PeerID: cfg.Identity.PeerID,
+		typ:    typ,
+	}
+	switch typ {
+	case keyTypeRSA:
+		k.rsa, err = x509.ParsePKCS1PrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("IPFS identity: %v", err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(&k.rsa.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		k.pub = marshalKey(typ, pub)
+	case keyTypeEd25519:
+		// older keys repeat the public key after the private key
+		if len(data) != ed25519.PrivateKeySize && len(data) != ed25519.PrivateKeySize+ed25519.PublicKeySize {
+			return nil, fmt.Errorf("IPFS identity: invalid Ed25519 key")
+		}
+		k.ed = ed25519.PrivateKey(data[:ed25519.PrivateKeySize])
+		k.pub = marshalKey(typ, k.ed.Public().(ed25519.PublicKey))
+	default:
+		return nil, fmt.Errorf("IPFS identity: unsupported key type: %v", typ)
+	}
+
+	if id, err := peerIDOfKey(k.pub); err != nil || id != k.PeerID {
+		return nil, fmt.Errorf("IPFS identity: key does not match peer ID %v", k.PeerID)
+	}
+	return k, nil
+}
+
+// PublicKey returns the libp2p encoded public key
+func (k *IdentityKey) PublicKey() []byte {
+	return k.pub
+}
+
+// Sign signs msg the way libp2p does for the key type
+func (k *IdentityKey) Sign(msg []byte) ([]byte, error) {
+	if k.typ == keyTypeEd25519 {
+		return ed25519.Sign(k.ed, msg), nil
+	}
+	h := sha256.Sum256(msg)
+	return rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, h[:])
+}
+
+// peerIDOfKey derives the peer ID from a libp2p encoded public key
+func peerIDOfKey(pub []byte) (string, error) {
+	var m multihash.Multihash
+	var err error
+	if len(pub) <= maxInlineKeyLength {
+		m, err = multihash.Encode(pub, multihash.ID)
+	} else {
+		m, err = multihash.Sum(pub, multihash.SHA2_256, -1)
+	}
+	if err != nil {
+		return "", err
+	}
+	return m.B58String(), nil
+}
+
+// verifySignature checks sig of msg by the libp2p encoded public key
+func verifySignature(pub, msg, sig []byte) error {
+	typ, data, err := unmarshalKey(pub)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case keyTypeRSA:
+		k, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			return err
+		}
+		rk, ok := k.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("not an RSA key")
+		}
+		h := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(rk, crypto.SHA256, h[:], sig)
+	case keyTypeEd25519:
+		if len(data) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(data), msg, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type: %v", typ)
+}
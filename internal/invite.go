@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// default address book below $DHNT_BASE
+const addressBookFile = "etc/peers.json"
+
+// size of the QR code images in pixels
+const qrSize = 320
+
+// inviteContext prefixes the signed payload so that invite signatures are
+// not valid for anything else signed with the identity key
+const inviteContext = "m3-invite-v1\n"
+
+// DefaultInviteMaxAge is how long invites are accepted after their creation
+const DefaultInviteMaxAge = 30 * 24 * time.Hour
+
+// inviteClockSkew tolerates the clock of the inviting node being ahead
+const inviteClockSkew = time.Hour
+
+// Invite introduces this node to another. It is signed with the IPFS
+// identity key and the key is checked against the peer ID on import.
+type Invite struct {
+	ID      string   `json:"id"`
+	Addr    string   `json:"addr"`
+	Name    string   `json:"name,omitempty"`
+	URLs    []string `json:"urls,omitempty"`
+	Created int64    `json:"created"`
+	// Key is the libp2p encoded public key of the peer
+	Key []byte `json:"key"`
+}
+
+// NodeURLs returns the .m3 URLs of the node addr and its services
+func NodeURLs(addr string, services []string) []string {
+	urls := []string{fmt.Sprintf("http://%v.m3/", addr)}
+	for _, s := range services {
+		urls = append(urls, fmt.Sprintf("http://%v.%v.m3/", s, addr))
+	}
+	return urls
+}
+
+// NewInvite creates a signed invite token for the node of key
+func NewInvite(key *IdentityKey, name string, services []string) (string, error) {
+	addr := ToPeerAddr(key.PeerID)
+	inv := &Invite{
+		ID:      key.PeerID,
+		Addr:    addr,
+		Name:    name,
+		URLs:    NodeURLs(addr, services),
+		Created: time.Now().Unix(),
+		Key:     key.PublicKey(),
+	}
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.Sign(append([]byte(inviteContext), payload...))
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sig), nil
+}
+
+// InviteLink returns the link opening token on the mirr at base
+func InviteLink(base, token string) string {
+	return strings.TrimSuffix(base, "/") + "/invite?t=" + token
+}
+
+// ParseInvite verifies an invite link or bare token, rejecting invites
+// older than maxAge unless it is 0
+func ParseInvite(s string, maxAge time.Duration) (*Invite, error) {
+	token := strings.TrimSpace(s)
+	if u, err := url.Parse(token); err == nil && u.Query().Get("t") != "" {
+		token = u.Query().Get("t")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid invite")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %v", err)
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite signature: %v", err)
+	}
+
+	var inv Invite
+	if err := json.Unmarshal(payload, &inv); err != nil {
+		return nil, fmt.Errorf("invalid invite: %v", err)
+	}
+	if id, err := peerIDOfKey(inv.Key); err != nil || id != inv.ID {
+		return nil, fmt.Errorf("invite key does not belong to peer %v", inv.ID)
+	}
+	if err := verifySignature(inv.Key, append([]byte(inviteContext), payload...), sig); err != nil {
+		return nil, fmt.Errorf("invite signature: %v", err)
+	}
+	created := time.Unix(inv.Created, 0)
+	if created.After(time.Now().Add(inviteClockSkew)) {
+		return nil, fmt.Errorf("invite created in the future: %v", created)
+	}
+	if maxAge > 0 && time.Since(created) > maxAge {
+		return nil, fmt.Errorf("invite expired, it was created %v", created.Format("2006-01-02"))
+	}
+	if inv.Addr != ToPeerAddr(inv.ID) {
+		return nil, fmt.Errorf("invite address does not match peer %v", inv.ID)
+	}
+	return &inv, nil
+}
+
+// QRCode renders content as PNG
+func QRCode(content string) ([]byte, error) {
+	return qrcode.Encode(content, qrcode.Medium, qrSize)
+}
+
+// BookEntry is a peer imported from an invite
+type BookEntry struct {
+	ID    string    `json:"id"`
+	Addr  string    `json:"addr"`
+	Name  string    `json:"name,omitempty"`
+	URLs  []string  `json:"urls,omitempty"`
+	Added time.Time `json:"added"`
+}
+
+// AddressBook is the list of known peers kept in a JSON file
+type AddressBook struct {
+	path string
+	sync.Mutex
+}
+
+// DefaultAddressBookFile returns $DHNT_BASE/etc/peers.json or empty if
+// DHNT_BASE is not set
+func DefaultAddressBookFile() string {
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		return filepath.Join(base, addressBookFile)
+	}
+	return ""
+}
+
+// NewAddressBook opens the address book at path
+func NewAddressBook(path string) *AddressBook {
+	return &AddressBook{
+		path: path,
+	}
+}
+
+func (r *AddressBook) read() ([]BookEntry, error) {
+	if r.path == "" {
+		return nil, fmt.Errorf("no address book, set DHNT_BASE")
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return []BookEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []BookEntry
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%v: %v", r.path, err)
+	}
+	return list, nil
+}
+
+// List returns the entries in the order they were added
+func (r *AddressBook) List() ([]BookEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.read()
+}
+
+// Resolve returns the peer ID of s, a peer address or ID, or the name of
+// an address book entry, optionally followed by .m3
+func (r *AddressBook) Resolve(s string) (string, error) {
+	s = strings.TrimSuffix(s, ".m3")
+	if id := ToPeerID(s); id != "" {
+		return id, nil
+	}
+	list, err := r.List()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range list {
+		if strings.EqualFold(e.Name, s) {
+			return e.ID, nil
+		}
+	}
+	return "", fmt.Errorf("unknown peer: %v", s)
+}
+
+// Add stores the peer of inv, replacing an entry of the same peer
+func (r *AddressBook) Add(inv *Invite) (*BookEntry, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	list, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	e := BookEntry{
+		ID:    inv.ID,
+		Addr:  inv.Addr,
+		Name:  inv.Name,
+		URLs:  inv.URLs,
+		Added: time.Now(),
+	}
+	found := false
+	for i := range list {
+		if list[i].ID == e.ID {
+			list[i] = e
+			found = true
+		}
+	}
+	if !found {
+		list = append(list, e)
+	}
+
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	ensureDir(r.path)
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return nil, err
+	}
+	return &e, os.Rename(tmp, r.path)
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// writeIPFSRepo creates an IPFS config holding the identity of typ
+func writeIPFSRepo(t *testing.T, dir string, typ int) string {
+	var priv, pub []byte
+	switch typ {
+	case keyTypeRSA:
+		k, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv = x509.MarshalPKCS1PrivateKey(k)
+		pub, _ = x509.MarshalPKIXPublicKey(&k.PublicKey)
+	case keyTypeEd25519:
+		pk, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = sk, pk
+	}
+	id, err := peerIDOfKey(marshalKey(typ, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := fmt.Sprintf(`{"Identity":{"PeerID":%q,"PrivKey":%q}}`, id, base64.StdEncoding.EncodeToString(marshalKey(typ, priv)))
+	writeTestFile(t, dir, "config", cfg)
+	return id
+}
+
+func TestInvite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirr-invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, typ := range []int{keyTypeRSA, keyTypeEd25519} {
+		id := writeIPFSRepo(t, dir, typ)
+		key, err := LoadIdentityKey(dir)
+		if err != nil {
+			t.Fatalf("key type %v: %v", typ, err)
+		}
+		if key.PeerID != id {
+			t.Fatalf("expected %v, got %v", id, key.PeerID)
+		}
+
+		s := NewShareInfo(id, key, "alice", []string{"git"}, "http://127.0.0.1:18080")
+		if s.InviteError != "" || !strings.HasPrefix(s.Invite, "http://127.0.0.1:18080/invite?t=") {
+			t.Fatalf("invite: %+v", s)
+		}
+		inv, err := ParseInvite(s.Invite, DefaultInviteMaxAge)
+		if err != nil {
+			t.Fatalf("key type %v: %v", typ, err)
+		}
+		addr := ToPeerAddr(id)
+		if inv.ID != id || inv.Addr != addr || inv.Name != "alice" {
+			t.Errorf("unexpected invite: %+v", inv)
+		}
+		if len(inv.URLs) != 2 || inv.URLs[1] != "http://git."+addr+".m3/" {
+			t.Errorf("unexpected URLs: %v", inv.URLs)
+		}
+
+		// the payload can not be changed without the key
+		token := s.Invite[strings.Index(s.Invite, "=")+1:]
+		parts := strings.Split(token, ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		forged := strings.Replace(string(payload), "alice", "mallory", 1)
+		if _, err := ParseInvite(base64.RawURLEncoding.EncodeToString([]byte(forged))+"."+parts[1], DefaultInviteMaxAge); err == nil {
+			t.Errorf("key type %v: forged invite accepted", typ)
+		}
+	}
+
+	// a key of another peer
+	other := writeIPFSRepo(t, dir, keyTypeEd25519)
+	key, _ := LoadIdentityKey(dir)
+	token, _ := NewInvite(key, "", nil)
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	swapped := strings.Replace(string(payload), other, "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk", 1)
+	if _, err := ParseInvite(base64.RawURLEncoding.EncodeToString([]byte(swapped))+"."+strings.Split(token, ".")[1], DefaultInviteMaxAge); err == nil {
+		t.Error("invite with foreign key accepted")
+	}
+
+	sign := func(created time.Time, context string) string {
+		inv := &Invite{ID: key.PeerID, Addr: ToPeerAddr(key.PeerID), Created: created.Unix(), Key: key.PublicKey()}
+		payload, _ := json.Marshal(inv)
+		sig, err := key.Sign(append([]byte(context), payload...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	if _, err := ParseInvite(sign(time.Now(), inviteContext), DefaultInviteMaxAge); err != nil {
+		t.Errorf("fresh invite: %v", err)
+	}
+	if _, err := ParseInvite(sign(old, inviteContext), DefaultInviteMaxAge); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired invite: %v", err)
+	}
+	if _, err := ParseInvite(sign(old, inviteContext), 0); err != nil {
+		t.Errorf("invite without age limit: %v", err)
+	}
+	if _, err := ParseInvite(sign(time.Now().Add(24*time.Hour), inviteContext), DefaultInviteMaxAge); err == nil {
+		t.Error("invite from the future accepted")
+	}
+	// signatures of the bare payload are not invites
+	if _, err := ParseInvite(sign(time.Now(), ""), DefaultInviteMaxAge); err == nil {
+		t.Error("invite signed without context accepted")
+	}
+}
+
+func TestAddressBook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirr-book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id := writeIPFSRepo(t, dir, keyTypeEd25519)
+	key, err := LoadIdentityKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb := NewNeighborhood(&Config{AddressBook: filepath.Join(dir, "etc", "peers.json")})
+	nb.My = &Node{ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	mux := http.NewServeMux()
+	NewShare(nb, NewAdminAuth(nil), "http://127.0.0.1:18080").Register(mux)
+
+	for _, name := range []string{"bob", "bobby"} {
+		token, err := NewInvite(key, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/invite?t="+token, nil))
+		if w.Code != 200 || !strings.Contains(w.Body.String(), name+" invites you") {
+			t.Errorf("invite page: %v %v", w.Code, w.Body.String())
+		}
+
+		req := httptest.NewRequest("POST", "http://127.0.0.1:18080/dashboard/api/book", strings.NewReader("t="+url.QueryEscape(token)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "127.0.0.1:5000"
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("import: %v %v", w.Code, w.Body.String())
+		}
+	}
+
+	list, err := NewAddressBook(nb.config.AddressBook).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].Name != "bobby" {
+		t.Errorf("unexpected address book: %+v", list)
+	}
+	book := NewAddressBook(nb.config.AddressBook)
+	for _, s := range []string{"bobby", "Bobby.m3", id} {
+		if got, err := book.Resolve(s); err != nil || got != id {
+			t.Errorf("resolve %v: %v %v", s, got, err)
+		}
+	}
+	if _, err := book.Resolve("bob"); err == nil {
+		t.Error("replaced entry resolved")
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/invite?t=bogus", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid invite") {
+		t.Errorf("bogus invite: %v", w.Code)
+	}
+}
@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it, replaced in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Schedule returns the first time a job runs after t, the zero time if it
+// does not run again. CronSchedule is a Schedule.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type interval time.Duration
+
+func (d interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(d))
+}
+
+// Interval schedules a job every d, the first run is d after it is added
+func Interval(d time.Duration) Schedule {
+	return interval(d)
+}
+
+// overlap policies of a job due while still running
+const (
+	// OverlapSkip drops the run, the default
+	OverlapSkip = "skip"
+	// OverlapQueue runs once more after the running one, further runs due
+	// meanwhile are dropped
+	OverlapQueue = "queue"
+	// OverlapAllow runs concurrently
+	OverlapAllow = "allow"
+)
+
+// jobHistory is the number of runs kept per job
+const jobHistory = 10
+
+// ErrJobExists is returned when adding a job of a name already scheduled
+var ErrJobExists = errors.New("job exists")
+
+// ErrNoJob is returned for a name that is not scheduled
+var ErrNoJob = errors.New("no such job")
+
+// JobFunc is the work of a job, ctx is cancelled when the job is removed or
+// the scheduler stopped
+type JobFunc func(ctx context.Context) error
+
+// JobOptions configure a job
+type JobOptions struct {
+	// Overlap is OverlapSkip, OverlapQueue or OverlapAllow
+	Overlap string
+	// Jitter delays each run randomly by up to Jitter
+	Jitter time.Duration
+}
+
+// JobRun records a run of a job
+type JobRun struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// JobStatus reports a job and its recent runs, latest first
+type JobStatus struct {
+	Name    string    `json:"name"`
+	Overlap string    `json:"overlap"`
+	Running int       `json:"running"`
+	Next    time.Time `json:"next"`
+	Runs    int64     `json:"runs"`
+	Failed  int64     `json:"failed"`
+	Skipped int64     `json:"skipped"`
+	History []JobRun  `json:"history"`
+}
+
+// Scheduler runs named jobs on their schedules. Runs are recorded and a
+// panic fails the run rather than the process.
+type Scheduler struct {
+	clock  Clock
+	ctx    context.Context
+	cancel context.CancelFunc
+	rand   *rand.Rand
+	wg     sync.WaitGroup
+
+	jobs map[string]*scheduledJob
+	sync.Mutex
+}
+
+type scheduledJob struct {
+	s    *Scheduler
+	name string
+	when Schedule
+	fn   JobFunc
+	opts JobOptions
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	trigger chan struct{}
+
+	// guarded by s
+	running int
+	queued  bool
+	next    time.Time
+	runs    int64
+	failed  int64
+	skipped int64
+	history []JobRun
+}
+
+// NewScheduler creates a scheduler telling time by clock, the system
+// clock if nil
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = realClock{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		clock:  clock,
+		ctx:    ctx,
+		cancel: cancel,
+		rand:   rand.New(rand.NewSource(clock.Now().UnixNano())),
+		jobs:   make(map[string]*scheduledJob),
+	}
+}
+
+// Add schedules fn as the job name
+func (r *Scheduler) Add(name string, when Schedule, fn JobFunc, opts JobOptions) error {
+	switch opts.Overlap {
+	case "":
+		opts.Overlap = OverlapSkip
+	case OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		return fmt.Errorf("job %v: unknown overlap policy %q", name, opts.Overlap)
+	}
+	if when == nil || fn == nil {
+		return fmt.Errorf("job %v: schedule and function are required", name)
+	}
+	if opts.Jitter < 0 {
+		return fmt.Errorf("job %v: jitter must not be negative", name)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.ctx.Err() != nil {
+		return fmt.Errorf("job %v: scheduler stopped", name)
+	}
+	if r.jobs[name] != nil {
+		return ErrJobExists
+	}
+	j := &scheduledJob{
+		s:       r,
+		name:    name,
+		when:    when,
+		fn:      fn,
+		opts:    opts,
+		trigger: make(chan struct{}, 1),
+	}
+	j.ctx, j.cancel = context.WithCancel(r.ctx)
+	r.jobs[name] = j
+	go j.loop()
+	return nil
+}
+
+// Remove unschedules the job name and cancels its runs
+func (r *Scheduler) Remove(name string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	j := r.jobs[name]
+	if j == nil {
+		return ErrNoJob
+	}
+	j.cancel()
+	delete(r.jobs, name)
+	return nil
+}
+
+// RunNow runs the job name as if it were due
+func (r *Scheduler) RunNow(name string) error {
+	r.Lock()
+	j := r.jobs[name]
+	r.Unlock()
+	if j == nil {
+		return ErrNoJob
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// a trigger is pending already
+	}
+	return nil
+}
+
+// Status reports the jobs ordered by name
+func (r *Scheduler) Status() []JobStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	list := []JobStatus{}
+	for _, j := range r.jobs {
+		history := make([]JobRun, len(j.history))
+		for i, run := range j.history {
+			history[len(history)-1-i] = run
+		}
+		list = append(list, JobStatus{
+			Name:    j.name,
+			Overlap: j.opts.Overlap,
+			Running: j.running,
+			Next:    j.next,
+			Runs:    j.runs,
+			Failed:  j.failed,
+			Skipped: j.skipped,
+			History: history,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Stop cancels all jobs and waits for their runs to return
+func (r *Scheduler) Stop() {
+	r.Lock()
+	r.cancel()
+	r.jobs = make(map[string]*scheduledJob)
+	r.Unlock()
+
+	r.wg.Wait()
+}
+
+// loop waits for the runs of the job until it is removed
+func (j *scheduledJob) loop() {
+	clock := j.s.clock
+	for {
+		now := clock.Now()
+		next := j.when.Next(now)
+		if next.IsZero() {
+			j.setNext(next)
+			return
+		}
+		if j.opts.Jitter > 0 {
+			j.s.Lock()
+			next = next.Add(time.Duration(j.s.rand.Int63n(int64(j.opts.Jitter))))
+			j.s.Unlock()
+		}
+		j.setNext(next)
+
+		select {
+		case <-j.ctx.Done():
+			return
+		case <-j.trigger:
+		case <-clock.After(next.Sub(now)):
+		}
+		j.due()
+	}
+}
+
+func (j *scheduledJob) setNext(t time.Time) {
+	j.s.Lock()
+	j.next = t
+	j.s.Unlock()
+}
+
+// due starts a run as the overlap policy allows
+func (j *scheduledJob) due() {
+	j.s.Lock()
+	defer j.s.Unlock()
+
+	if j.ctx.Err() != nil {
+		return
+	}
+	if j.running > 0 {
+		switch j.opts.Overlap {
+		case OverlapSkip:
+			j.skipped++
+			return
+		case OverlapQueue:
+			if j.queued {
+				j.skipped++
+			}
+			j.queued = true
+			return
+		}
+	}
+	j.running++
+	j.s.wg.Add(1)
+	go j.run()
+}
+
+// run calls the job, then the run queued meanwhile if any
+func (j *scheduledJob) run() {
+	defer j.s.wg.Done()
+	for {
+		start := j.s.clock.Now()
+		err := j.call()
+		run := JobRun{Start: start, Duration: j.s.clock.Now().Sub(start)}
+		if err != nil {
+			run.Error = err.Error()
+			logger.Errorf("job %v: %v", j.name, err)
+		}
+
+		j.s.Lock()
+		j.runs++
+		if err != nil {
+			j.failed++
+		}
+		j.history = append(j.history, run)
+		if len(j.history) > jobHistory {
+			j.history = j.history[1:]
+		}
+		again := j.queued && j.ctx.Err() == nil
+		j.queued = false
+		if !again {
+			j.running--
+		}
+		j.s.Unlock()
+		if !again {
+			return
+		}
+	}
+}
+
+// call runs the function of the job, recovering from panics
+func (j *scheduledJob) call() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logger.Errorf("job %v panic: %v\n%s", j.name, v, debug.Stack())
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return j.fn(j.ctx)
+}
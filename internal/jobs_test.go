@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock moves only when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var left []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			left = append(left, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = left
+}
+
+// wait blocks until n waiters are registered
+func (c *fakeClock) wait(t *testing.T, n int) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		c.mu.Lock()
+		got := len(c.waiters)
+		c.mu.Unlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v waiters, got %v", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitJob waits for cond on the status of the job name
+func waitJob(t *testing.T, s *Scheduler, name string, cond func(JobStatus) bool) JobStatus {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		for _, st := range s.Status() {
+			if st.Name == name && cond(st) {
+				return st
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status: %+v", s.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerRuns(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	defer s.Stop()
+
+	start := clock.Now()
+	calls := 0
+	err := s.Add("tick", Interval(time.Minute), func(ctx context.Context) error {
+		calls++
+		if calls == 2 {
+			return errors.New("failed")
+		}
+		if calls == 3 {
+			panic("boom")
+		}
+		return nil
+	}, JobOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("tick", Interval(time.Minute), func(ctx context.Context) error { return nil }, JobOptions{}); err != ErrJobExists {
+		t.Errorf("expected %v, got %v", ErrJobExists, err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		clock.wait(t, 1)
+		clock.Advance(time.Minute)
+		waitJob(t, s, "tick", func(st JobStatus) bool { return st.Runs == int64(i) && st.Running == 0 })
+	}
+	st := waitJob(t, s, "tick", func(st JobStatus) bool { return !st.Next.IsZero() && st.Next.After(start.Add(3*time.Minute)) })
+	if st.Failed != 2 || len(st.History) != 3 || st.History[0].Error != "panic: boom" || st.History[1].Error != "failed" || st.History[2].Error != "" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	if !st.History[2].Start.Equal(start.Add(time.Minute)) || !st.Next.Equal(start.Add(4*time.Minute)) {
+		t.Errorf("unexpected times: %+v", st)
+	}
+
+	if err := s.Remove("tick"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("tick"); err != ErrNoJob {
+		t.Errorf("expected %v, got %v", ErrNoJob, err)
+	}
+	if err := s.Add("bad", Interval(time.Minute), func(ctx context.Context) error { return nil }, JobOptions{Overlap: "never"}); err == nil {
+		t.Error("unknown overlap policy accepted")
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	cases := []struct {
+		overlap string
+		// running, runs and skipped of four triggers while the first run blocks
+		running       int
+		runs, skipped int64
+	}{
+		{OverlapSkip, 1, 1, 3},
+		{OverlapQueue, 1, 2, 2},
+		{OverlapAllow, 4, 4, 0},
+	}
+	for _, c := range cases {
+		clock := newFakeClock()
+		s := NewScheduler(clock)
+		release := make(chan struct{})
+		s.Add("slow", Interval(time.Hour), func(ctx context.Context) error {
+			<-release
+			return nil
+		}, JobOptions{Overlap: c.overlap})
+
+		// each trigger is handled once the job waits again
+		clock.wait(t, 1)
+		for i := 0; i < 4; i++ {
+			s.RunNow("slow")
+			clock.wait(t, i+2)
+		}
+		if st := s.Status()[0]; st.Running != c.running || st.Skipped != c.skipped {
+			t.Errorf("%v: unexpected status: %+v", c.overlap, st)
+		}
+		close(release)
+		st := waitJob(t, s, "slow", func(st JobStatus) bool { return st.Running == 0 })
+		if st.Runs != c.runs || st.Skipped != c.skipped {
+			t.Errorf("%v: unexpected status: %+v", c.overlap, st)
+		}
+		s.Stop()
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+
+	started := make(chan struct{})
+	s.Add("wait", Interval(time.Hour), func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, JobOptions{})
+	s.RunNow("wait")
+	<-started
+	s.Remove("wait")
+
+	// the removed job no longer shows, its run is cancelled
+	if st := s.Status(); len(st) != 0 {
+		t.Errorf("unexpected status: %+v", st)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stop did not wait for the cancelled run")
+	}
+	if err := s.Add("late", Interval(time.Hour), func(ctx context.Context) error { return nil }, JobOptions{}); err == nil {
+		t.Error("job added to a stopped scheduler")
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	clock := newFakeClock()
+	s := NewScheduler(clock)
+	defer s.Stop()
+
+	cron, err := ParseCronIn("0 * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add("hourly", cron, func(ctx context.Context) error { return nil }, JobOptions{Jitter: 10 * time.Minute})
+	hour := clock.Now().Add(time.Hour)
+	st := waitJob(t, s, "hourly", func(st JobStatus) bool { return !st.Next.IsZero() })
+	if st.Next.Before(hour) || !st.Next.Before(hour.Add(10*time.Minute)) {
+		t.Errorf("next run %v not within jitter of %v", st.Next, hour)
+	}
+}
+
+func TestJobStop(t *testing.T) {
+	j, err := Every(1).Hours().NotImmediately().Run(func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Stop()
+	j.Stop()
+
+	ran := make(chan bool, 1)
+	j = Every(1).Seconds()
+	j.Stop()
+	if _, err := j.Run(func() { ran <- true }); err != nil {
+		t.Fatal(err)
+	}
+	j.SkipWait <- true
+	select {
+	case <-ran:
+		t.Fatal("job stopped before Run was started")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	j = Every(1).Hours().NotImmediately()
+	done := make(chan bool)
+	go func() {
+		j.Stop()
+		close(done)
+	}()
+	if _, err := j.Run(func() {}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	j.Stop()
+}
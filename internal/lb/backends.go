@@ -1,14 +1,81 @@
 package lb
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// balancing policies
+const (
+	RoundRobin         = "round-robin"
+	LeastConnections   = "least-conn"
+	WeightedRoundRobin = "weighted"
+	ConsistentHash     = "hash"
+)
+
+// ringReplicas is the number of points of a backend of weight 1 on the
+// consistent hash ring
+const ringReplicas = 64
+
+// defaults of the health tracking
+const (
+	DefaultMaxFails      = 3
+	DefaultProbeInterval = 5 * time.Second
+	DefaultDialTimeout   = 5 * time.Second
+)
+
+// ErrNoBackend is returned when no backend is up
+var ErrNoBackend = errors.New("no backend available")
+
+// BackendState reports the health of a backend
+type BackendState struct {
+	Address   string    `json:"address"`
+	Weight    int       `json:"weight"`
+	Up        bool      `json:"up"`
+	Active    int       `json:"active"`
+	Draining  bool      `json:"draining,omitempty"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+type backend struct {
+	BackendState
+	probing bool
+	// current weight of the smooth weighted round robin
+	current int
+}
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
 type Backends struct {
 	Length    int
 	current   int
 	Addresses []string
 
+	// Policy picks the backend of a connection, round robin by default
+	Policy string
+
+	// MaxFails consecutive dial failures mark a backend down, it is then
+	// probed every ProbeInterval until it accepts connections again
+	MaxFails      int
+	ProbeInterval time.Duration
+	DialTimeout   time.Duration
+
+	state map[string]*backend
+	ring  []ringPoint
+	done  chan struct{}
+
 	sync.Mutex
 }
 
@@ -18,15 +85,109 @@ func NewBackends() *Backends {
 	length := 0
 
 	return &Backends{
-		Length:    length,
-		current:   current,
-		Addresses: addresses,
+		Length:        length,
+		current:       current,
+		Addresses:     addresses,
+		Policy:        RoundRobin,
+		MaxFails:      DefaultMaxFails,
+		ProbeInterval: DefaultProbeInterval,
+		DialTimeout:   DefaultDialTimeout,
+		state:         make(map[string]*backend),
+		done:          make(chan struct{}),
 	}
 }
 
+// SetPolicy selects the balancing policy by name
+func (self *Backends) SetPolicy(name string) error {
+	switch name {
+	case "":
+		name = RoundRobin
+	case RoundRobin, LeastConnections, WeightedRoundRobin, ConsistentHash:
+	default:
+		return fmt.Errorf("unknown balancing policy: %q", name)
+	}
+	self.Lock()
+	self.Policy = name
+	self.Unlock()
+	return nil
+}
+
+// NextAddress returns the next backend that is up, empty if there is none
 func (self *Backends) NextAddress() (addess string) {
 	self.Lock()
+	defer self.Unlock()
+
+	return self.pick("", nil)
+}
 
+// pick selects a backend that is up and not tried for client
+func (self *Backends) pick(client string, tried map[string]bool) string {
+	ok := func(addr string) bool {
+		b := self.state[addr]
+		return b.Up && !b.Draining && !tried[addr]
+	}
+
+	switch self.Policy {
+	case LeastConnections:
+		best := ""
+		for i := 0; i < self.Length; i++ {
+			addr := self.next()
+			if !ok(addr) {
+				continue
+			}
+			// ties go round robin
+			if best == "" || self.state[addr].Active < self.state[best].Active {
+				best = addr
+			}
+		}
+		return best
+	case WeightedRoundRobin:
+		var best *backend
+		total := 0
+		for _, addr := range self.Addresses {
+			if !ok(addr) {
+				continue
+			}
+			b := self.state[addr]
+			b.current += b.Weight
+			total += b.Weight
+			if best == nil || b.current > best.current {
+				best = b
+			}
+		}
+		if best == nil {
+			return ""
+		}
+		best.current -= total
+		return best.Address
+	case ConsistentHash:
+		if len(self.ring) == 0 {
+			return ""
+		}
+		h := hashOf(client)
+		i := sort.Search(len(self.ring), func(i int) bool { return self.ring[i].hash >= h })
+		for n := 0; n < len(self.ring); n++ {
+			p := self.ring[(i+n)%len(self.ring)]
+			if ok(p.addr) {
+				return p.addr
+			}
+		}
+		return ""
+	}
+
+	for i := 0; i < self.Length; i++ {
+		if addr := self.next(); ok(addr) {
+			return addr
+		}
+	}
+	return ""
+}
+
+// next advances the round robin
+func (self *Backends) next() string {
+	if self.current > self.Length-1 {
+		self.current = 0
+	}
 	index := self.current
 
 	self.current = self.current + 1
@@ -34,17 +195,203 @@ func (self *Backends) NextAddress() (addess string) {
 		self.current = 0
 	}
 
-	self.Unlock()
 	return self.Addresses[index]
 }
 
+// Add adds backends, each address may carry a weight as in host:port=3
 func (self *Backends) Add(addresses ...string) {
 	self.Lock()
 
+	now := time.Now()
 	for _, item := range addresses {
-		self.Addresses = append(self.Addresses, item)
+		item, weight := parseWeight(item)
+		if self.state[item] == nil {
+			self.Addresses = append(self.Addresses, item)
+			self.state[item] = &backend{BackendState: BackendState{Address: item, Up: true, Since: now}}
+		}
+		self.state[item].Weight = weight
 	}
 	self.Length = len(self.Addresses)
+	self.buildRing()
+
+	self.Unlock()
+}
+
+func parseWeight(s string) (string, int) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return s, 1
+	}
+	w, err := strconv.Atoi(s[i+1:])
+	if err != nil || w < 1 {
+		return s[:i], 1
+	}
+	return s[:i], w
+}
+
+// buildRing places the backends on the consistent hash ring
+func (self *Backends) buildRing() {
+	self.ring = self.ring[:0]
+	for _, addr := range self.Addresses {
+		n := ringReplicas * self.state[addr].Weight
+		for i := 0; i < n; i++ {
+			self.ring = append(self.ring, ringPoint{hash: hashOf(addr + "#" + strconv.Itoa(i)), addr: addr})
+		}
+	}
+	sort.Slice(self.ring, func(i, j int) bool { return self.ring[i].hash < self.ring[j].hash })
+}
 
+func hashOf(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Dial connects to a backend that is up for client, the IP address
+// consistent hashing is keyed on, trying the others in turn before
+// giving up
+func (self *Backends) Dial(client string) (net.Conn, string, error) {
+	self.Lock()
+	attempts := self.Length
 	self.Unlock()
+
+	tried := make(map[string]bool)
+	err := ErrNoBackend
+	for i := 0; i < attempts; i++ {
+		self.Lock()
+		addr := self.pick(client, tried)
+		self.Unlock()
+		if addr == "" {
+			break
+		}
+		tried[addr] = true
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, self.DialTimeout)
+		if err == nil {
+			self.Succeeded(addr)
+			return conn, addr, nil
+		}
+		self.Failed(addr, err)
+	}
+	return nil, "", err
+}
+
+// Connected counts an active connection to addr
+func (self *Backends) Connected(addr string) {
+	self.Lock()
+	defer self.Unlock()
+
+	if b := self.state[addr]; b != nil {
+		b.Active++
+	}
+}
+
+// Disconnected counts the end of a connection to addr
+func (self *Backends) Disconnected(addr string) {
+	self.Lock()
+	defer self.Unlock()
+
+	b := self.state[addr]
+	if b == nil || b.Active == 0 {
+		return
+	}
+	b.Active--
+	if b.Draining && b.Active == 0 {
+		self.remove(addr)
+	}
+}
+
+// Succeeded resets the failures of addr
+func (self *Backends) Succeeded(addr string) {
+	self.Lock()
+	defer self.Unlock()
+
+	b := self.state[addr]
+	if b == nil {
+		return
+	}
+	b.Failures = 0
+	b.LastError = ""
+	if !b.Up {
+		b.Up = true
+		b.Since = time.Now()
+	}
+}
+
+// Failed counts a dial failure of addr, marking it down after MaxFails
+func (self *Backends) Failed(addr string, err error) {
+	self.Lock()
+	defer self.Unlock()
+
+	b := self.state[addr]
+	if b == nil {
+		return
+	}
+	b.Failures++
+	b.LastError = err.Error()
+	if b.Up && b.Failures >= self.MaxFails {
+		b.Up = false
+		b.Since = time.Now()
+		fmt.Printf("Backend %v is down: %v\n", addr, err)
+	}
+	if !b.Up && !b.probing {
+		b.probing = true
+		go self.probe(addr)
+	}
+}
+
+// probe dials addr until it is back up
+func (self *Backends) probe(addr string) {
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-time.After(self.ProbeInterval):
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, self.DialTimeout)
+		self.Lock()
+		b := self.state[addr]
+		if b == nil {
+			self.Unlock()
+			return
+		}
+		if err == nil {
+			conn.Close()
+			b.probing = false
+			b.Up = true
+			b.Failures = 0
+			b.LastError = ""
+			b.Since = time.Now()
+			self.Unlock()
+			fmt.Printf("Backend %v is up\n", addr)
+			return
+		}
+		b.LastError = err.Error()
+		self.Unlock()
+	}
+}
+
+// State returns the health of the backends in order
+func (self *Backends) State() []BackendState {
+	self.Lock()
+	defer self.Unlock()
+
+	list := make([]BackendState, 0, self.Length)
+	for _, addr := range self.Addresses {
+		list = append(list, self.state[addr].BackendState)
+	}
+	return list
+}
+
+// Close stops probing the backends
+func (self *Backends) Close() {
+	self.Lock()
+	defer self.Unlock()
+
+	select {
+	case <-self.done:
+	default:
+		close(self.done)
+	}
 }
@@ -0,0 +1,164 @@
+package lb
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// deadAddress returns an address nothing listens on
+func deadAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestBackendsEmpty(t *testing.T) {
+	be := NewBackends()
+	if addr := be.NextAddress(); addr != "" {
+		t.Errorf("expected no address, got %q", addr)
+	}
+	if _, _, err := be.Dial(""); err != ErrNoBackend {
+		t.Errorf("expected %v, got %v", ErrNoBackend, err)
+	}
+}
+
+func TestBackendsHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	dead := deadAddress(t)
+	be := NewBackends()
+	be.MaxFails = 2
+	be.ProbeInterval = 50 * time.Millisecond
+	defer be.Close()
+	be.Add(dead, l.Addr().String())
+
+	// the dead backend is skipped after failing
+	for i := 0; i < 4; i++ {
+		conn, addr, err := be.Dial("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if addr != l.Addr().String() {
+			t.Errorf("expected %v, got %v", l.Addr(), addr)
+		}
+	}
+	state := be.State()
+	if state[0].Up || state[0].Failures != 2 || state[0].LastError == "" || !state[1].Up {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	// it comes back once it accepts connections
+	revived, err := net.Listen("tcp", dead)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer revived.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !be.State()[0].Up {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend not back up: %+v", be.State()[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// nothing is up
+	l.Close()
+	revived.Close()
+	for i := 0; i < 4; i++ {
+		be.Dial("")
+	}
+	if _, _, err := be.Dial(""); err != ErrNoBackend {
+		t.Errorf("expected %v, got %v", ErrNoBackend, err)
+	}
+}
+
+func TestBackendsPolicy(t *testing.T) {
+	addrs := []string{"10.0.0.1:80", "10.0.0.2:80=3", "10.0.0.3:80"}
+	pick := func(policy, client string, n int) map[string]int {
+		be := NewBackends()
+		if err := be.SetPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+		be.Add(addrs...)
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			be.Lock()
+			addr := be.pick(client, nil)
+			be.Unlock()
+			counts[addr]++
+			if policy == LeastConnections {
+				be.Connected(addr)
+			}
+		}
+		return counts
+	}
+
+	if c := pick(RoundRobin, "", 9); c["10.0.0.1:80"] != 3 || c["10.0.0.2:80"] != 3 || c["10.0.0.3:80"] != 3 {
+		t.Errorf("round robin: %v", c)
+	}
+	if c := pick(WeightedRoundRobin, "", 10); c["10.0.0.1:80"] != 2 || c["10.0.0.2:80"] != 6 || c["10.0.0.3:80"] != 2 {
+		t.Errorf("weighted: %v", c)
+	}
+	if c := pick(LeastConnections, "", 6); c["10.0.0.1:80"] != 2 || c["10.0.0.2:80"] != 2 || c["10.0.0.3:80"] != 2 {
+		t.Errorf("least connections: %v", c)
+	}
+	for _, client := range []string{"192.168.1.2", "192.168.1.3", "::1"} {
+		if c := pick(ConsistentHash, client, 5); len(c) != 1 {
+			t.Errorf("hash of %v: %v", client, c)
+		}
+	}
+	if err := NewBackends().SetPolicy("random"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestBackendsHashStable(t *testing.T) {
+	be := NewBackends()
+	be.SetPolicy(ConsistentHash)
+	be.Add("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80")
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		client := "192.168.0." + strconv.Itoa(i)
+		be.Lock()
+		before[client] = be.pick(client, nil)
+		be.Unlock()
+	}
+
+	// only clients of the added backend move
+	be.Add("10.0.0.4:80")
+	moved := 0
+	for client, addr := range before {
+		be.Lock()
+		now := be.pick(client, nil)
+		be.Unlock()
+		if now != addr {
+			if now != "10.0.0.4:80" {
+				t.Errorf("%v moved from %v to %v", client, addr, now)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 50 {
+		t.Errorf("%v of 100 clients moved", moved)
+	}
+}
@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// NewControl serves the control API of backends:
+//
+//	GET  /backends                 policy and state of the backends
+//	PUT  /backends                 replace the backends with a JSON list
+//	POST /backends/add?addr=       add backends, host:port=weight
+//	POST /backends/remove?addr=    remove backends at once
+//	POST /backends/drain?addr=     remove backends once their connections end
+func NewControl(backends *Backends) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "PUT":
+			var list []string
+			if err := json.NewDecoder(req.Body).Decode(&list); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			backends.Replace(list...)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		backends.Lock()
+		policy := backends.Policy
+		backends.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"policy":   policy,
+			"backends": backends.State(),
+		})
+	})
+
+	op := func(f func(...string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "POST" {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			addrs := req.URL.Query()["addr"]
+			if len(addrs) == 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "addr missing"})
+				return
+			}
+			f(addrs...)
+			writeJSON(w, http.StatusOK, backends.State())
+		}
+	}
+	mux.HandleFunc("/backends/add", op(backends.Add))
+	mux.HandleFunc("/backends/remove", op(backends.Remove))
+	mux.HandleFunc("/backends/drain", op(backends.Drain))
+
+	return mux
+}
+
+// CheckControlAddr refuses control API addresses other than loopback: the
+// API is not authenticated and redirects all balanced traffic
+func CheckControlAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("control API must listen on loopback, not %q", addr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,13 +2,11 @@ package lb
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"strconv"
-	"time"
 )
 
-func startServer(listenPort int, backends *Backends) {
+func startServer(listenPort int, backends *Backends, o *Options) {
 	port := strconv.Itoa(listenPort)
 	fmt.Println("Starting server on port ", port)
 
@@ -27,37 +25,52 @@ func startServer(listenPort int, backends *Backends) {
 		fmt.Println("Listener closed")
 	}()
 
+	serve(listener, backends, o)
+}
+
+func serve(listener net.Listener, backends *Backends, o *Options) {
+	if o.AcceptProxy {
+		listener = NewProxyListener(listener, o.TrustedProxies...)
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error occurred accepting a connection", err.Error())
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				fmt.Println("Error occurred accepting a connection", err.Error())
+				continue
+			}
+			return
 		}
 
-		conn.SetDeadline(time.Now().Add(time.Second * 60))
-
-		addr := backends.NextAddress()
-		if addr == "" {
-			conn.Close()
-			continue
-		}
-		go handleConnection(conn, addr)
+		go handleConnection(conn, backends, o)
 	}
 }
 
-func handleConnection(cliConn net.Conn, srvAddr string) {
-	srvConn, err := net.Dial("tcp", srvAddr)
+func handleConnection(cliConn net.Conn, backends *Backends, o *Options) {
+	client, _, _ := net.SplitHostPort(cliConn.RemoteAddr().String())
+	srvConn, srvAddr, err := backends.Dial(client)
 	if err != nil {
-		fmt.Printf("Could not connect to server (%q), connection dropping\n", srvAddr)
+		fmt.Printf("Could not connect to a server (%v), connection dropping\n", err)
+		cliConn.Close()
 		return
 	}
+	backends.Connected(srvAddr)
+	defer backends.Disconnected(srvAddr)
 
-	// close the connections when done
-	defer func() {
-		srvConn.Close()
-		cliConn.Close()
-	}()
+	if o.SendProxy != 0 {
+		var tlvs []TLV
+		if c, ok := cliConn.(*ProxyConn); ok {
+			if h, _ := c.Header(); h != nil && h.PeerID() != "" {
+				tlvs = append(tlvs, TLV{Type: TLVPeerID, Value: []byte(h.PeerID())})
+			}
+		}
+		if err := WriteProxyHeader(srvConn, o.SendProxy, cliConn.RemoteAddr(), cliConn.LocalAddr(), tlvs...); err != nil {
+			fmt.Printf("Could not send PROXY header to %v: %v\n", srvAddr, err)
+			srvConn.Close()
+			cliConn.Close()
+			return
+		}
+	}
 
-	go io.Copy(cliConn, srvConn)
-	io.Copy(srvConn, cliConn)
+	pipe(cliConn, srvConn, o.IdleTimeout, o.MaxLifetime)
 }
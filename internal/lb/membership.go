@@ -0,0 +1,103 @@
+package lb
+
+import (
+	"time"
+)
+
+// PeerSource lists the forwards of healthy peers, as Neighborhood does
+type PeerSource interface {
+	GetPeers() []string
+}
+
+// Remove drops backends at once, connections to them are left open
+func (self *Backends) Remove(addresses ...string) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, addr := range addresses {
+		self.remove(addr)
+	}
+}
+
+// remove drops addr keeping the round robin position of the others
+func (self *Backends) remove(addr string) {
+	if self.state[addr] == nil {
+		return
+	}
+	delete(self.state, addr)
+	for i, a := range self.Addresses {
+		if a != addr {
+			continue
+		}
+		self.Addresses = append(self.Addresses[:i], self.Addresses[i+1:]...)
+		if i < self.current {
+			self.current--
+		}
+		break
+	}
+	self.Length = len(self.Addresses)
+	if self.current > self.Length-1 {
+		self.current = 0
+	}
+	self.buildRing()
+}
+
+// Drain stops new connections to backends, they are removed once their
+// connections are closed
+func (self *Backends) Drain(addresses ...string) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, addr := range addresses {
+		b := self.state[addr]
+		if b == nil {
+			continue
+		}
+		b.Draining = true
+		if b.Active == 0 {
+			self.remove(addr)
+		}
+	}
+}
+
+// Replace makes addresses the backends, adding the new ones and draining
+// the ones not listed
+func (self *Backends) Replace(addresses ...string) {
+	keep := make(map[string]bool, len(addresses))
+	for _, item := range addresses {
+		addr, _ := parseWeight(item)
+		keep[addr] = true
+	}
+
+	self.Lock()
+	var gone []string
+	for _, addr := range self.Addresses {
+		if !keep[addr] {
+			gone = append(gone, addr)
+		}
+	}
+	for addr := range keep {
+		// listed again while draining
+		if b := self.state[addr]; b != nil {
+			b.Draining = false
+		}
+	}
+	self.Unlock()
+
+	self.Add(addresses...)
+	self.Drain(gone...)
+}
+
+// Follow replaces the backends with the peers of src every interval until
+// the backends are closed
+func (self *Backends) Follow(src PeerSource, interval time.Duration) {
+	for {
+		self.Replace(src.GetPeers()...)
+
+		select {
+		case <-self.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
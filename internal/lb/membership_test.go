@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func addresses(be *Backends) string {
+	var list []string
+	for _, s := range be.State() {
+		list = append(list, s.Address)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestBackendsRemove(t *testing.T) {
+	be := NewBackends()
+	be.Add("a:1", "b:1", "c:1")
+	if addr := be.NextAddress(); addr != "a:1" {
+		t.Fatalf("expected a:1, got %v", addr)
+	}
+
+	// the round robin goes on with the next one
+	be.Remove("a:1")
+	if addr := be.NextAddress(); addr != "b:1" {
+		t.Errorf("expected b:1, got %v", addr)
+	}
+	be.Remove("c:1", "x:1")
+	if addr := be.NextAddress(); addr != "b:1" {
+		t.Errorf("expected b:1, got %v", addr)
+	}
+	be.Remove("b:1")
+	if addr := be.NextAddress(); addr != "" {
+		t.Errorf("expected no address, got %v", addr)
+	}
+}
+
+func TestBackendsDrain(t *testing.T) {
+	be := NewBackends()
+	be.Add("a:1", "b:1")
+	be.Connected("a:1")
+	be.Drain("a:1", "b:1")
+
+	if got := addresses(be); got != "a:1" {
+		t.Fatalf("expected a:1 draining, got %v", got)
+	}
+	if addr := be.NextAddress(); addr != "" {
+		t.Errorf("expected no address while draining, got %v", addr)
+	}
+	be.Disconnected("a:1")
+	if got := addresses(be); got != "" {
+		t.Errorf("expected no backends, got %v", got)
+	}
+}
+
+func TestBackendsReplace(t *testing.T) {
+	be := NewBackends()
+	be.Add("a:1", "b:1")
+	be.Connected("b:1")
+	be.Replace("b:1=2", "c:1")
+	if got := addresses(be); got != "b:1 c:1" {
+		t.Errorf("expected b:1 c:1, got %v", got)
+	}
+	if s := be.State(); s[0].Weight != 2 || s[0].Active != 1 || s[0].Draining {
+		t.Errorf("unexpected state: %+v", s[0])
+	}
+
+	// a draining backend listed again stays
+	be.Replace("c:1")
+	be.Replace("b:1", "c:1")
+	be.Disconnected("b:1")
+	if got := addresses(be); got != "b:1 c:1" {
+		t.Errorf("expected b:1 c:1, got %v", got)
+	}
+}
+
+type testPeers struct {
+	sync.Mutex
+	list []string
+}
+
+func (p *testPeers) GetPeers() []string {
+	p.Lock()
+	defer p.Unlock()
+	return p.list
+}
+
+func TestBackendsFollow(t *testing.T) {
+	peers := &testPeers{list: []string{"127.0.0.1:4001"}}
+	be := NewBackends()
+	go be.Follow(peers, 10*time.Millisecond)
+	defer be.Close()
+
+	wait := func(expected string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for addresses(be) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %v, got %v", expected, addresses(be))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	wait("127.0.0.1:4001")
+	peers.Lock()
+	peers.list = []string{"127.0.0.1:4002", "127.0.0.1:4003"}
+	peers.Unlock()
+	wait("127.0.0.1:4002 127.0.0.1:4003")
+}
+
+func TestControl(t *testing.T) {
+	be := NewBackends()
+	h := NewControl(be)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("POST", "/backends/add?addr=a:1&addr=b:1=3", ""); w.Code != http.StatusOK {
+		t.Fatalf("add: %v %v", w.Code, w.Body)
+	}
+	do("POST", "/backends/remove?addr=a:1", "")
+	if w := do("GET", "/backends", ""); !strings.Contains(w.Body.String(), `"address":"b:1","weight":3`) || strings.Contains(w.Body.String(), "a:1") {
+		t.Errorf("unexpected backends: %v", w.Body)
+	}
+	do("PUT", "/backends", `["c:1", "d:1"]`)
+	if got := addresses(be); got != "c:1 d:1" {
+		t.Errorf("expected c:1 d:1, got %v", got)
+	}
+	if w := do("POST", "/backends/drain", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %v, got %v", http.StatusBadRequest, w.Code)
+	}
+	if w := do("PUT", "/backends", `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %v, got %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestControlAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:9000": true,
+		"[::1]:9000":     true,
+		"localhost:9000": true,
+		":9000":          false,
+		"0.0.0.0:9000":   false,
+		"10.0.0.1:9000":  false,
+		"9000":           false,
+	} {
+		if err := CheckControlAddr(addr); (err == nil) != ok {
+			t.Errorf("%v: %v", addr, err)
+		}
+	}
+	if err := Run(&Options{Control: ":9000"}); err == nil {
+		t.Error("control API on all addresses accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package lb
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdleTimeout closes connections without traffic in either direction
+const DefaultIdleTimeout = 5 * time.Minute
+
+// closeWriter is implemented by connections that can be half-closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies between client and server until both sides are done, no
+// traffic is seen for idle or maxLifetime passes; zero disables either.
+// The end of one direction is passed on as a half-close.
+func pipe(client, server net.Conn, idle, maxLifetime time.Duration) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			server.Close()
+		})
+	}
+	defer closeBoth()
+
+	var activity int64
+	touch := func() {
+		atomic.StoreInt64(&activity, time.Now().UnixNano())
+	}
+	touch()
+
+	done := make(chan struct{})
+	defer close(done)
+	if idle > 0 {
+		go func() {
+			t := time.NewTimer(idle)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+				}
+				left := idle - time.Since(time.Unix(0, atomic.LoadInt64(&activity)))
+				if left <= 0 {
+					closeBoth()
+					return
+				}
+				t.Reset(left)
+			}
+		}()
+	}
+	if maxLifetime > 0 {
+		t := time.AfterFunc(maxLifetime, closeBoth)
+		defer t.Stop()
+	}
+
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, &activityReader{r: src, touch: touch})
+		if err != nil {
+			closeBoth()
+			return
+		}
+		if c, ok := dst.(closeWriter); ok {
+			c.CloseWrite()
+		} else {
+			closeBoth()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(server, client)
+	go copyHalf(client, server)
+	wg.Wait()
+}
+
+// activityReader records the time of each read
+type activityReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
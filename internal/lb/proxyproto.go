@@ -0,0 +1,400 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions
+const (
+	ProxyV1 = 1
+	ProxyV2 = 2
+)
+
+// TLVPeerID is the custom v2 TLV type carrying the ipfs peer ID of the client
+const TLVPeerID = 0xE0
+
+// ProxyHeaderTimeout limits reading the PROXY header of a connection
+var ProxyHeaderTimeout = 5 * time.Second
+
+// ProxyHeaderGrace is how long clients that may send a PROXY header are
+// waited for: proxies send it at once, clients of protocols the server
+// speaks first send nothing
+var ProxyHeaderGrace = 50 * time.Millisecond
+
+var proxyV1Prefix = []byte("PROXY ")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// longest v1 header including CRLF
+const proxyV1MaxLength = 107
+
+// ErrProxyHeader is returned for malformed PROXY headers
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// TLV is a type-length-value extension of a v2 header
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is the connection information sent ahead of the stream
+type ProxyHeader struct {
+	Version int
+	// Src and Dst are nil for connections of unknown origin
+	Src  net.Addr
+	Dst  net.Addr
+	TLVs []TLV
+}
+
+// PeerID returns the peer ID carried in the header, if any
+func (h *ProxyHeader) PeerID() string {
+	for _, t := range h.TLVs {
+		if t.Type == TLVPeerID {
+			return string(t.Value)
+		}
+	}
+	return ""
+}
+
+// WriteProxyHeader sends the header of version for a connection from src
+// to dst; TLVs are only sent with v2
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr, tlvs ...TLV) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	tcp4 := sok && dok && s.IP.To4() != nil && d.IP.To4() != nil
+	tcp6 := sok && dok && !tcp4
+
+	switch version {
+	case ProxyV1:
+		var line string
+		switch {
+		case tcp4:
+			line = fmt.Sprintf("PROXY TCP4 %v %v %v %v\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)
+		case tcp6:
+			line = fmt.Sprintf("PROXY TCP6 %v %v %v %v\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port)
+		default:
+			line = "PROXY UNKNOWN\r\n"
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	case ProxyV2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		// version 2, PROXY command
+		buf.WriteByte(0x21)
+		var addrs []byte
+		switch {
+		case tcp4:
+			buf.WriteByte(0x11)
+			addrs = append(append(addrs, s.IP.To4()...), d.IP.To4()...)
+		case tcp6:
+			buf.WriteByte(0x21)
+			addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+		default:
+			buf.WriteByte(0x00)
+		}
+		if tcp4 || tcp6 {
+			var ports [4]byte
+			binary.BigEndian.PutUint16(ports[0:], uint16(s.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(d.Port))
+			addrs = append(addrs, ports[:]...)
+		}
+		for _, t := range tlvs {
+			addrs = append(addrs, t.Type, byte(len(t.Value)>>8), byte(len(t.Value)))
+			addrs = append(addrs, t.Value...)
+		}
+		if len(addrs) > 0xffff {
+			return ErrProxyHeader
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	return fmt.Errorf("unknown PROXY protocol version: %v", version)
+}
+
+// ReadProxyHeader consumes the PROXY header at the start of r, returning
+// nil if the stream does not start with one
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil
+	}
+	var prefix []byte
+	switch b[0] {
+	case proxyV1Prefix[0]:
+		prefix = proxyV1Prefix
+	case proxyV2Signature[0]:
+		prefix = proxyV2Signature
+	default:
+		return nil, nil
+	}
+	// peek no further than the client sent
+	for n := 2; n <= len(prefix); n++ {
+		b, err := r.Peek(n)
+		if err != nil || b[n-1] != prefix[n-1] {
+			return nil, nil
+		}
+	}
+	if b[0] == proxyV1Prefix[0] {
+		return readProxyV1(r)
+	}
+	return readProxyV2(r)
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, ErrProxyHeader
+	}
+	fields := strings.Fields(strings.TrimSuffix(s, "\r\n"))
+	h := &ProxyHeader{Version: ProxyV1}
+	if len(fields) == 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Src, h.Dst = src, dst
+	return h, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if a == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: ProxyV2}
+	// LOCAL connections are the proxy's own, such as health checks
+	local := fixed[12]&0x0f == 0
+	var n int
+	switch fixed[13] >> 4 {
+	case 1:
+		n = 4
+	case 2:
+		n = 16
+	}
+	if n > 0 {
+		if len(body) < 2*n+4 {
+			return nil, ErrProxyHeader
+		}
+		if !local {
+			h.Src = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+			h.Dst = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+		}
+		body = body[2*n+4:]
+	} else if fixed[13]>>4 != 0 {
+		// unix sockets, the TLVs follow 216 bytes of addresses
+		if len(body) < 216 {
+			return nil, ErrProxyHeader
+		}
+		body = body[216:]
+	}
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, ErrProxyHeader
+		}
+		l := int(binary.BigEndian.Uint16(body[1:]))
+		if len(body) < 3+l {
+			return nil, ErrProxyHeader
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: body[0], Value: body[3 : 3+l]})
+		body = body[3+l:]
+	}
+	return h, nil
+}
+
+// ProxyListener accepts connections preceded by a PROXY header, reporting
+// the client address of the header as their remote address. Only headers
+// of trusted upstream proxies are read; the connections of other clients
+// are passed on as they are so that they cannot claim any address.
+type ProxyListener struct {
+	net.Listener
+	// Trusted lists the networks of the upstream proxies, which must send
+	// a header. If empty, loopback clients are trusted and may connect
+	// without a header.
+	Trusted []*net.IPNet
+}
+
+// NewProxyListener wraps l to read PROXY headers of the trusted networks
+func NewProxyListener(l net.Listener, trusted ...*net.IPNet) *ProxyListener {
+	return &ProxyListener{Listener: l, Trusted: trusted}
+}
+
+// ParseTrustedProxies parses CIDRs or single addresses of upstream proxies
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusts reports whether the header of a client at addr is used, and
+// whether it must send one
+func (self *ProxyListener) trusts(addr net.Addr) (trusted, required bool) {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false, false
+	}
+	if len(self.Trusted) == 0 {
+		return a.IP.IsLoopback(), false
+	}
+	for _, n := range self.Trusted {
+		if n.Contains(a.IP) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// Accept waits for the next connection
+func (self *ProxyListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	trusted, required := self.trusts(c.RemoteAddr())
+	return &ProxyConn{
+		Conn:     c,
+		r:        bufio.NewReader(c),
+		trusted:  trusted,
+		required: required,
+	}, nil
+}
+
+// ProxyConn reads the PROXY header on first use
+type ProxyConn struct {
+	net.Conn
+	r *bufio.Reader
+	// trusted clients are upstream proxies, required to send a header
+	// if configured explicitly
+	trusted, required bool
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+// errProxyHeaderMissing fails connections of trusted proxies without header
+var errProxyHeaderMissing = errors.New("missing PROXY protocol header")
+
+// detect reads the header of trusted clients. Those not required to send
+// one are waited for no longer than ProxyHeaderGrace.
+func (c *ProxyConn) detect() {
+	if !c.trusted {
+		return
+	}
+	// a failed peek is left in the reader, clear it for the client
+	defer c.r.Read(nil)
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	if !c.required {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderGrace))
+		if _, err := c.r.Peek(1); err != nil {
+			return
+		}
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	c.header, c.err = ReadProxyHeader(c.r)
+	if c.err == nil && c.header == nil && c.required {
+		c.err = errProxyHeaderMissing
+	}
+}
+
+// Header returns the PROXY header of the connection, nil if it had none
+func (c *ProxyConn) Header() (*ProxyHeader, error) {
+	c.once.Do(c.detect)
+	return c.header, c.err
+}
+
+func (c *ProxyConn) Read(p []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address of the PROXY header, reading it
+// if needed
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Src != nil {
+		return h.Src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination of the PROXY header
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Dst != nil {
+		return h.Dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection
+func (c *ProxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,232 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	cases := []struct {
+		version  int
+		src, dst net.Addr
+		tlvs     []TLV
+	}{
+		{ProxyV1, &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, nil},
+		{ProxyV1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, nil},
+		{ProxyV2, &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, nil},
+		{ProxyV2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			[]TLV{{Type: TLVPeerID, Value: []byte("QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk")}}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := WriteProxyHeader(&buf, c.version, c.src, c.dst, c.tlvs...); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+
+		r := bufio.NewReader(&buf)
+		h, err := ReadProxyHeader(r)
+		if err != nil || h == nil {
+			t.Fatalf("v%v %v: %v %v", c.version, c.src, h, err)
+		}
+		if h.Version != c.version || h.Src.String() != c.src.String() || h.Dst.String() != c.dst.String() {
+			t.Errorf("expected v%v %v %v, got %+v", c.version, c.src, c.dst, h)
+		}
+		if len(c.tlvs) > 0 && h.PeerID() != string(c.tlvs[0].Value) {
+			t.Errorf("expected peer %s, got %q", c.tlvs[0].Value, h.PeerID())
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("expected payload, got %q", rest)
+		}
+	}
+
+	// unknown origin
+	for _, version := range []int{ProxyV1, ProxyV2} {
+		var buf bytes.Buffer
+		WriteProxyHeader(&buf, version, nil, nil)
+		h, err := ReadProxyHeader(bufio.NewReader(&buf))
+		if err != nil || h == nil || h.Src != nil {
+			t.Errorf("v%v unknown: %+v %v", version, h, err)
+		}
+	}
+
+	// no header or a broken one
+	for s, ok := range map[string]bool{
+		"GET / HTTP/1.1\r\n":                         true,
+		"PROXZ":                                      true,
+		"PROXY TCP4 1.2.3.4\r\n":                     false,
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n":     false,
+		"PROXY " + strings.Repeat("x", 200) + "\r\n": false,
+	} {
+		h, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(s)))
+		if h != nil || (err == nil) != ok {
+			t.Errorf("%q: %+v %v", s, h, err)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	timeout := ProxyHeaderTimeout
+	ProxyHeaderTimeout = 200 * time.Millisecond
+	defer func() { ProxyHeaderTimeout = timeout }()
+
+	// the backend reports the client it sees
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	pl := NewProxyListener(backend)
+	go func() {
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				h, _ := c.(*ProxyConn).Header()
+				peer := ""
+				if h != nil {
+					peer = h.PeerID()
+				}
+				c.Write([]byte(c.RemoteAddr().String() + " " + peer))
+			}()
+		}
+	}()
+
+	for _, version := range []int{ProxyV1, ProxyV2} {
+		addr, stop := startLB(t, &Options{IdleTimeout: time.Second, SendProxy: version, AcceptProxy: true}, backend.Addr().String())
+
+		// a client behind another proxy
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4711}
+		WriteProxyHeader(c, ProxyV2, src, c.RemoteAddr(), TLV{Type: TLVPeerID, Value: []byte("QmPeer")})
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, _ := ioutil.ReadAll(c)
+		c.Close()
+		expected := "203.0.113.7:4711"
+		if version == ProxyV2 {
+			expected += " QmPeer"
+		} else {
+			expected += " "
+		}
+		if string(got) != expected {
+			t.Errorf("v%v: expected %q, got %q", version, expected, got)
+		}
+
+		// a direct client
+		c, err = net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, _ = ioutil.ReadAll(c)
+		if expected := c.LocalAddr().String() + " "; string(got) != expected {
+			t.Errorf("v%v: expected %q, got %q", version, expected, got)
+		}
+		c.Close()
+		stop()
+	}
+}
+
+func TestProxyTrusted(t *testing.T) {
+	timeout := ProxyHeaderTimeout
+	ProxyHeaderTimeout = 200 * time.Millisecond
+	defer func() { ProxyHeaderTimeout = timeout }()
+
+	// accept reports the client seen by a listener trusting the networks
+	accept := func(trusted []string, header bool) (string, error) {
+		nets, err := ParseTrustedProxies(trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		pl := NewProxyListener(l, nets...)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if header {
+			src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4711}
+			WriteProxyHeader(c, ProxyV1, src, c.RemoteAddr())
+		}
+		c.Write([]byte("x"))
+
+		s, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.Read(make([]byte, 1)); err != nil {
+			return "", err
+		}
+		return s.RemoteAddr().String(), nil
+	}
+
+	if got, err := accept([]string{"127.0.0.1"}, true); err != nil || got != "203.0.113.7:4711" {
+		t.Errorf("trusted: %v %v", got, err)
+	}
+	if _, err := accept([]string{"127.0.0.0/8"}, false); err == nil {
+		t.Error("trusted proxy without header accepted")
+	}
+	// the header of an untrusted client is ignored
+	if got, err := accept([]string{"10.0.0.0/8"}, true); err != nil || strings.HasPrefix(got, "203.0.113.7") {
+		t.Errorf("untrusted: %v %v", got, err)
+	}
+	if got, err := accept([]string{"10.0.0.0/8"}, false); err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("untrusted without header: %v %v", got, err)
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid network accepted")
+	}
+
+	// servers speaking first learn the client at once unless it is
+	// required to send a header
+	for _, trusted := range [][]string{nil, {"10.0.0.0/8"}} {
+		nets, _ := ParseTrustedProxies(trusted)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := NewProxyListener(l, nets...)
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		addr := s.RemoteAddr().String()
+		if d := time.Since(start); d >= ProxyHeaderTimeout/2 || addr != c.LocalAddr().String() {
+			t.Errorf("%v: client %v after %v", trusted, addr, d)
+		}
+		// the client answers the greeting
+		s.Write([]byte("220 ready\r\n"))
+		c.Write([]byte("x"))
+		b := make([]byte, 1)
+		if _, err := s.Read(b); err != nil || b[0] != 'x' {
+			t.Errorf("%v: read %q %v", trusted, b, err)
+		}
+		c.Close()
+		s.Close()
+		l.Close()
+	}
+}
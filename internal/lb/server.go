@@ -4,6 +4,8 @@ package lb
 import (
 	//"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"runtime"
 	"time"
 )
@@ -34,23 +36,111 @@ import (
 // 	startServer(*port, backends)
 // }
 
-// Start starts load balancer
-func Start(port int, backends []string, debug bool) {
+// Options configures a load balancer
+type Options struct {
+	Port int
+	// Backends are host:port with an optional =weight
+	Backends []string
+	// Policy is one of round-robin, least-conn, weighted or hash
+	Policy string
+	// Peers feeds the backends instead, refreshed every PeerInterval
+	Peers        PeerSource
+	PeerInterval time.Duration
+	// ConnectTimeout limits dialing a backend, IdleTimeout closes
+	// connections without traffic and MaxLifetime any connection if set;
+	// zero timeouts are the defaults, negative ones disable them
+	ConnectTimeout time.Duration
+	IdleTimeout    time.Duration
+	MaxLifetime    time.Duration
+	// SendProxy sends a PROXY header of version 1 or 2 to the backends,
+	// AcceptProxy reads the one of clients behind the upstream proxies in
+	// TrustedProxies, or on loopback if there are none
+	SendProxy      int
+	AcceptProxy    bool
+	TrustedProxies []*net.IPNet
+	// Control is the loopback listen address of the control API if not empty
+	Control string
+	Debug   bool
+}
+
+// Start starts load balancer, policy is one of round-robin, least-conn,
+// weighted or hash
+func Start(port int, backends []string, policy string, debug bool) {
+	err := Run(&Options{
+		Port:     port,
+		Backends: backends,
+		Policy:   policy,
+		Debug:    debug,
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Run starts load balancer with options
+func Run(o *Options) error {
+	switch o.SendProxy {
+	case 0, ProxyV1, ProxyV2:
+	default:
+		return fmt.Errorf("unknown PROXY protocol version: %v", o.SendProxy)
+	}
+
+	if o.Control != "" {
+		if err := CheckControlAddr(o.Control); err != nil {
+			return err
+		}
+	}
+
 	be := NewBackends()
+	if err := be.SetPolicy(o.Policy); err != nil {
+		return err
+	}
+	defer be.Close()
+
+	switch {
+	case o.ConnectTimeout > 0:
+		be.DialTimeout = o.ConnectTimeout
+	case o.ConnectTimeout < 0:
+		be.DialTimeout = 0
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = DefaultIdleTimeout
+	}
 
-	be.Add([]string(backends)...)
+	be.Add(o.Backends...)
+
+	if o.Peers != nil {
+		interval := o.PeerInterval
+		if interval <= 0 {
+			interval = DefaultProbeInterval
+		}
+		go be.Follow(o.Peers, interval)
+	}
+
+	if o.Control != "" {
+		go func() {
+			fmt.Println("Control API on", o.Control)
+			if err := http.ListenAndServe(o.Control, NewControl(be)); err != nil {
+				fmt.Println("Control API stopped:", err)
+			}
+		}()
+	}
 
-	if debug {
-		go debugRoutine()
+	if o.Debug {
+		go debugRoutine(be)
 	}
 
-	startServer(port, be)
+	startServer(o.Port, be, o)
+	return nil
 }
 
-func debugRoutine() {
+func debugRoutine(backends *Backends) {
 	for {
 		<-time.After(2 * time.Second)
 		fmt.Println(time.Now(), "NumGoroutine", runtime.NumGoroutine())
+		for _, s := range backends.State() {
+			fmt.Printf("%v up: %v active: %v failures: %v %v\n", s.Address, s.Up, s.Active, s.Failures, s.LastError)
+		}
 	}
 }
 
@@ -0,0 +1,189 @@
+package lb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEcho serves an echo server that closes after the client half-closes
+func startEcho(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// startLB balances over backends with o
+func startLB(t *testing.T, o *Options, backends ...string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := NewBackends()
+	be.Add(backends...)
+	go serve(l, be, o)
+	return l.Addr().String(), func() {
+		l.Close()
+		be.Close()
+	}
+}
+
+func TestPipeLongTransfer(t *testing.T) {
+	echo, stopEcho := startEcho(t)
+	defer stopEcho()
+	addr, stop := startLB(t, &Options{IdleTimeout: 200 * time.Millisecond}, echo)
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// a transfer lasting several idle timeouts is kept open by its traffic
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	go func() {
+		chunk := len(data) / 16
+		for i := 0; i < len(data); i += chunk {
+			c.Write(data[i : i+chunk])
+			time.Sleep(50 * time.Millisecond)
+		}
+		c.(*net.TCPConn).CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %v bytes echoed, got %v", len(data), len(got))
+	}
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	// the server answers once the client is done sending
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		c.Write(bytes.ToUpper(b))
+	}()
+	addr, stop := startLB(t, &Options{IdleTimeout: time.Second}, l.Addr().String())
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.(*net.TCPConn).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "HELLO" {
+		t.Errorf("expected HELLO, got %q", got)
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	echo, stopEcho := startEcho(t)
+	defer stopEcho()
+	idle := 100 * time.Millisecond
+	addr, stop := startLB(t, &Options{IdleTimeout: idle}, echo)
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if d := time.Since(start); d < idle/2 || d > 2*time.Second {
+		t.Errorf("closed after %v", d)
+	}
+}
+
+func TestPipeMaxLifetime(t *testing.T) {
+	echo, stopEcho := startEcho(t)
+	defer stopEcho()
+	addr, stop := startLB(t, &Options{IdleTimeout: time.Second, MaxLifetime: 300 * time.Millisecond}, echo)
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// busy connections are closed too
+	start := time.Now()
+	buf := make([]byte, 4)
+	for {
+		if _, err := c.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond || d > 3*time.Second {
+		t.Errorf("closed after %v", d)
+	}
+}
+
+func TestNoBackendRefused(t *testing.T) {
+	addr, stop := startLB(t, &Options{})
+	defer stop()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
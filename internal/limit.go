@@ -0,0 +1,735 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/multiformats/go-multihash"
+)
+
+// client classes limits apply to
+const (
+	clientLocal = "local"
+	clientPeer  = "peer"
+)
+
+// Limit restricts the traffic of each client of a class using a route action.
+// Zero values are unlimited.
+type Limit struct {
+	Class  string
+	Action string
+
+	// Rate is the bandwidth in bytes per second
+	Rate int64
+	// Quota is the traffic in bytes per day
+	Quota int64
+	// Requests is the number of requests or tunnels per second
+	Requests float64
+}
+
+func (l *Limit) String() string {
+	return fmt.Sprintf("%v:%v rate=%vB/s quota=%vB/day requests=%v/s", l.Class, l.Action, l.Rate, l.Quota, l.Requests)
+}
+
+// ParseLimit parses a limit of the form class:action,key=value...
+//
+//	peer:exit,rate=1Mbit,quota=2GB,requests=10
+//
+// class is local or peer, action is a route action or * for any.
+// rate takes bit (kbit, Mbit, Gbit) or byte (B, KB, MB, GB) units per second,
+// quota takes byte units per day.
+func ParseLimit(s string) (*Limit, error) {
+	fs := strings.Split(s, ",")
+	scope := strings.SplitN(fs[0], ":", 2)
+	if len(scope) != 2 || scope[1] == "" {
+		return nil, fmt.Errorf("invalid limit %q: expected class:action", s)
+	}
+	l := &Limit{
+		Class:  scope[0],
+		Action: scope[1],
+	}
+	if l.Class != clientLocal && l.Class != clientPeer {
+		return nil, fmt.Errorf("invalid limit %q: unknown client class: %v", s, l.Class)
+	}
+
+	for _, f := range fs[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid limit %q: %q", s, f)
+		}
+		var err error
+		switch v := kv[1]; kv[0] {
+		case "rate":
+			l.Rate, err = parseBytes(strings.TrimSuffix(v, "/s"), true)
+		case "quota":
+			l.Quota, err = parseBytes(strings.TrimSuffix(v, "/day"), false)
+		case "requests":
+			l.Requests, err = strconv.ParseFloat(strings.TrimSuffix(v, "/s"), 64)
+			if err == nil && l.Requests < 0 {
+				err = errors.New("negative value")
+			}
+		default:
+			err = fmt.Errorf("unknown key: %v", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q: %v", s, err)
+		}
+	}
+	return l, nil
+}
+
+var byteUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"gbit", 1000 * 1000 * 1000 / 8},
+	{"mbit", 1000 * 1000 / 8},
+	{"kbit", 1000 / 8},
+	{"bit", 0},
+	{"tb", 1000 * 1000 * 1000 * 1000},
+	{"gb", 1000 * 1000 * 1000},
+	{"mb", 1000 * 1000},
+	{"kb", 1000},
+	{"b", 1},
+}
+
+// parseBytes parses a size with decimal units, bit units are accepted for rates
+func parseBytes(s string, bits bool) (int64, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range byteUnits {
+		if !strings.HasSuffix(ls, u.suffix) {
+			continue
+		}
+		if strings.HasSuffix(u.suffix, "bit") && !bits {
+			return 0, fmt.Errorf("bit unit not allowed: %v", s)
+		}
+		f, err := strconv.ParseFloat(strings.TrimSuffix(ls, u.suffix), 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("invalid size: %v", s)
+		}
+		if u.n == 0 {
+			return int64(f / 8), nil
+		}
+		return int64(f * float64(u.n)), nil
+	}
+	n, err := strconv.ParseInt(ls, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %v", s)
+	}
+	return n, nil
+}
+
+// Client identifies who is using the proxy, by peer ID for traffic arriving
+// over p2p and by IP for local users.
+type Client struct {
+	Class string
+	ID    string
+}
+
+func (c Client) String() string {
+	return c.Class + ":" + c.ID
+}
+
+// LimitError is returned when a client exceeded a limit
+type LimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+var errQuotaExceeded = &LimitError{Reason: "daily bandwidth quota exceeded"}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take removes n tokens if available, otherwise reports how long until they are
+func (b *tokenBucket) take(n float64, now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// reserve removes n tokens, going into debt, and returns the time to wait
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// usage of a client under a limit
+type clientUsage struct {
+	limit    *Limit
+	requests *tokenBucket
+	bytes    *tokenBucket
+	day      string
+	used     int64
+}
+
+// Limiter enforces rate limits and daily quotas per client and route action
+type Limiter struct {
+	limits map[string]*Limit
+	usage  map[string]*clientUsage
+
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	sync.Mutex
+}
+
+// NewLimiter creates a limiter from limit specs, see ParseLimit
+func NewLimiter(specs []string) (*Limiter, error) {
+	r := &Limiter{
+		limits: make(map[string]*Limit),
+		usage:  make(map[string]*clientUsage),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+	for _, s := range specs {
+		l, err := ParseLimit(s)
+		if err != nil {
+			return nil, err
+		}
+		r.limits[l.Class+":"+l.Action] = l
+	}
+	return r, nil
+}
+
+// Lookup returns the limit for the client class and route action or nil
+func (r *Limiter) Lookup(c Client, action string) *Limit {
+	if l, ok := r.limits[c.Class+":"+action]; ok {
+		return l
+	}
+	return r.limits[c.Class+":*"]
+}
+
+// must be called with the lock held
+func (r *Limiter) usageOf(c Client, l *Limit) *clientUsage {
+	key := c.String() + "|" + l.Action
+	u, ok := r.usage[key]
+	if !ok {
+		now := r.now()
+		u = &clientUsage{limit: l}
+		if l.Requests > 0 {
+			burst := 2 * l.Requests
+			if burst < 1 {
+				burst = 1
+			}
+			u.requests = newTokenBucket(l.Requests, burst, now)
+		}
+		if l.Rate > 0 {
+			burst := float64(l.Rate)
+			if burst < 32*1024 {
+				burst = 32 * 1024
+			}
+			u.bytes = newTokenBucket(float64(l.Rate), burst, now)
+		}
+		r.usage[key] = u
+	}
+	// quotas reset at local midnight
+	if day := r.now().Format("2006-01-02"); u.day != day {
+		u.day = day
+		u.used = 0
+	}
+	return u
+}
+
+// Allow admits a request or tunnel of the client, or returns a LimitError
+func (r *Limiter) Allow(c Client, action string) error {
+	l := r.Lookup(c, action)
+	if l == nil {
+		return nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	u := r.usageOf(c, l)
+	if l.Quota > 0 && u.used >= l.Quota {
+		now := r.now()
+		y, m, d := now.Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+		return &LimitError{
+			Reason:     fmt.Sprintf("daily bandwidth quota of %v bytes exceeded", l.Quota),
+			RetryAfter: midnight.Sub(now),
+		}
+	}
+	if u.requests != nil {
+		if ok, wait := u.requests.take(1, r.now()); !ok {
+			return &LimitError{
+				Reason:     fmt.Sprintf("request rate of %v/s exceeded", l.Requests),
+				RetryAfter: wait,
+			}
+		}
+	}
+	return nil
+}
+
+// transfer accounts n bytes and waits as the rate limit requires
+func (r *Limiter) transfer(c Client, l *Limit, n int) error {
+	r.Lock()
+	u := r.usageOf(c, l)
+	u.used += int64(n)
+	exceeded := l.Quota > 0 && u.used > l.Quota
+	var wait time.Duration
+	if u.bytes != nil {
+		wait = u.bytes.reserve(float64(n), r.now())
+	}
+	r.Unlock()
+
+	if wait > 0 {
+		r.sleep(wait)
+	}
+	if exceeded {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chunk caps a single transfer so throttling stays smooth
+func (r *Limiter) chunk(l *Limit, n int) int {
+	if l.Rate > 0 && n > 16*1024 {
+		return 16 * 1024
+	}
+	return n
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	limiter *Limiter
+	client  Client
+	limit   *Limit
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	p = p[:r.limiter.chunk(r.limit, len(p))]
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if lerr := r.limiter.transfer(r.client, r.limit, n); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+// Reader throttles and accounts the traffic of the client read from rc
+func (r *Limiter) Reader(rc io.ReadCloser, c Client, action string) io.ReadCloser {
+	l := r.Lookup(c, action)
+	if l == nil || rc == nil || (l.Rate <= 0 && l.Quota <= 0) {
+		return rc
+	}
+	return &limitedReader{
+		ReadCloser: rc,
+		limiter:    r,
+		client:     c,
+		limit:      l,
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *Limiter
+	client  Client
+	limit   *Limit
+}
+
+func (r *limitedConn) Read(p []byte) (int, error) {
+	p = p[:r.limiter.chunk(r.limit, len(p))]
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		if lerr := r.limiter.transfer(r.client, r.limit, n); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	return n, err
+}
+
+func (r *limitedConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := r.limiter.chunk(r.limit, len(p))
+		if err := r.limiter.transfer(r.client, r.limit, n); err != nil {
+			return written, err
+		}
+		m, err := r.Conn.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Conn throttles and accounts the traffic of the client in both directions of conn
+func (r *Limiter) Conn(conn net.Conn, c Client, action string) net.Conn {
+	l := r.Lookup(c, action)
+	if l == nil || (l.Rate <= 0 && l.Quota <= 0) {
+		return conn
+	}
+	return &limitedConn{
+		Conn:    conn,
+		limiter: r,
+		client:  c,
+		limit:   l,
+	}
+}
+
+// longest preamble sent by ipfs p2p listen --report-peer-id
+const maxPeerPreamble = 128
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// PeerListener accepts connections from local users and from peers. The ipfs
+// daemon reports the remote peer ID in a line preceding each p2p stream;
+// the line is consumed and the ID remembered for the remote address. The
+// line is taken from loopback connections only.
+type PeerListener struct {
+	net.Listener
+
+	// Allow optionally rejects peers, their connections are closed
+	Allow func(id string) bool
+
+	peers map[string]string
+	sync.Mutex
+}
+
+// NewPeerListener wraps l to recognize connections from peers
+func NewPeerListener(l net.Listener) *PeerListener {
+	return &PeerListener{
+		Listener: l,
+		peers:    make(map[string]string),
+	}
+}
+
+// Accept waits for the next connection
+func (r *PeerListener) Accept() (net.Conn, error) {
+	c, err := r.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+		l:    r,
+	}, nil
+}
+
+// PeerOf returns the peer ID of the connection from remoteAddr or empty if local
+func (r *PeerListener) PeerOf(remoteAddr string) string {
+	if r == nil {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.peers[remoteAddr]
+}
+
+// ClientOf identifies the client sending req
+func (r *PeerListener) ClientOf(req *http.Request) Client {
+	if id := r.PeerOf(req.RemoteAddr); id != "" {
+		return Client{Class: clientPeer, ID: id}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return Client{Class: clientLocal, ID: host}
+}
+
+type peerConn struct {
+	net.Conn
+	r      *bufio.Reader
+	l      *PeerListener
+	once   sync.Once
+	peer   bool
+	id     string
+	denied bool
+}
+
+// PeerID returns the peer ID reported for the connection, empty if local
+func (c *peerConn) PeerID() string {
+	c.once.Do(c.detect)
+	return c.id
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	c.once.Do(c.detect)
+	if c.denied {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+// detect consumes the peer ID line if the connection starts with one. Only
+// ipfs on this host reports peers, clients connecting from elsewhere could
+// claim any ID.
+func (c *peerConn) detect() {
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+		return
+	}
+	for n := 1; n <= maxPeerPreamble; n++ {
+		b, err := c.r.Peek(n)
+		if err != nil {
+			return
+		}
+		ch := b[n-1]
+		if ch == '\n' {
+			id := strings.TrimSuffix(string(b[:n-1]), "\r")
+			if _, err := multihash.FromB58String(id); err != nil {
+				return
+			}
+			c.r.Discard(n)
+			if c.l.Allow != nil && !c.l.Allow(id) {
+				logger.Infof("peer %v denied", id)
+				c.denied = true
+				c.Conn.Close()
+				return
+			}
+			c.peer = true
+			c.id = id
+			c.l.Lock()
+			c.l.peers[c.RemoteAddr().String()] = id
+			c.l.Unlock()
+			return
+		}
+		// HTTP requests start with a method followed by a space
+		if strings.IndexByte(base58Alphabet, ch) < 0 {
+			return
+		}
+	}
+}
+
+func (c *peerConn) Close() error {
+	if c.peer {
+		c.l.Lock()
+		delete(c.l.peers, c.RemoteAddr().String())
+		c.l.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// limitResponse is the 429 page for a request over a limit
+func limitResponse(req *http.Request, err *LimitError) *http.Response {
+	body := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>429 Too Many Requests</title></head>
+<body>
+<h1>Too Many Requests</h1>
+<p>%v.</p>
+<p>Please try again later.</p>
+</body>
+</html>
+`, html.EscapeString(err.Reason))
+
+	resp := &http.Response{
+		Status:        "429 Too Many Requests",
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	if err.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", fmt.Sprintf("%v", int64(err.RetryAfter/time.Second)+1))
+	}
+	return resp
+}
+
+type limitState struct {
+	client Client
+	action string
+}
+
+// LimitHandler hooks the limiter into goproxy
+type LimitHandler struct {
+	limiter *Limiter
+	peers   *PeerListener
+	action  func(host string) string
+	dial    func(network, addr string) (net.Conn, error)
+	// peerDial opens the connections of peers, peerTr their requests
+	peerDial func(network, addr string) (net.Conn, error)
+	peerTr   *http.Transport
+	idle     time.Duration
+}
+
+// NewLimitHandler limits clients identified by peers, tunnels are opened with dial
+func NewLimitHandler(limiter *Limiter, nb *Neighborhood, peers *PeerListener, dial func(network, addr string) (net.Conn, error)) *LimitHandler {
+	peerDial := nb.PeerDial(func() []string {
+		return nb.peerPorts(peers)
+	})
+	return &LimitHandler{
+		limiter: limiter,
+		peers:   peers,
+		action: func(host string) string {
+			if nb.Router == nil {
+				return ""
+			}
+			route := nb.Router.MatchRoute(host)
+			if route == nil {
+				return ""
+			}
+			return route.Action()
+		},
+		dial:     dial,
+		peerDial: peerDial,
+		// connections of peers are not shared with local users, they
+		// are checked when dialed
+		peerTr: &http.Transport{Dial: peerDial},
+		idle:   nb.config.IdleTimeout,
+	}
+}
+
+// Dialer returns the dial function of connections for c: those of peers may
+// not reach the listeners of this node, they come from loopback and would
+// pass peers for local users
+func (r *LimitHandler) Dialer(c Client) func(network, addr string) (net.Conn, error) {
+	if c.IsPeer() {
+		return r.peerDial
+	}
+	return r.dial
+}
+
+// dialErrorResponse answers a CONNECT failing to dial
+func dialErrorResponse(req *http.Request, err error) *http.Response {
+	status := http.StatusBadGateway
+	if kind, _ := classifyError(err); kind == ErrRefused {
+		status = http.StatusForbidden
+	}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, status, err.Error())
+}
+
+// OnRequest rejects requests over the limit and throttles uploads
+func (r *LimitHandler) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	c := r.peers.ClientOf(req)
+	if c.IsPeer() {
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return r.peerTr.RoundTrip(req)
+		})
+	}
+	action := r.action(req.URL.Hostname())
+	if r.limiter.Lookup(c, action) == nil {
+		return req, nil
+	}
+	if err := r.limiter.Allow(c, action); err != nil {
+		logger.Infof("limit: %v %v %v: %v", c, action, req.URL.Host, err)
+		return req, limitResponse(req, err.(*LimitError))
+	}
+	stateOf(ctx).limit = &limitState{
+		client: c,
+		action: action,
+	}
+	if req.Body != nil {
+		req.Body = r.limiter.Reader(req.Body, c, action)
+	}
+	return req, nil
+}
+
+// OnResponse throttles downloads
+func (r *LimitHandler) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	st := stateOf(ctx).limit
+	if resp == nil || st == nil || stateOf(ctx).handled("limit", resp) {
+		return resp
+	}
+	stateOf(ctx).handle("limit", resp, resp)
+	resp.Body = r.limiter.Reader(resp.Body, st.client, st.action)
+	return resp
+}
+
+// HandleConnect rejects tunnels over the limit and throttles the others.
+// Tunnels of peers are dialed here to check where they go.
+func (r *LimitHandler) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	c := r.peers.ClientOf(ctx.Req)
+	hostname := strings.Split(host, ":")[0]
+	action := r.action(hostname)
+	l := r.limiter.Lookup(c, action)
+	if l != nil {
+		if err := r.limiter.Allow(c, action); err != nil {
+			logger.Infof("limit: %v %v CONNECT %v: %v", c, action, host, err)
+			ctx.Resp = limitResponse(ctx.Req, err.(*LimitError))
+			return goproxy.RejectConnect, host
+		}
+	}
+	if !c.IsPeer() && (l == nil || l.Rate <= 0 && l.Quota <= 0) {
+		return nil, host
+	}
+
+	if !strings.Contains(host, ":") {
+		host += ":80"
+	}
+	target, err := r.Dialer(c)("tcp", host)
+	if err != nil {
+		logger.Infof("limit: %v tunnel %v: %v", c, host, err)
+		ctx.Resp = dialErrorResponse(ctx.Req, err)
+		return goproxy.RejectConnect, host
+	}
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			pipe(client, r.limiter.Conn(target, c, action), r.idle)
+		},
+	}, host
+}
+
+// Admit checks the client of an upgraded connection to hostname against the
+// limits and returns a wrapper throttling the connection to the origin
+func (r *LimitHandler) Admit(req *http.Request, hostname string) (func(net.Conn) net.Conn, *LimitError) {
+	c := r.peers.ClientOf(req)
+	action := r.action(hostname)
+	if r.limiter.Lookup(c, action) == nil {
+		return func(conn net.Conn) net.Conn { return conn }, nil
+	}
+	if err := r.limiter.Allow(c, action); err != nil {
+		logger.Infof("limit: %v %v upgrade %v: %v", c, action, hostname, err)
+		return nil, err.(*LimitError)
+	}
+	return func(conn net.Conn) net.Conn {
+		return r.limiter.Conn(conn, c, action)
+	}, nil
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	l, err := ParseLimit("peer:exit,rate=1Mbit,quota=2GB/day,requests=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Class != "peer" || l.Action != "exit" || l.Rate != 125000 || l.Quota != 2000000000 || l.Requests != 10 {
+		t.Fatalf("unexpected limit: %v", l)
+	}
+	l, err = ParseLimit("local:*,rate=64KB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Rate != 64000 {
+		t.Fatalf("unexpected rate: %v", l.Rate)
+	}
+
+	for _, s := range []string{
+		"peer",
+		"guest:exit,rate=1Mbit",
+		"peer:exit,rate=fast",
+		"peer:exit,quota=1Gbit",
+		"peer:exit,requests=-1",
+		"peer:exit,burst=1",
+		"peer:exit,rate",
+	} {
+		if _, err := ParseLimit(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	r, err := NewLimiter([]string{"peer:exit,requests=1,quota=1KB", "local:*,requests=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	peer := Client{Class: clientPeer, ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	local := Client{Class: clientLocal, ID: "10.0.0.2"}
+
+	if r.Lookup(peer, "direct") != nil {
+		t.Fatal("peer direct should be unlimited")
+	}
+	if r.Lookup(local, "direct") == nil {
+		t.Fatal("local wildcard limit expected")
+	}
+
+	// burst of two requests then refused
+	for i := 0; i < 2; i++ {
+		if err := r.Allow(peer, "exit"); err != nil {
+			t.Fatalf("request %v: %v", i, err)
+		}
+	}
+	err = r.Allow(peer, "exit")
+	if le, ok := err.(*LimitError); !ok || le.RetryAfter <= 0 {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	// other clients are not affected
+	if err := r.Allow(Client{Class: clientPeer, ID: "other"}, "exit"); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Second)
+	if err := r.Allow(peer, "exit"); err != nil {
+		t.Fatalf("expected refill: %v", err)
+	}
+
+	// quota
+	if err := r.transfer(peer, r.Lookup(peer, "exit"), 2000); err != errQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	now = now.Add(time.Second)
+	err = r.Allow(peer, "exit")
+	if le, ok := err.(*LimitError); !ok || le.RetryAfter != 12*time.Hour-2*time.Second {
+		t.Fatalf("expected quota error until midnight, got %v", err)
+	}
+	// next day
+	now = now.Add(12 * time.Hour)
+	if err := r.Allow(peer, "exit"); err != nil {
+		t.Fatalf("expected quota reset: %v", err)
+	}
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	r, err := NewLimiter([]string{"local:*,rate=32KB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var slept time.Duration
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	c := Client{Class: clientLocal, ID: "127.0.0.1"}
+	body := strings.Repeat("x", 128*1000)
+	rc := r.Reader(ioutil.NopCloser(strings.NewReader(body)), c, "direct")
+	b, err := ioutil.ReadAll(rc)
+	if err != nil || len(b) != len(body) {
+		t.Fatalf("read %v bytes: %v", len(b), err)
+	}
+	// 128KB minus the 32KB burst at 32KB/s
+	if slept < 2900*time.Millisecond || slept > 3100*time.Millisecond {
+		t.Fatalf("unexpected throttle time: %v", slept)
+	}
+}
+
+func TestPeerListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewPeerListener(l)
+	clients := make(chan Client, 2)
+	go http.Serve(pl, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clients <- pl.ClientOf(req)
+	}))
+
+	send := func(preamble string) Client {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(preamble + "GET / HTTP/1.1\r\nHost: a.home\r\n\r\n"))
+		if _, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil {
+			t.Fatal(err)
+		}
+		return <-clients
+	}
+
+	id := "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"
+	if c := send(id + "\n"); c.Class != clientPeer || c.ID != id {
+		t.Fatalf("expected peer client, got %v", c)
+	}
+	if c := send(""); c.Class != clientLocal || c.ID != "127.0.0.1" {
+		t.Fatalf("expected local client, got %v", c)
+	}
+}
+
+// nonLoopbackIP returns an address of this host other than loopback
+func nonLoopbackIP(t *testing.T) net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP
+		}
+	}
+	t.Skip("no address other than loopback")
+	return nil
+}
+
+func TestPeerListenerRemote(t *testing.T) {
+	l, err := net.Listen("tcp", net.JoinHostPort(nonLoopbackIP(t).String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pl := NewPeerListener(l)
+	go http.Serve(pl, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c := pl.ClientOf(req); c.IsPeer() {
+			t.Errorf("peer ID taken from %v", c)
+		}
+	}))
+
+	// only ipfs on this host reports peers
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk\nGET / HTTP/1.1\r\nHost: a.home\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %v", resp.Status)
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp := limitResponse(req, &LimitError{Reason: "request rate of 1/s exceeded", RetryAfter: 500 * time.Millisecond})
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("unexpected response: %v %v", resp.Status, resp.Header)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "request rate of 1/s exceeded") {
+		t.Fatalf("unexpected body: %s", b)
+	}
+}
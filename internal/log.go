@@ -74,3 +74,21 @@ func ensureDir(name string) {
 func Logger() *logrus.Entry {
 	return logger
 }
+
+// SetLogging overrides the log level and file set from the environment
+func SetLogging(level, file string) {
+	if level != "" {
+		if l, err := logrus.ParseLevel(level); err == nil {
+			logrus.SetLevel(l)
+		}
+	}
+	if file != "" {
+		ensureDir(file)
+		w, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			logger.Errorf("log file: %v", err)
+			return
+		}
+		logrus.SetOutput(w)
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PAC fallback for hosts that match no route
+const (
+	PACFallbackProxy  = "proxy"
+	PACFallbackDirect = "direct"
+)
+
+const pacHeader = `// generated by mirr from the route table
+function FindProxyForURL(url, host) {
+`
+
+// PAC generates a proxy auto-config script from the routes.
+// Routes with a direct backend are reached by the browser itself, anything
+// else (home, peers, upstream proxies) is sent to proxy and, if socks is set,
+// to the SOCKS alternative.
+func (c *RouteRegistry) PAC(proxy, socks, fallback string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	via := fmt.Sprintf("PROXY %v", proxy)
+	if socks != "" {
+		via = fmt.Sprintf("%v; SOCKS5 %v; SOCKS %v", via, socks, socks)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(pacHeader)
+	for _, r := range c.Routes {
+		cond := pacCondition(r)
+		if cond == "" || len(r.Backend) == 0 {
+			continue
+		}
+		action := via
+		if r.IsDirect() {
+			action = "DIRECT"
+		}
+		fmt.Fprintf(&b, "\tif (%v) return %v;\n", cond, jsString(action))
+	}
+	if fallback == PACFallbackDirect {
+		fmt.Fprintf(&b, "\treturn %v;\n", jsString("DIRECT"))
+	} else {
+		fmt.Fprintf(&b, "\treturn %v;\n", jsString(via))
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// pacCondition translates a route match into a PAC expression.
+// Globs with only * and ? map to shExpMatch, other globs and regular
+// expressions become RegExp tests.
+func pacCondition(r *Route) string {
+	if r.re != nil {
+		return fmt.Sprintf("new RegExp(%v).test(host)", jsString(r.re.String()))
+	}
+	if r.pattern == "" {
+		return ""
+	}
+	if !strings.ContainsAny(r.pattern, `[\`) {
+		return fmt.Sprintf("shExpMatch(host, %v)", jsString(r.pattern))
+	}
+	return fmt.Sprintf("new RegExp(%v).test(host)", jsString(globToRegexp(r.pattern)))
+}
+
+// globToRegexp converts a filepath.Match pattern into an anchored regexp
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+j]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + strings.Replace(class[1:], "^", `\^`, -1)
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// PACHandlerFunc serves proxy.pac generated from the route table
+func PACHandlerFunc(proxyURL string, nb *Neighborhood) http.HandlerFunc {
+	URL, _ := url.Parse(proxyURL)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the address the browser used to fetch the PAC file reaches the proxy too
+		proxy := req.Host
+		if proxy == "" {
+			proxy = URL.Host
+		} else if _, _, err := net.SplitHostPort(proxy); err != nil {
+			proxy = net.JoinHostPort(strings.Trim(proxy, "[]"), URL.Port())
+		}
+
+		var socks, fallback string
+		if nb.config != nil {
+			socks = nb.config.PACSocks
+			fallback = nb.config.PACFallback
+		}
+
+		if nb.Router == nil {
+			http.Error(w, "route table not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(nb.Router.PAC(proxy, socks, fallback)))
+	})
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	cfg := NewRouteRegistry("921sm3fxr9v5wwh08d7nvnks5a37px0tdj8qd8e0cc60acy514r61r")
+	err := cfg.ReadString(`
+localhost            direct
+*.home               localhost
+*.${myid}            localhost
+/.*\.[a-zA-Z0-9]{25,}\.m3/ peer
+git[0-9].example.com 1.2.3.4
+foobar.net           direct PROXY
+/.*/                 direct
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pac := cfg.PAC("10.0.0.1:18080", "10.0.0.1:1080", PACFallbackDirect)
+	via := `"PROXY 10.0.0.1:18080; SOCKS5 10.0.0.1:1080; SOCKS 10.0.0.1:1080"`
+	expected := []string{
+		`if (shExpMatch(host, "localhost")) return "DIRECT";`,
+		`if (shExpMatch(host, "*.home")) return ` + via + `;`,
+		`if (shExpMatch(host, "*.921sm3fxr9v5wwh08d7nvnks5a37px0tdj8qd8e0cc60acy514r61r")) return ` + via + `;`,
+		`if (new RegExp(".*\\.[a-zA-Z0-9]{25,}\\.m3").test(host)) return ` + via + `;`,
+		`if (new RegExp("^git[0-9]\\.example\\.com$").test(host)) return ` + via + `;`,
+		`if (shExpMatch(host, "foobar.net")) return ` + via + `;`,
+		`if (new RegExp(".*").test(host)) return "DIRECT";`,
+		`return "DIRECT";`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(pac, e) {
+			t.Errorf("PAC missing %v in:\n%v", e, pac)
+		}
+	}
+
+	pac = cfg.PAC("10.0.0.1:18080", "", PACFallbackProxy)
+	if !strings.HasSuffix(pac, "\treturn \"PROXY 10.0.0.1:18080\";\n}\n") {
+		t.Errorf("PAC fallback is wrong:\n%v", pac)
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := map[string][]string{
+		"git[0-9].home": {"git1.home"},
+		"a[^b]?.m3":     {"acd.m3"},
+		`x\*y`:          {"x*y"},
+	}
+	for glob, hosts := range tests {
+		re := regexp.MustCompile(globToRegexp(glob))
+		for _, h := range hosts {
+			if !re.MatchString(h) {
+				t.Errorf("globToRegexp(%q) = %q does not match %q", glob, re, h)
+			}
+		}
+	}
+}
+
+func TestPACHandlerFunc(t *testing.T) {
+	nb := NewNeighborhood(&Config{PACFallback: PACFallbackProxy})
+	nb.Router = NewRouteRegistry("")
+	nb.Router.ReadString("*.home localhost")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://mirr.local/proxy.pac", nil)
+	PACHandlerFunc("http://127.0.0.1:18080", nb)(w, req)
+
+	if !strings.Contains(w.Body.String(), `"PROXY mirr.local:18080"`) {
+		t.Errorf("PACHandlerFunc body:\n%v", w.Body.String())
+	}
+}
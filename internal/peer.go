@@ -3,6 +3,7 @@ package internal
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Peer is
@@ -17,6 +18,7 @@ type Peer struct {
 
 	Rank      int // -1, 0, 1 ...
 	timestamp int64
+	latency   time.Duration
 }
 
 // Neighborhood is
@@ -24,10 +26,15 @@ type Neighborhood struct {
 	Peers  map[string]*Peer
 	My     *Node
 	Router *RouteRegistry
+	// Forwards runs the configured port forwards if started
+	Forwards *ForwardService
+	// Published offers the configured services to peers if started
+	Published *Publisher
 	// W3ProxyHost string
 	config *Config
 	min    int
 	max    int
+	exits  *peerExits
 
 	sync.Mutex
 }
@@ -39,6 +46,7 @@ func NewNeighborhood(c *Config) *Neighborhood {
 		config: c,
 		min:    0,
 		max:    5,
+		exits:  newPeerExits(),
 	}
 
 	return nb
@@ -101,6 +109,28 @@ func (r *Neighborhood) GetPeerTarget(id string) string {
 	return addr
 }
 
+// PeerTarget resolves the peer of hostname to its forward host:port
+func (r *Neighborhood) PeerTarget(hostname string) (string, string, error) {
+	id := ToPeerID(PeerTLD(hostname))
+	if id == "" {
+		return "", "", &RouteError{
+			Kind: ErrPeerInvalid,
+			Host: hostname,
+			Err:  fmt.Errorf("Peer invalid: %v", hostname),
+		}
+	}
+	target := r.GetPeerTarget(id)
+	if target == "" {
+		return id, "", &RouteError{
+			Kind:   ErrPeerUnreachable,
+			Host:   hostname,
+			PeerID: id,
+			Err:    fmt.Errorf("Peer not reachable: %v", hostname),
+		}
+	}
+	return id, target, nil
+}
+
 func (r *Neighborhood) addPeer(id string) *Peer {
 	if id == r.My.ID {
 		//TODO
@@ -120,19 +150,23 @@ func (r *Neighborhood) addPeer(id string) *Peer {
 	err = p2pForward(port, id)
 
 	rank := -1
+	var latency time.Duration
 	if err == nil {
+		start := time.Now()
 		ok := p2pIsLive(port)
 		if ok {
 			rank = 1
+			latency = time.Since(start)
 		}
 	}
-	logger.Printf("@@@ addPeer id: %v port: %v rank: %v err: %v\n", id, port, rank, err)
+	logger.Printf("@@@ addPeer id: %v port: %v rank: %v latency: %v err: %v\n", id, port, rank, latency, err)
 
 	p = &Peer{
 		Peer:      id,
 		Port:      port,
 		Rank:      rank,
 		timestamp: CurrentTime(),
+		latency:   latency,
 	}
 
 	// add
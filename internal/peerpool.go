@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// peer pool modes
+const (
+	PeerPoolH2C   = "h2c"
+	PeerPoolHTTP1 = "http1"
+	PeerPoolOff   = "off"
+)
+
+// defaults of the peer pool
+const (
+	DefaultPeerMaxConns    = 8
+	DefaultPeerIdleTimeout = 90 * time.Second
+)
+
+// peerProxyHeader marks HTTP/2 requests a peer sends in proxy form, the
+// authority being the requested host rather than the peer itself
+const peerProxyHeader = "X-M3-Proxy"
+
+// PeerPool sends plain HTTP requests of peer routes over reusable
+// connections to the peer forwards instead of a CONNECT tunnel per target.
+// Between m3 nodes requests are multiplexed over one HTTP/2 connection
+// without TLS (h2c); peers without h2c get HTTP/1.1 keep-alive connections.
+type PeerPool struct {
+	nb   *Neighborhood
+	mode string
+	// MaxConns caps the HTTP/1.1 connections per peer
+	MaxConns    int
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*peerTransport
+}
+
+// NewPeerPool creates the pool configured for nb, nil if pooling is off
+func NewPeerPool(nb *Neighborhood) *PeerPool {
+	p := &PeerPool{
+		nb:          nb,
+		mode:        PeerPoolH2C,
+		MaxConns:    DefaultPeerMaxConns,
+		IdleTimeout: DefaultPeerIdleTimeout,
+		peers:       make(map[string]*peerTransport),
+	}
+	if cfg := nb.config; cfg != nil {
+		if cfg.PeerPool != "" {
+			p.mode = cfg.PeerPool
+		}
+		if cfg.PeerMaxConns > 0 {
+			p.MaxConns = cfg.PeerMaxConns
+		}
+		if cfg.PeerIdleTimeout > 0 {
+			p.IdleTimeout = cfg.PeerIdleTimeout
+		}
+	}
+	if p.mode == PeerPoolOff {
+		return nil
+	}
+	return p
+}
+
+// peerTransport holds the connections to one peer forward
+type peerTransport struct {
+	target string
+	h1     *http.Transport
+	h2     *http2.Transport
+	idle   *time.Timer
+
+	mu sync.Mutex
+	// h1Only is set once the peer turned out not to speak h2c
+	h1Only bool
+	h2ok   bool
+}
+
+func (p *PeerPool) newTransport(target string) *peerTransport {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, target, dialTimeout)
+	}
+	t := &peerTransport{
+		target: target,
+		h1: &http.Transport{
+			Proxy:               http.ProxyURL(&url.URL{Scheme: "http", Host: target}),
+			Dial:                dial,
+			MaxConnsPerHost:     p.MaxConns,
+			MaxIdleConnsPerHost: p.MaxConns,
+			IdleConnTimeout:     p.IdleTimeout,
+			DisableCompression:  true,
+		},
+		h1Only: p.mode == PeerPoolHTTP1,
+	}
+	if !t.h1Only {
+		t.h2 = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			},
+			DisableCompression: true,
+			// one connection per peer
+			StrictMaxConcurrentStreams: true,
+		}
+		t.idle = time.AfterFunc(p.IdleTimeout, t.h2.CloseIdleConnections)
+	}
+	return t
+}
+
+func (t *peerTransport) close() {
+	t.h1.CloseIdleConnections()
+	if t.h2 != nil {
+		t.idle.Stop()
+		t.h2.CloseIdleConnections()
+	}
+}
+
+// transport returns the connections to the peer of hostname
+func (p *PeerPool) transport(hostname string) (*peerTransport, error) {
+	id, target, err := p.nb.PeerTarget(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.peers[id]
+	if t != nil && t.target == target {
+		return t, nil
+	}
+	// the forward moved, connections to the old port are useless
+	if t != nil {
+		t.close()
+	}
+	t = p.newTransport(target)
+	p.peers[id] = t
+	return t, nil
+}
+
+// RoundTrip sends req to the peer serving its host
+func (p *PeerPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := p.transport(req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	h1Only := t.h1Only
+	t.mu.Unlock()
+	if h1Only {
+		return t.h1.RoundTrip(req)
+	}
+
+	out := req.WithContext(req.Context())
+	out.URL = new(url.URL)
+	*out.URL = *req.URL
+	out.URL.Host = t.target
+	out.Host = req.URL.Host
+	out.Header = cloneHeader(req.Header)
+	out.Header.Set(peerProxyHeader, "1")
+
+	resp, err := t.h2.RoundTrip(out)
+	t.idle.Reset(p.IdleTimeout)
+	if err == nil {
+		t.mu.Lock()
+		t.h2ok = true
+		t.mu.Unlock()
+		resp.Request = req
+		return resp, nil
+	}
+	if !t.fallback(err) {
+		return nil, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.h1.RoundTrip(req)
+}
+
+// fallback switches the peer to HTTP/1.1 if h2c never worked, telling
+// peers without h2c from broken connections
+func (t *peerTransport) fallback(err error) bool {
+	if op, ok := err.(*net.OpError); ok && op.Op == "dial" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h2ok {
+		return false
+	}
+	logger.Infof("peer %v: h2c failed, using HTTP/1.1: %v", t.target, err)
+	t.h1Only = true
+	return true
+}
+
+// OnRequest sends plain HTTP requests of peer routes through the pool
+func (p *PeerPool) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.URL.Scheme != "http" || p.nb.Router == nil {
+		return req, nil
+	}
+	r := p.nb.Router.MatchRoute(req.URL.Hostname())
+	if r == nil || r.Action() != "peer" {
+		return req, nil
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		return p.RoundTrip(req)
+	})
+	return req, nil
+}
+
+// peerProxyHandler turns HTTP/2 requests of peers in proxy form back into
+// absolute requests, and accepts HTTP/2 without TLS from peer pools
+func peerProxyHandler(next http.Handler, idle time.Duration) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && req.Header.Get(peerProxyHeader) != "" && req.Method != "CONNECT" && !req.URL.IsAbs() {
+			req.Header.Del(peerProxyHeader)
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+		}
+		next.ServeHTTP(w, req)
+	})
+	return h2c.NewHandler(h, &http2.Server{IdleTimeout: idle})
+}
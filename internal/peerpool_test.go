@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPeerID = "QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N"
+
+// countListener counts the accepted connections
+type countListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.n, 1)
+	}
+	return c, err
+}
+
+func (l *countListener) count() int {
+	return int(atomic.LoadInt32(&l.n))
+}
+
+// startTestNode serves a proxy for id with handler wrapped by wrap
+func startTestNode(t testing.TB, cfg *Config, id, routes string, wrap func(http.Handler) http.Handler) (*Neighborhood, *countListener, func()) {
+	nb := NewNeighborhood(cfg)
+	nb.My = &Node{ID: id}
+	nb.Router = NewRouteRegistry(id)
+	if err := nb.Router.ReadString(routes); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countListener{Listener: l}
+	peers := NewPeerListener(cl)
+	h := NewProxy(nb, peers, "http://"+l.Addr().String())
+	if wrap != nil {
+		h = wrap(h)
+	}
+	go http.Serve(peers, h)
+	return nb, cl, func() { l.Close() }
+}
+
+// peerPair starts a node of testPeerID forwarding to origin and a node
+// reaching it as peer, returning the proxy URL of the latter
+func peerPair(t testing.TB, pool string, origin *httptest.Server, wrap func(http.Handler) http.Handler) (*url.URL, *countListener, func()) {
+	u, _ := url.Parse(origin.URL)
+	_, remote, stopRemote := startTestNode(t, &Config{}, testPeerID, "*.${myid} "+u.Host, wrap)
+
+	nb, local, stopLocal := startTestNode(t, &Config{PeerPool: pool}, "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk", `/.*\.[a-zA-Z0-9]{25,}/ peer`, nil)
+	port := remote.Addr().(*net.TCPAddr).Port
+	nb.Peers[testPeerID] = &Peer{Peer: testPeerID, Port: port, Rank: 1}
+
+	host := apiHost
+	apiHost = "127.0.0.1"
+	proxyURL, _ := url.Parse("http://" + local.Addr().String())
+	return proxyURL, remote, func() {
+		apiHost = host
+		stopLocal()
+		stopRemote()
+	}
+}
+
+func testPage(p string) string {
+	return "http://web." + ToPeerAddr(testPeerID) + p
+}
+
+func fetch(client *http.Client, u string) (string, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%v: %v", u, resp.Status)
+	}
+	return string(b), nil
+}
+
+func TestPeerPool(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%v %v", req.Host, req.URL.Path)
+	}))
+	defer origin.Close()
+
+	plain := func(h http.Handler) http.Handler {
+		// strip h2c support off the remote node
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "PRI" {
+				http.Error(w, "no h2c", http.StatusBadRequest)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+
+	cases := []struct {
+		name  string
+		pool  string
+		wrap  func(http.Handler) http.Handler
+		conns int
+	}{
+		{"h2c", PeerPoolH2C, nil, 1},
+		{"http1", PeerPoolHTTP1, nil, 1},
+		// the failed h2c attempt takes a connection
+		{"fallback", PeerPoolH2C, plain, 2},
+	}
+	for _, c := range cases {
+		proxyURL, remote, stop := peerPair(t, c.pool, origin, c.wrap)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		for i := 0; i < 5; i++ {
+			p := fmt.Sprintf("/asset%v", i)
+			body, err := fetch(client, testPage(p))
+			if err != nil {
+				t.Fatalf("%v: %v", c.name, err)
+			}
+			if expected := "web." + ToPeerAddr(testPeerID) + " " + p; body != expected {
+				t.Errorf("%v: expected %q, got %q", c.name, expected, body)
+			}
+		}
+		if n := remote.count(); n != c.conns {
+			t.Errorf("%v: expected %v connections to the peer, got %v", c.name, c.conns, n)
+		}
+		stop()
+	}
+}
+
+// BenchmarkPeerPageLoad loads a page and its assets from a peer
+func BenchmarkPeerPageLoad(b *testing.B) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond)
+		io.WriteString(w, "<html></html>")
+	}))
+	defer origin.Close()
+
+	for _, pool := range []string{PeerPoolOff, PeerPoolHTTP1, PeerPoolH2C} {
+		b.Run(pool, func(b *testing.B) {
+			proxyURL, _, stop := peerPair(b, pool, origin, nil)
+			defer stop()
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:               http.ProxyURL(proxyURL),
+				MaxIdleConnsPerHost: 10,
+			}}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fetch(client, testPage("/")); err != nil {
+					b.Fatal(err)
+				}
+				var wg sync.WaitGroup
+				for j := 0; j < 10; j++ {
+					wg.Add(1)
+					go func(j int) {
+						defer wg.Done()
+						if _, err := fetch(client, testPage(fmt.Sprintf("/asset%v", j))); err != nil {
+							b.Error(err)
+						}
+					}(j)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 
 	"strings"
 	"time"
@@ -34,81 +37,163 @@ func redirectHost(r *http.Request, host, body string) *http.Response {
 	return resp
 }
 
-func cors(r *http.Response) {
-	r.Header.Set("Access-Control-Allow-Origin", "*")
-	r.Header.Set("Access-Control-Allow-Credentials", "true")
-	r.Header.Set("Access-Control-Allow-Methods", "*")
-	r.Header.Set("Access-Control-Allow-Headers", "*")
+// proxyState carries per request data between goproxy handlers
+type proxyState struct {
+	cache  *cacheState
+	limit  *limitState
+	header *headerState
+
+	// the last response each response handler got and returned
+	responses map[string][2]*http.Response
+}
+
+// handled reports whether the response handler name already ran on resp:
+// goproxy filters error pages twice
+func (s *proxyState) handled(name string, resp *http.Response) bool {
+	h := s.responses[name]
+	return resp != nil && (h[0] == resp || h[1] == resp)
+}
+
+// handle records that the response handler name turned in into out
+func (s *proxyState) handle(name string, in, out *http.Response) {
+	if s.responses == nil {
+		s.responses = make(map[string][2]*http.Response)
+	}
+	s.responses[name] = [2]*http.Response{in, out}
+}
+
+func stateOf(ctx *goproxy.ProxyCtx) *proxyState {
+	if s, ok := ctx.UserData.(*proxyState); ok {
+		return s
+	}
+	s := &proxyState{}
+	ctx.UserData = s
+	return s
 }
 
 // HTTPProxy dispatches request based on network addr
 func HTTPProxy(port int, nb *Neighborhood) {
-	proxy := goproxy.NewProxyHttpServer()
-	dial := func(network, addr string) (net.Conn, error) {
-		hostport := strings.Split(addr, ":")
+	cfg := nb.config
+	addr := cfg.Listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%v", port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	peers := NewPeerListener(l)
+	peers.Allow = cfg.PeerAllowed
+	proxyURL := fmt.Sprintf("http://127.0.0.1:%v", port)
+	handler := NewProxy(nb, peers, proxyURL)
+
+	if cfg.HTTPSListen != "" {
+		go func() {
+			logger.Debugf("Proxy listening on TLS: %v\n", cfg.HTTPSListen)
+			err := http.ListenAndServeTLS(cfg.HTTPSListen, cfg.TLSCert, cfg.TLSKey, handler)
+			logger.Errorf("TLS proxy exited: %v", err)
+		}()
+	}
 
-		// resolved := hostport[0] //nb.ResolveAddr(hostport[0])
-		be, viaProxy := nb.Router.Match(hostport[0])
-		if be == nil || len(be) == 0 {
-			return nil, fmt.Errorf("Proxy routing error: %v %v", network, addr)
-		}
-		logger.Debugf("Router.Match(%q): %v proxy: %v, network: %v addr: %v", hostport[0], *be[0], viaProxy, network, addr)
+	logger.Debugf("Proxy listening on: %v\n", addr)
+	logger.Fatal(http.Serve(peers, handler))
+}
 
-		// prevent loop
-		if be[0].Hostname == hostport[0] {
-			return net.Dial(network, addr)
-		}
+// Dial connects to addr as routed: directly, to a backend, over p2p to the
+// peer of the host or through exits
+func (r *Neighborhood) Dial(network, addr string) (net.Conn, error) {
+	return r.dialRoute(network, addr, nil)
+}
+
+// PeerDial returns the dial function of connections opened for peers, they
+// may not reach the listeners on ports of this host nor its addresses no
+// route maps a name to
+func (r *Neighborhood) PeerDial(ports func() []string) func(network, addr string) (net.Conn, error) {
+	g := &selfGuard{ports: ports}
+	return func(network, addr string) (net.Conn, error) {
+		return r.dialRoute(network, addr, g)
+	}
+}
 
-		if be[0].Hostname == "direct" {
-			return net.Dial(network, addr)
+// dialRoute connects to addr as routed, checking the addresses dialed on
+// this host with g if not nil
+func (r *Neighborhood) dialRoute(network, addr string, g *selfGuard) (net.Conn, error) {
+	hostport := strings.Split(addr, ":")
+
+	// resolved := hostport[0] //nb.ResolveAddr(hostport[0])
+	route := r.Router.MatchRoute(hostport[0])
+	if route == nil || len(route.Backend) == 0 {
+		return nil, &RouteError{
+			Kind: ErrNoRoute,
+			Host: hostport[0],
+			Err:  fmt.Errorf("Proxy routing error: %v %v", network, addr),
 		}
+	}
+	be := route.Backend
+	logger.Debugf("Router.Match(%q): %v proxy: %v exits: %v, network: %v addr: %v", hostport[0], *be[0], route.Proxy, route.Exits, network, addr)
 
-		if be[0].Hostname == "peer" {
-			logger.Debugf("@@@ Dial peer network: %v addr: %v\n", network, addr)
+	if len(route.Exits) > 0 {
+		return r.DialExits(route.Exits, network, addr)
+	}
 
-			tld := PeerTLD(hostport[0])
-			id := ToPeerID(tld)
-			if id == "" {
-				return nil, fmt.Errorf("Peer invalid: %v", hostport[0])
-			}
-			target := nb.GetPeerTarget(id)
-			if target == "" {
-				return nil, fmt.Errorf("Peer not reachable: %v", hostport[0])
-			}
+	// prevent loop
+	if be[0].Hostname == hostport[0] {
+		return g.dial(network, addr, false)
+	}
 
-			logger.Debugf("@@@ Dial peer network: %v addr: %v target: %v\n", network, addr, target)
-			dial := proxy.NewConnectDialToProxy(fmt.Sprintf("http://%v", target))
+	if be[0].Hostname == "direct" {
+		return g.dial(network, addr, false)
+	}
 
-			if dial != nil {
-				return dial(network, addr)
-			}
-			return nil, fmt.Errorf("Peer proxy error: %v", target)
-		}
+	if be[0].Hostname == actionExit {
+		return r.DialPeerExit(network, addr)
+	}
+
+	if be[0].Hostname == "peer" {
+		logger.Debugf("@@@ Dial peer network: %v addr: %v\n", network, addr)
 
-		// pass on port if not provided in backend target
-		port := fmt.Sprintf("%v", be[0].Port)
-		if be[0].Port == 0 {
-			port = hostport[1]
+		id, target, err := r.PeerTarget(hostport[0])
+		if err != nil {
+			return nil, err
 		}
-		target := fmt.Sprintf("%v:%v", be[0].Hostname, port)
-		if viaProxy {
-			dial := proxy.NewConnectDialToProxy(fmt.Sprintf("http://%v", target))
 
-			if dial != nil {
-				return dial(network, addr)
+		logger.Debugf("@@@ Dial peer network: %v addr: %v target: %v\n", network, addr, target)
+		c, err := connectDial(&url.URL{Scheme: "http", Host: target}, network, addr)
+		if err != nil {
+			return nil, &RouteError{
+				Kind:   ErrPeerUnreachable,
+				Host:   hostport[0],
+				PeerID: id,
+				Err:    err,
 			}
-			return nil, fmt.Errorf("Proxy routing error: %v %v", network, addr)
 		}
+		return c, nil
+	}
 
-		return net.Dial(network, target)
+	// pass on port if not provided in backend target
+	port := fmt.Sprintf("%v", be[0].Port)
+	if be[0].Port == 0 {
+		port = hostport[1]
 	}
+	target := fmt.Sprintf("%v:%v", be[0].Hostname, port)
+
+	return g.dial(network, target, true)
+}
+
+// NewProxy creates the proxy handler reachable at proxyURL, clients are identified by peers
+func NewProxy(nb *Neighborhood, peers *PeerListener, proxyURL string) http.Handler {
+	proxy := goproxy.NewProxyHttpServer()
+	dial := nb.Dial
 
 	//
 	proxy.ConnectDial = nil
 	proxy.Tr.Dial = dial
 	proxy.Tr.DialTLS = nil
 	proxy.Tr.Proxy = nil
-	proxy.NonproxyHandler = MuxHandlerFunc(fmt.Sprintf("http://127.0.0.1:%v", port))
+	cache := newCache(nb.config)
+
+	access := NewAccessLog(accessLogSize)
+	proxy.NonproxyHandler = MuxHandlerFunc(proxyURL, nb, NewNodeHealthChecker(nb, proxyURL), cache, NewAdminAuth(nb.config), access)
 
 	//
 	proxy.Verbose = true
@@ -132,19 +217,73 @@ func HTTPProxy(port int, nb *Neighborhood) {
 			return req, nil
 		})
 
+	// limits apply to cached responses too
+	limiter, err := NewLimiter(nb.config.Limits)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	lh := NewLimitHandler(limiter, nb, peers, dial)
+	proxy.OnRequest().DoFunc(lh.OnRequest)
+	proxy.OnRequest().HandleConnectFunc(lh.HandleConnect)
+
+	// failed round trips get an error page all other handlers see
+	var etc string
+	if base := os.Getenv("DHNT_BASE"); base != "" {
+		etc = filepath.Join(base, "etc")
+	}
+	pages := NewErrorPages(etc)
+	proxy.OnResponse().DoFunc(NewErrorHandler(pages, nb).OnResponse)
+
+	// cache sees the request as sent and the origin response before
+	// the header policy is applied
+	hh := NewHeaderHandler(nb, peers)
+	proxy.OnRequest().DoFunc(hh.OnRequest)
+	if cache != nil {
+		ch := NewCacheHandler(cache, nb)
+		proxy.OnRequest().DoFunc(ch.OnRequest)
+		proxy.OnResponse().DoFunc(ch.OnResponse)
+	}
+	proxy.OnResponse().DoFunc(hh.OnResponse)
+
+	// requests not answered by now go to the origin, to peers over the pool
+	pool := NewPeerPool(nb)
+	if pool != nil {
+		proxy.OnRequest().DoFunc(pool.OnRequest)
+	}
+
 	proxy.OnResponse().DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 		logger.Debugf("\n--------------------\n")
 		if r != nil {
-			r.Header.Add("X-Peer-Id", nb.My.ID)
-			cors(r)
 			logger.Debugf("@@@ Proxy OnResponse status: %v length: %v\n", r.StatusCode, r.ContentLength)
 		}
 		logger.Debugf("@@@ OnResponse response: %v\n", r)
 		return r
 	})
 
-	logger.Debugf("Proxy listening on: %v\n", port)
-	logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), proxy))
+	proxy.OnResponse().DoFunc(lh.OnResponse)
+
+	return peerProxyHandler(clientHandler(peers, accessHandler(access, &UpgradeHandler{
+		Next:        proxy,
+		Dial:        dial,
+		IdleTimeout: nb.config.IdleTimeout,
+		Nb:          nb,
+		Limits:      lh,
+		Headers:     hh,
+		Pages:       pages,
+	})), nb.config.PeerIdleTimeout)
+}
+
+func newCache(cfg *Config) *HTTPCache {
+	if cfg == nil || cfg.CacheDir == "" || cfg.CacheSize <= 0 {
+		return nil
+	}
+	cache, err := NewHTTPCache(cfg.CacheDir, cfg.CacheSize)
+	if err != nil {
+		logger.Errorf("cache disabled: %v", err)
+		return nil
+	}
+	logger.Infof("cache: %v", cache.Stats())
+	return cache
 }
 
 // StartProxy starts proxy services
@@ -166,7 +305,20 @@ func StartProxy(cfg *Config) {
 	}
 	nb.My = &node
 	nb.Router = NewRouteRegistry(nb.My.ID)
-	nb.Router.ReadFile(cfg.RouteFile)
+	if err := nb.Router.ReadFiles(cfg.RouteFiles); err != nil {
+		logger.Errorf("routes: %v", err)
+	}
+
+	nb.Forwards = NewForwardService(nb)
+	if err := nb.Forwards.Apply(cfg.Forwards); err != nil {
+		logger.Errorf("%v", err)
+	}
+	nb.Published = NewPublisher(cfg)
+	if err := nb.Published.Apply(cfg.Publish); err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	go StartDNS(cfg, nb.Router)
 
 	//
 	port := cfg.Port
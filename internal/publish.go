@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PublishSpec declares a local TCP service offered to peers under the p2p
+// protocol /x/<name>/1.0
+type PublishSpec struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Allow lists the peer addresses or IDs that may connect, * admits
+	// every peer not denied by peer.deny
+	Allow []string `json:"allow"`
+}
+
+// PublishStatus reports a published service and its connections
+type PublishStatus struct {
+	PublishSpec
+	Protocol  string `json:"protocol"`
+	Running   bool   `json:"running"`
+	Active    int64  `json:"active"`
+	Total     int64  `json:"total"`
+	Failed    int64  `json:"failed"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+var serviceNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// errPeerDenied fails connections to a published service from local users
+// or peers not allowed
+var errPeerDenied = errors.New("peer not allowed")
+
+// peerPreambleTimeout limits waiting for the peer ID ipfs sends ahead of
+// a stream
+var peerPreambleTimeout = 5 * time.Second
+
+// ServiceProtocol returns the p2p protocol of the service name
+func ServiceProtocol(name string) string {
+	return "/x/" + name + "/1.0"
+}
+
+// Validate checks the name, target and ACL of the service
+func (r *PublishSpec) Validate() error {
+	if !serviceNameRE.MatchString(r.Name) {
+		return fmt.Errorf("invalid service name %q", r.Name)
+	}
+	if ServiceProtocol(r.Name) == protocolWWW {
+		return fmt.Errorf("%v: reserved for the proxy", r.Name)
+	}
+	if host, port, err := net.SplitHostPort(r.Target); err != nil || host == "" || port == "" {
+		return fmt.Errorf("%v: target %q must be host:port", r.Name, r.Target)
+	}
+	if len(r.Allow) == 0 {
+		return fmt.Errorf("%v: allow is required, * admits all peers", r.Name)
+	}
+	var bad []string
+	for _, a := range r.Allow {
+		if a != "*" && ToPeerID(a) == "" {
+			bad = append(bad, a)
+		}
+	}
+	if bad != nil {
+		return fmt.Errorf("%v: invalid peer addresses: %v", r.Name, bad)
+	}
+	return nil
+}
+
+// allows reports whether the peer id may connect to the service
+func (r *PublishSpec) allows(id string) bool {
+	for _, a := range r.Allow {
+		if a == "*" || ToPeerID(a) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Publisher offers local services to peers. Each service is served by a
+// relay that ipfs p2p listen passes the streams of its protocol to; the
+// relay checks the peer ID reported by ipfs and connects allowed peers to
+// the target.
+//
+// The peer ID is a line ipfs sends ahead of the stream, any client able to
+// connect to a relay can send one too. Relays therefore listen on loopback
+// and take connections from loopback only, where ipfs dials them from:
+// remote clients cannot claim to be a peer, local users of the host can
+// and are trusted as they are by the admin API. The proxy does not connect
+// peers to the relays, see Neighborhood.PeerDial.
+type Publisher struct {
+	cfg *Config
+	// host is the loopback address relays listen on
+	host string
+
+	// listen and close register the relays with ipfs
+	listen func(protocol string, port int) error
+	close  func(protocol string) error
+
+	services map[string]*publication
+	sync.Mutex
+}
+
+type publication struct {
+	spec PublishSpec
+	fw   *forward
+}
+
+// NewPublisher creates the publisher of the services of a node with the
+// peer ACL of cfg
+func NewPublisher(cfg *Config) *Publisher {
+	return &Publisher{
+		cfg:      cfg,
+		host:     "127.0.0.1",
+		listen:   p2pListen,
+		close:    p2pClose,
+		services: make(map[string]*publication),
+	}
+}
+
+// Apply publishes the services of specs: new ones are started, changed
+// ones restarted and missing ones withdrawn along with their connections.
+// Services failing to start are reported in the returned error and the
+// status.
+func (r *Publisher) Apply(specs []PublishSpec) error {
+	for i := range specs {
+		if err := specs[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	want := make(map[string]PublishSpec, len(specs))
+	for _, spec := range specs {
+		want[spec.Name] = spec
+	}
+	for name, p := range r.services {
+		if spec, ok := want[name]; ok && reflect.DeepEqual(spec, p.spec) && p.fw.status().Running {
+			delete(want, name)
+			continue
+		}
+		r.withdraw(p)
+		delete(r.services, name)
+	}
+
+	var errs []string
+	for name, spec := range want {
+		p, err := r.publish(spec)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+		r.services[name] = p
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("publish failed: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// publish starts the relay of spec and registers it with ipfs
+func (r *Publisher) publish(spec PublishSpec) (*publication, error) {
+	fw := newForward(ForwardSpec{
+		Listen:         net.JoinHostPort(r.host, "0"),
+		Target:         spec.Target,
+		ForwardOptions: ForwardOptions{Peers: true},
+	}, nil)
+	fw.allow = func(id string) bool {
+		return r.cfg.PeerAllowed(id) && spec.allows(id)
+	}
+	p := &publication{spec: spec, fw: fw}
+
+	err := fw.start("")
+	if err == nil {
+		protocol := ServiceProtocol(spec.Name)
+		port := fw.listener.Addr().(*net.TCPAddr).Port
+		// drop the listener left by an earlier run
+		r.close(protocol)
+		if err = r.listen(protocol, port); err != nil {
+			fw.close()
+		} else {
+			logger.Infof("published %v as %v", spec.Target, protocol)
+		}
+	} else {
+		close(fw.done)
+	}
+	if err != nil {
+		fw.stats.fail(err)
+	}
+	return p, err
+}
+
+func (r *Publisher) withdraw(p *publication) {
+	if p.fw.status().Running {
+		r.close(ServiceProtocol(p.spec.Name))
+	}
+	p.fw.close()
+}
+
+// Status reports the published services ordered by name
+func (r *Publisher) Status() []PublishStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	list := []PublishStatus{}
+	for _, p := range r.services {
+		s := p.fw.status()
+		list = append(list, PublishStatus{
+			PublishSpec: p.spec,
+			Protocol:    ServiceProtocol(p.spec.Name),
+			Running:     s.Running,
+			Active:      s.Active,
+			Total:       s.Total,
+			Failed:      s.Failed,
+			LastError:   s.LastError,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Ports returns the ports of the relays
+func (r *Publisher) Ports() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var ports []string
+	for _, p := range r.services {
+		if port := p.fw.peerPort(); port != "" {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// Close withdraws all services
+func (r *Publisher) Close() {
+	r.Lock()
+	defer r.Unlock()
+
+	for name, p := range r.services {
+		r.withdraw(p)
+		delete(r.services, name)
+	}
+}
+
+// serviceHost is the address forwards to services of peers listen on: who
+// connects passes the ACL of the service as this node, only local users may
+const serviceHost = "127.0.0.1"
+
+// ServiceForward maps a service published by a peer to a local port
+type ServiceForward struct {
+	Protocol string
+	PeerID   string
+	Port     int
+}
+
+// ConnectService forwards the local port, a free one if 0, to the service
+// published by the peer id
+func ConnectService(id, service string, port int) (*ServiceForward, error) {
+	if !serviceNameRE.MatchString(service) {
+		return nil, fmt.Errorf("invalid service name %q", service)
+	}
+	// the port must be free where the forward listens
+	l, err := net.Listen("tcp", net.JoinHostPort(serviceHost, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	r := &ServiceForward{
+		Protocol: ServiceProtocol(service),
+		PeerID:   id,
+		Port:     port,
+	}
+	if err := P2PForward(r.Protocol, "/ip4/"+serviceHost, r.Port, r.PeerID); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Addr returns the address local clients connect to
+func (r *ServiceForward) Addr() string {
+	return net.JoinHostPort(serviceHost, strconv.Itoa(r.Port))
+}
+
+// Close removes the forward
+func (r *ServiceForward) Close() error {
+	return P2PForwardClose(r.Protocol, "/ip4/"+serviceHost, r.Port, r.PeerID)
+}
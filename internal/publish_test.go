@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublishSpecValidate(t *testing.T) {
+	cases := []struct {
+		spec PublishSpec
+		ok   bool
+	}{
+		{PublishSpec{Name: "ssh", Target: "127.0.0.1:22", Allow: []string{testPeerID}}, true},
+		{PublishSpec{Name: "git-daemon", Target: "git.home:9418", Allow: []string{"*", ToPeerAddr(testPeerID)}}, true},
+		{PublishSpec{Name: "SSH", Target: "127.0.0.1:22", Allow: []string{"*"}}, false},
+		{PublishSpec{Name: "x/y", Target: "127.0.0.1:22", Allow: []string{"*"}}, false},
+		{PublishSpec{Name: "www", Target: "127.0.0.1:80", Allow: []string{"*"}}, false},
+		{PublishSpec{Name: "pg", Target: "5432", Allow: []string{"*"}}, false},
+		{PublishSpec{Name: "pg", Target: "127.0.0.1:5432"}, false},
+		{PublishSpec{Name: "pg", Target: "127.0.0.1:5432", Allow: []string{"alice"}}, false},
+	}
+	for _, c := range cases {
+		if err := c.spec.Validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", c.spec, err)
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	addr, stop := startEchoServer(t, "ssh")
+	defer stop()
+
+	other := "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"
+	denied := "QmXG428k4Aa6Fchp7buub2pK4Fa2nbhcTfznL7oVSGWRRZ"
+	p := NewPublisher(&Config{DenyPeers: []string{denied}})
+	registered := make(map[string]int)
+	p.listen = func(protocol string, port int) error {
+		registered[protocol] = port
+		return nil
+	}
+	p.close = func(protocol string) error {
+		delete(registered, protocol)
+		return nil
+	}
+	defer p.Close()
+
+	if err := p.Apply([]PublishSpec{{Name: "ssh", Target: addr, Allow: []string{ToPeerAddr(testPeerID), denied}}}); err != nil {
+		t.Fatal(err)
+	}
+	port := registered["/x/ssh/1.0"]
+	if port == 0 {
+		t.Fatalf("not registered: %v", registered)
+	}
+	relay := fmt.Sprintf("127.0.0.1:%v", port)
+
+	// ipfs reports the peer ahead of the stream
+	c := dialForward(t, relay)
+	fmt.Fprintf(c, "%v\n", testPeerID)
+	if s := echo(t, c, "hello"); s != "ssh hello" {
+		t.Errorf("unexpected echo: %q", s)
+	}
+	c.Close()
+
+	// peers not allowed by the service or the node and local users are
+	// closed
+	for _, preamble := range []string{other + "\n", denied + "\n", "SSH-2.0-OpenSSH\r\n"} {
+		c := dialForward(t, relay)
+		fmt.Fprint(c, preamble)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if b, err := ioutil.ReadAll(c); err != nil || len(b) > 0 {
+			t.Errorf("%q: read %q %v", preamble, b, err)
+		}
+		c.Close()
+	}
+
+	// peers may not reach relays through the proxy, on loopback they
+	// could claim to be another peer
+	nb, l, stopNode := startTestNode(t, &Config{}, testPeerID, "127.0.0.1 direct\n*.${myid} localhost", nil)
+	defer stopNode()
+	nb.Published = p
+	for _, target := range []string{relay, fmt.Sprintf("ssh.%v:%v", ToPeerAddr(testPeerID), port)} {
+		c := dialForward(t, l.Addr().String())
+		fmt.Fprintf(c, "%v\nCONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", other, target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("CONNECT %v: expected 403, got %v", target, resp.Status)
+		}
+		c.Close()
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		st := p.Status()
+		if len(st) == 1 && st[0].Running && st[0].Total == 1 && st[0].Failed == 3 && st[0].Protocol == "/x/ssh/1.0" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// withdrawn services are unregistered and stop listening
+	if err := p.Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 0 || len(p.Status()) != 0 {
+		t.Errorf("not withdrawn: %v %+v", registered, p.Status())
+	}
+	if c, err := net.Dial("tcp", relay); err == nil {
+		c.Close()
+		t.Error("relay still listening")
+	}
+}
+
+func TestPublisherForgedPeer(t *testing.T) {
+	ip := nonLoopbackIP(t)
+
+	addr, stop := startEchoServer(t, "ssh")
+	defer stop()
+
+	p := NewPublisher(&Config{})
+	if p.host != "127.0.0.1" {
+		t.Errorf("relays listen on %v", p.host)
+	}
+	// a relay reachable by other clients does not take their peer IDs
+	p.host = ip.String()
+	registered := make(map[string]int)
+	p.listen = func(protocol string, port int) error {
+		registered[protocol] = port
+		return nil
+	}
+	p.close = func(protocol string) error { return nil }
+	defer p.Close()
+	if err := p.Apply([]PublishSpec{{Name: "ssh", Target: addr, Allow: []string{"*"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialForward(t, net.JoinHostPort(ip.String(), fmt.Sprint(registered["/x/ssh/1.0"])))
+	defer c.Close()
+	fmt.Fprintf(c, "%v\n", testPeerID)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(c); err != nil || len(b) > 0 {
+		t.Errorf("forged peer: read %q %v", b, err)
+	}
+}
+
+func TestConnectService(t *testing.T) {
+	var args []string
+	ipfs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/p2p/forward" {
+			args = req.URL.Query()["arg"]
+		}
+	}))
+	defer ipfs.Close()
+	base := apiBase
+	apiBase = ipfs.URL
+	defer func() { apiBase = base }()
+
+	sf, err := ConnectService(testPeerID, "ssh", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only local users may pass the ACL of the service as this node
+	listen := fmt.Sprintf("/ip4/127.0.0.1/tcp/%v", sf.Port)
+	if len(args) != 3 || args[0] != "/x/ssh/1.0" || args[1] != listen {
+		t.Errorf("unexpected forward: %v", args)
+	}
+	if addr := sf.Addr(); addr != fmt.Sprintf("127.0.0.1:%v", sf.Port) {
+		t.Errorf("unexpected address: %v", addr)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := ConnectService(testPeerID, "ssh", l.Addr().(*net.TCPAddr).Port); err == nil {
+		t.Error("port in use accepted")
+	}
+}
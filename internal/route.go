@@ -28,14 +28,41 @@ type Route struct {
 	pattern string
 	Backend []*Backend
 	Proxy   bool
+
+	// Exits are tried in order to reach the requested host
+	Exits []*Exit
+}
+
+// IsDirect reports whether clients can reach hosts of the route without mirr.
+// PAC and DNS answers both rely on it so their views do not diverge.
+func (r *Route) IsDirect() bool {
+	return !r.Proxy && len(r.Backend) > 0 && r.Backend[0].Hostname == "direct"
+}
+
+// Action names how the route reaches its hosts: direct, localhost, peer,
+// exit, via for routes through named exits or host for a fixed backend.
+func (r *Route) Action() string {
+	if len(r.Exits) > 0 {
+		return "via"
+	}
+	if len(r.Backend) == 0 {
+		return ""
+	}
+	switch h := r.Backend[0].Hostname; h {
+	case "direct", "localhost", "peer", actionExit:
+		return h
+	}
+	return "host"
 }
 
 // RouteRegistry stores the routing configuration.
 type RouteRegistry struct {
-	mu     sync.Mutex
-	MyID   string
-	MyAddr string
-	Routes []*Route
+	mu      sync.Mutex
+	MyID    string
+	MyAddr  string
+	Routes  []*Route
+	Exits   map[string]*Exit
+	Headers []*headerRule
 }
 
 // func (r *RouteRegistry) SetDefault(target string) {
@@ -147,88 +174,219 @@ func (c *RouteRegistry) parseDomain(s string) (*regexp.Regexp, string, error) {
 
 // Match returns the backend for hostname, and whether to use proxy.
 func (c *RouteRegistry) Match(hostname string) ([]*Backend, bool) {
+	r := c.MatchRoute(hostname)
+	if r == nil {
+		return nil, false
+	}
+	return r.Backend, r.Proxy
+}
+
+// MatchRoute returns the first route matching hostname or nil.
+func (c *RouteRegistry) MatchRoute(hostname string) *Route {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	for _, r := range c.Routes {
-		if r.re != nil && r.re.MatchString(hostname) {
-			return r.Backend, r.Proxy
+		if matchHost(r.re, r.pattern, hostname) {
+			return r
 		}
-		if r.pattern != "" {
-			if matched, err := filepath.Match(r.pattern, hostname); matched && err == nil {
-				return r.Backend, r.Proxy
-			}
+	}
+	return nil
+}
+
+func matchHost(re *regexp.Regexp, pattern, hostname string) bool {
+	if re != nil {
+		return re.MatchString(hostname)
+	}
+	if pattern != "" {
+		matched, err := filepath.Match(pattern, hostname)
+		return matched && err == nil
+	}
+	return false
+}
+
+// parseExits resolves a comma separated list of exit names
+func (c *RouteRegistry) parseExits(s string, exits map[string]*Exit) ([]*Exit, error) {
+	var el []*Exit
+	for _, name := range strings.Split(s, ",") {
+		e, ok := exits[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown exit: %q", name)
 		}
+		el = append(el, e)
 	}
-	return nil, false
+	return el, nil
 }
 
 // Read replaces current config
+//
+// Each line is either an exit declaration, a header directive (see
+// parseHeaderRule) or a route:
+//
+//	exit <name> <url>
+//	<domain> <backend> [proxy]
+//	<domain> via <exit>[,<exit>...]
 func (c *RouteRegistry) Read(reader io.Reader) error {
-	var routes []*Route
+	return c.read(routeSource{r: reader})
+}
 
-	s := bufio.NewScanner(reader)
-	for s.Scan() {
-		if strings.HasPrefix(strings.TrimSpace(s.Text()), "#") {
-			// Comment, ignore.
-			continue
-		}
+// routeSource is a named route configuration, errors refer to its lines
+type routeSource struct {
+	name string
+	r    io.Reader
+}
 
-		fs := strings.Fields(s.Text())
-		switch len(fs) {
-		case 0:
-			continue
-		case 1:
-			return fmt.Errorf("invalid entry: %q", s.Text())
-		case 2:
-			re, pa, err := c.parseDomain(fs[0])
-			if err != nil {
-				return err
+func (s routeSource) errorf(line int, err error) error {
+	if s.name == "" {
+		return fmt.Errorf("line %v: %v", line, err)
+	}
+	return fmt.Errorf("%v:%v: %v", s.name, line, err)
+}
+
+// read parses the sources as one configuration
+func (c *RouteRegistry) read(srcs ...routeSource) error {
+	var routes []*Route
+	var headers []*headerRule
+	exits := map[string]*Exit{
+		exitDirect: directExit,
+	}
+	// exits may be declared after the routes using them
+	type via struct {
+		names string
+		src   routeSource
+		line  int
+	}
+	vias := make(map[*Route]via)
+
+	for _, src := range srcs {
+		s := bufio.NewScanner(src.r)
+		for n := 1; s.Scan(); n++ {
+			if strings.HasPrefix(strings.TrimSpace(s.Text()), "#") {
+				// Comment, ignore.
+				continue
 			}
 
-			routes = append(routes, &Route{
-				re:      re,
-				pattern: pa,
-				Backend: []*Backend{c.parseBackend(fs[1])},
-				Proxy:   false,
-			})
-		case 3:
-			re, pa, err := c.parseDomain(fs[0])
-			if err != nil {
-				return err
+			fs := strings.Fields(s.Text())
+			if len(fs) > 0 {
+				switch fs[0] {
+				case "header", "cors", "forwarded":
+					h, err := c.parseHeaderRule(fs)
+					if err != nil {
+						return src.errorf(n, err)
+					}
+					headers = append(headers, h)
+					continue
+				}
 			}
-			if strings.ToLower(fs[2]) != "proxy" {
-				return errors.New("invalid proxy flag")
+			switch len(fs) {
+			case 0:
+				continue
+			case 1:
+				return src.errorf(n, fmt.Errorf("invalid entry: %q", s.Text()))
+			case 2:
+				re, pa, err := c.parseDomain(fs[0])
+				if err != nil {
+					return src.errorf(n, err)
+				}
+
+				routes = append(routes, &Route{
+					re:      re,
+					pattern: pa,
+					Backend: []*Backend{c.parseBackend(fs[1])},
+					Proxy:   false,
+				})
+			case 3:
+				if fs[0] == "exit" {
+					e, err := NewExit(fs[1], c.expandVar(fs[2]))
+					if err != nil {
+						return src.errorf(n, err)
+					}
+					if _, ok := exits[e.Name]; ok {
+						return src.errorf(n, fmt.Errorf("duplicate exit: %q", e.Name))
+					}
+					exits[e.Name] = e
+					continue
+				}
+				re, pa, err := c.parseDomain(fs[0])
+				if err != nil {
+					return src.errorf(n, err)
+				}
+				if strings.ToLower(fs[1]) == "via" {
+					r := &Route{
+						re:      re,
+						pattern: pa,
+						Backend: []*Backend{&Backend{Hostname: "via"}},
+						Proxy:   true,
+					}
+					vias[r] = via{fs[2], src, n}
+					routes = append(routes, r)
+					continue
+				}
+				if strings.ToLower(fs[2]) != "proxy" {
+					return src.errorf(n, errors.New("invalid proxy flag"))
+				}
+				backend := c.expandVar(fs[1])
+				be := c.parseBackend(backend)
+				e, err := NewExit(backend, fmt.Sprintf("http://%v", backend))
+				if err != nil {
+					return src.errorf(n, err)
+				}
+				if be.Port == 0 {
+					// the proxy listens on the port of the request
+					e.dial = requestPortDial(be.Hostname)
+				}
+				routes = append(routes, &Route{
+					re:      re,
+					pattern: pa,
+					Backend: []*Backend{be},
+					Proxy:   true,
+					Exits:   []*Exit{e},
+				})
+			default:
+				// TODO: multiple backends?
+				return src.errorf(n, fmt.Errorf("multiple backeds not supported yet: %v", s.Text()))
 			}
-			routes = append(routes, &Route{
-				re:      re,
-				pattern: pa,
-				Backend: []*Backend{c.parseBackend(fs[1])},
-				Proxy:   true,
-			})
-		default:
-			// TODO: multiple backends?
-			return fmt.Errorf("multiple backeds not supported yet: %v", s.Text())
+		}
+		if err := s.Err(); err != nil {
+			return err
 		}
 	}
-	if err := s.Err(); err != nil {
-		return err
+
+	for r, v := range vias {
+		el, err := c.parseExits(v.names, exits)
+		if err != nil {
+			return v.src.errorf(v.line, err)
+		}
+		r.Exits = el
 	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.Routes = routes
+	c.Exits = exits
+	c.Headers = headers
 
 	return nil
 }
 
 // ReadFile replaces the current routes with one read from path.
 func (c *RouteRegistry) ReadFile(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+	return c.ReadFiles([]string{path})
+}
+
+// ReadFiles replaces the current routes with the concatenation of paths.
+// Exits declared in one file may be used in the others.
+func (c *RouteRegistry) ReadFiles(paths []string) error {
+	var srcs []routeSource
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		srcs = append(srcs, routeSource{name: p, r: f})
 	}
-	return c.Read(f)
+	return c.read(srcs...)
 }
 
 // ReadString replaces the current routes with one read from cfg.
@@ -12,6 +12,7 @@
 //    scheduler.Every(5).Seconds().Run(function)
 //    scheduler.Every().Day().Run(function)
 //    scheduler.Every().Sunday().At("08:30").Run(function)
+//    scheduler.Cron("0 9 1 * *").In(berlin).Run(function)
 //  }
 package internal
 
@@ -35,6 +36,7 @@ type Job struct {
 	err       error
 	schedule  scheduled
 	isRunning bool
+	stopped   bool
 	sync.RWMutex
 }
 
@@ -59,6 +61,15 @@ type daily struct {
 	hour int
 	min  int
 	sec  int
+	loc  *time.Location
+}
+
+// location returns the time zone of the schedule, local by default
+func (d daily) location() *time.Location {
+	if d.loc == nil {
+		return time.Local
+	}
+	return d.loc
 }
 
 func (d *daily) setTime(h, m, s int) {
@@ -68,13 +79,13 @@ func (d *daily) setTime(h, m, s int) {
 }
 
 func (d daily) nextRun() (time.Duration, error) {
-	now := time.Now()
+	now := time.Now().In(d.location())
 	year, month, day := now.Date()
-	date := time.Date(year, month, day, d.hour, d.min, d.sec, 0, time.Local)
+	date := time.Date(year, month, day, d.hour, d.min, d.sec, 0, d.location())
 	if now.Before(date) {
 		return date.Sub(now), nil
 	}
-	date = time.Date(year, month, day+1, d.hour, d.min, d.sec, 0, time.Local)
+	date = time.Date(year, month, day+1, d.hour, d.min, d.sec, 0, d.location())
 	return date.Sub(now), nil
 }
 
@@ -84,7 +95,7 @@ type weekly struct {
 }
 
 func (w weekly) nextRun() (time.Duration, error) {
-	now := time.Now()
+	now := time.Now().In(w.d.location())
 	year, month, day := now.Date()
 	numDays := w.day - now.Weekday()
 	if numDays == 0 {
@@ -92,7 +103,7 @@ func (w weekly) nextRun() (time.Duration, error) {
 	} else if numDays < 0 {
 		numDays += 7
 	}
-	date := time.Date(year, month, day+int(numDays), w.d.hour, w.d.min, w.d.sec, 0, time.Local)
+	date := time.Date(year, month, day+int(numDays), w.d.hour, w.d.min, w.d.sec, 0, w.d.location())
 	return date.Sub(now), nil
 }
 
@@ -114,6 +125,35 @@ func Every(times ...int) *Job {
 	}
 }
 
+// Cron defines the times to run a job by a cron expression, see ParseCron.
+func Cron(expr string) *Job {
+	s, err := ParseCron(expr)
+	if err != nil {
+		return &Job{err: err}
+	}
+	return &Job{schedule: s}
+}
+
+// In sets the time zone of daily, weekly and cron jobs, the local one by default.
+func (j *Job) In(loc *time.Location) *Job {
+	if j.err != nil {
+		return j
+	}
+	switch s := j.schedule.(type) {
+	case daily:
+		s.loc = loc
+		j.schedule = s
+	case weekly:
+		s.d.loc = loc
+		j.schedule = s
+	case *CronSchedule:
+		j.schedule = s.In(loc)
+	default:
+		j.err = errors.New("bad function chaining")
+	}
+	return j
+}
+
 // NotImmediately allows recurrent jobs not to be executed immediatelly after
 // definition. If a job is declared hourly won't start executing until the first hour
 // passed.
@@ -164,20 +204,27 @@ func (j *Job) Run(f func()) (*Job, error) {
 	}
 	var next time.Duration
 	var err error
-	j.Quit = make(chan bool, 1)
-	j.SkipWait = make(chan bool, 1)
-	j.fn = f
 	// Check for possible errors in scheduling
 	next, err = j.schedule.nextRun()
 	if err != nil {
 		return nil, err
 	}
+	j.Lock()
+	j.Quit = make(chan bool, 1)
+	j.SkipWait = make(chan bool, 1)
+	j.fn = f
+	quit, skip := j.Quit, j.SkipWait
+	stopped := j.stopped
+	j.Unlock()
+	if stopped {
+		return j, nil
+	}
 	go func(j *Job) {
 		for {
 			select {
-			case <-j.Quit:
+			case <-quit:
 				return
-			case <-j.SkipWait:
+			case <-skip:
 				go runJob(j)
 			case <-time.After(next):
 				go runJob(j)
@@ -320,6 +367,21 @@ func (j *Job) Hours() *Job {
 	return j.timeOfDay(time.Hour)
 }
 
+// Stop stops a scheduled job. Unlike sending on Quit it may be called more
+// than once, and a job stopped before Run is never started.
+func (j *Job) Stop() {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.stopped {
+		return
+	}
+	j.stopped = true
+	if j.Quit != nil {
+		close(j.Quit)
+	}
+}
+
 // IsRunning returns if the job is currently running
 func (j *Job) IsRunning() bool {
 	j.RLock()
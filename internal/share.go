@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ShareInfo is what this node hands out to be found by others
+type ShareInfo struct {
+	ID   string   `json:"id"`
+	Addr string   `json:"addr"`
+	Name string   `json:"name,omitempty"`
+	URLs []string `json:"urls"`
+	// Invite is the signed invite link, InviteError tells why there is none
+	Invite      string `json:"invite,omitempty"`
+	InviteError string `json:"inviteError,omitempty"`
+	// QR is a PNG data URL of the invite link or the address
+	QR string `json:"qr,omitempty"`
+}
+
+// NewShareInfo describes the node id, signing an invite if key is given
+func NewShareInfo(id string, key *IdentityKey, name string, services []string, base string) *ShareInfo {
+	addr := ToPeerAddr(id)
+	s := &ShareInfo{
+		ID:   id,
+		Addr: addr,
+		Name: name,
+		URLs: NodeURLs(addr, services),
+	}
+	if key != nil {
+		token, err := NewInvite(key, name, services)
+		if err != nil {
+			s.InviteError = err.Error()
+		} else {
+			s.Invite = InviteLink(base, token)
+		}
+	}
+	return s
+}
+
+// QRContent is the invite link if there is one, the address otherwise
+func (s *ShareInfo) QRContent() string {
+	if s.Invite != "" {
+		return s.Invite
+	}
+	return s.Addr
+}
+
+// Share serves the share page, the invite landing page and their API
+type Share struct {
+	nb    *Neighborhood
+	admin *AdminAuth
+	book  *AddressBook
+	// base of invite links, the proxy URL
+	base string
+
+	mu  sync.Mutex
+	key *IdentityKey
+}
+
+// NewShare creates the share handlers of the node
+func NewShare(nb *Neighborhood, admin *AdminAuth, base string) *Share {
+	path := ""
+	if nb.config != nil {
+		path = nb.config.AddressBook
+	}
+	if path == "" {
+		path = DefaultAddressBookFile()
+	}
+	return &Share{
+		nb:    nb,
+		admin: admin,
+		book:  NewAddressBook(path),
+		base:  base,
+	}
+}
+
+// Register adds the share handlers to mux
+func (r *Share) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/share", r.servePage)
+	mux.HandleFunc("/invite", r.serveInvite)
+	mux.Handle("/dashboard/api/share", r.admin.Wrap(http.HandlerFunc(r.serveInfo)))
+	mux.Handle("/dashboard/api/share/qr.png", r.admin.Wrap(http.HandlerFunc(r.serveQR)))
+	mux.Handle("/dashboard/api/book", r.admin.Wrap(http.HandlerFunc(r.serveBook)))
+}
+
+// identity loads the signing key once it is readable
+func (r *Share) identity() (*IdentityKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.key != nil {
+		return r.key, nil
+	}
+	path := IPFSPath()
+	if r.nb.config != nil && r.nb.config.IPFSPath != "" {
+		path = r.nb.config.IPFSPath
+	}
+	key, err := LoadIdentityKey(path)
+	if err != nil {
+		return nil, err
+	}
+	r.key = key
+	return key, nil
+}
+
+// Info describes this node
+func (r *Share) Info() (*ShareInfo, error) {
+	if r.nb.My == nil || r.nb.My.ID == "" {
+		return nil, fmt.Errorf("node not connected to IPFS")
+	}
+	var name string
+	var services []string
+	if cfg := r.nb.config; cfg != nil {
+		name = cfg.ShareName
+		services = cfg.ShareServices
+	}
+
+	key, err := r.identity()
+	if err == nil && key.PeerID != r.nb.My.ID {
+		err = fmt.Errorf("IPFS identity %v is not this node", key.PeerID)
+		key = nil
+	}
+	s := NewShareInfo(r.nb.My.ID, key, name, services, r.base)
+	if err != nil {
+		s.InviteError = "invites need the IPFS identity key: " + err.Error()
+	}
+	return s, nil
+}
+
+func (r *Share) servePage(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, shareHTML)
+}
+
+func (r *Share) serveInfo(w http.ResponseWriter, req *http.Request) {
+	s, err := r.Info()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	png, err := QRCode(s.QRContent())
+	if err == nil {
+		s.QR = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (r *Share) serveQR(w http.ResponseWriter, req *http.Request) {
+	s, err := r.Info()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	png, err := QRCode(s.QRContent())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// serveBook lists the address book, POST imports the invite t
+func (r *Share) serveBook(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		list, err := r.book.List()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		inv, err := ParseInvite(req.PostFormValue("t"), r.inviteMaxAge())
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		if r.nb.My != nil && inv.ID == r.nb.My.ID {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "this is your own invite"})
+			return
+		}
+		e, err := r.book.Add(inv)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		logger.Infof("address book: added %v", e.ID)
+		writeJSON(w, http.StatusOK, e)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// inviteMaxAge is the age limit of the invites accepted
+func (r *Share) inviteMaxAge() time.Duration {
+	if r.nb.config == nil {
+		return DefaultInviteMaxAge
+	}
+	return r.nb.config.InviteMaxAge
+}
+
+var inviteTemplate = htmltemplate.Must(htmltemplate.New("invite").Parse(inviteHTML))
+
+// serveInvite shows a verified invite, importing is left to the page
+// because it needs admin access
+func (r *Share) serveInvite(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("t")
+	data := struct {
+		Invite *Invite
+		Token  string
+		Error  string
+	}{
+		Token: token,
+	}
+	inv, err := ParseInvite(token, r.inviteMaxAge())
+	if err != nil {
+		data.Error = err.Error()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		data.Invite = inv
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if err := inviteTemplate.Execute(w, data); err != nil {
+		logger.Infof("invite page: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+const pageStyle = `body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #333; }
+h1 { font-size: 1.6em; }
+code { background: #eee; padding: 0 .2em; word-break: break-all; }
+input { width: 100%; font-family: monospace; }
+.muted { color: #888; font-size: small; }
+#message { min-height: 1.5em; color: #c60; }
+`
+
+// shareHTML shows the node address, its QR code and invite link
+const shareHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Share my address</title>
+<style>
+` + pageStyle + `</style>
+</head>
+<body>
+<h1>Share my address</h1>
+<div id="message"></div>
+<p>My address: <code id="addr">&hellip;</code></p>
+<p id="urls"></p>
+<p><img id="qr" alt="" width="320" height="320"></p>
+<p>Invite link, send it to a friend to add you to their peers:</p>
+<p><input id="invite" readonly onclick="this.select()"> <button id="copy">Copy</button></p>
+<p class="muted">Anyone with the link learns your address, it grants no access to your node.</p>
+<p><a href="/">Back to my node</a></p>
+
+<script>
+` + adminScript + `
+function message(s) {
+	document.getElementById("message").textContent = s || "";
+}
+
+call("GET", "share").then(function (s) {
+	document.getElementById("addr").textContent = s.addr;
+	document.getElementById("urls").innerHTML = (s.urls || []).map(function (u) {
+		return "<a href=\"" + text(u) + "\">" + text(u) + "</a>";
+	}).join("<br>");
+	if (s.qr) {
+		document.getElementById("qr").src = s.qr;
+	}
+	document.getElementById("invite").value = s.invite || "";
+	if (s.inviteError) {
+		message(s.inviteError);
+	}
+}).catch(function (e) {
+	message(e.message);
+});
+
+document.getElementById("copy").onclick = function () {
+	var input = document.getElementById("invite");
+	input.select();
+	document.execCommand("copy");
+};
+</script>
+</body>
+</html>
+`
+
+// inviteHTML is the landing page of invite links, a html/template
+const inviteHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Invite</title>
+<style>
+` + pageStyle + `</style>
+</head>
+<body>
+{{if .Invite}}
+<h1>{{if .Invite.Name}}{{.Invite.Name}}{{else}}A peer{{end}} invites you</h1>
+<p>Address: <code>{{.Invite.Addr}}</code></p>
+<p>{{range .Invite.URLs}}<a href="{{.}}">{{.}}</a><br>{{end}}</p>
+<p class="muted">The invite is signed by peer {{.Invite.ID}}.</p>
+<div id="message"></div>
+<p><button id="add">Add to my peers</button></p>
+<script>
+` + adminScript + `
+document.getElementById("add").onclick = function () {
+	call("POST", "book", {t: {{.Token}}}).then(function () {
+		document.getElementById("message").textContent = "Added to your peers.";
+	}).catch(function (e) {
+		document.getElementById("message").textContent = e.message;
+	});
+};
+</script>
+{{else}}
+<h1>Invalid invite</h1>
+<p>{{.Error}}</p>
+<p>Ask your friend to send the link again.</p>
+{{end}}
+<p><a href="/">My node</a></p>
+</body>
+</html>
+`
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdleTimeout closes tunnels without traffic in either direction
+var DefaultIdleTimeout = 10 * time.Minute
+
+// idlePipe copies between two connections until one side closes or
+// no data moved in either direction for the idle timeout. Long-lived
+// connections such as WebSockets stay open as long as they are in use.
+type idlePipe struct {
+	idle time.Duration
+	// last activity in unix nanoseconds
+	last int64
+}
+
+func (p *idlePipe) active() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+}
+
+func (p *idlePipe) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&p.last))
+}
+
+func (p *idlePipe) copy(dst, src net.Conn) error {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(p.idle))
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.active()
+			dst.SetWriteDeadline(time.Now().Add(p.idle))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			// the other direction may still be busy
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && p.idleFor() < p.idle {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// pipe connects a and b, closing both when done
+func pipe(a, b net.Conn, idle time.Duration) {
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	p := &idlePipe{idle: idle}
+	p.active()
+
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		p.copy(b, a)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.copy(a, b)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
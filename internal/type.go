@@ -2,17 +2,97 @@ package internal
 
 import (
 	"fmt"
+	"time"
 )
 
-// Config is application settings
+// Config is application settings, see LoadConfig
 type Config struct {
-	Port      int
-	RouteFile string
-	// Local   bool
-	// Blocked []string
-	// Home    []string
-	// Web     []string
-	// Alias   map[string]string
+	// Listen is the proxy address, Port its port also used as p2p target
+	Listen string
+	Port   int
+	// HTTPSListen optionally serves the proxy over TLS with TLSCert and TLSKey
+	HTTPSListen string
+	TLSCert     string
+	TLSKey      string
+
+	// RouteFiles are read in order as one route configuration
+	RouteFiles []string
+
+	// IPFSAPI is the IPFS HTTP API base URL, IPFSHost the host of p2p forwards
+	IPFSAPI  string
+	IPFSHost string
+	// IPFSPath is the IPFS repository holding the identity key signing invites
+	IPFSPath string
+
+	// ShareName and ShareServices are announced in invites,
+	// services as <service>.<addr>.m3
+	ShareName     string
+	ShareServices []string
+	// InviteMaxAge limits the age of invites accepted, 0 accepts all
+	InviteMaxAge time.Duration
+	// AddressBook keeps the peers imported from invites
+	AddressBook string
+
+	// LogLevel and LogFile override the log_level and log_file environment
+	LogLevel string
+	LogFile  string
+
+	// AdminTokens and the tokens in AdminTokenFile grant access to the admin API
+	AdminTokens    []string
+	AdminTokenFile string
+	// AdminLocalOnly admits only loopback users to the admin API, never peers
+	AdminLocalOnly bool
+
+	// HealthProbes are optional external URLs fetched through the proxy
+	// as part of the health report
+	HealthProbes []string
+
+	// PACSocks is an optional SOCKS alternative offered in proxy.pac
+	PACSocks string
+	// PACFallback is proxy or direct for hosts matching no route
+	PACFallback string
+
+	// ExitPeers are peer addresses used by the exit route action
+	// in addition to healthy known peers
+	ExitPeers []string
+	// AllowPeers restricts the peers served over p2p if not empty,
+	// DenyPeers are never served
+	AllowPeers []string
+	DenyPeers  []string
+
+	// PeerPool is h2c, http1 or off for the connections to peer forwards,
+	// PeerMaxConns caps HTTP/1.1 connections per peer
+	PeerPool        string
+	PeerMaxConns    int
+	PeerIdleTimeout time.Duration
+
+	// DNSListen enables the DNS server on the address if not empty
+	DNSListen string
+	// DNSUpstream resolves names not routed through mirr
+	DNSUpstream string
+	// DNSAddrs answer routed names, defaults to the local interface addresses
+	DNSAddrs []string
+	// DNSClients may have names not routed through mirr resolved upstream,
+	// defaults to loopback and private networks
+	DNSClients []string
+
+	// CacheDir stores responses of peer and local routes, disabled if empty
+	CacheDir string
+	// CacheSize is the maximum cache size in bytes
+	CacheSize int64
+
+	// Limits restrict rate and daily traffic of local users and peers
+	// per route action, see ParseLimit
+	Limits []string
+
+	// IdleTimeout closes WebSocket and other tunnels without traffic
+	IdleTimeout time.Duration
+
+	// Forwards are local ports forwarded to hosts, routed names or peers
+	Forwards []ForwardSpec
+
+	// Publish offers local services to peers under their own p2p protocols
+	Publish []PublishSpec
 }
 
 // ListFlags is for collecting an array of command line arguments
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgrade reports whether req asks to switch protocols, e.g. to WebSocket
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flushWriter sends each write to the client immediately so streamed
+// responses such as server-sent events are not held in buffers
+type flushWriter struct {
+	http.ResponseWriter
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.f.Flush()
+	return n, err
+}
+
+// UpgradeHandler proxies Upgrade requests end to end and leaves all other
+// requests to Next, flushing their responses as they arrive. goproxy sends
+// requests through http.Transport which cannot hand over upgraded connections.
+type UpgradeHandler struct {
+	Next http.Handler
+	Dial func(network, addr string) (net.Conn, error)
+
+	// IdleTimeout closes upgraded connections without traffic
+	IdleTimeout time.Duration
+
+	// optional
+	Nb      *Neighborhood
+	Limits  *LimitHandler
+	Headers *HeaderHandler
+	Pages   *ErrorPages
+}
+
+func (r *UpgradeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" && req.URL.IsAbs() {
+		if isUpgrade(req) {
+			r.upgrade(w, req)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			w = &flushWriter{ResponseWriter: w, f: f}
+		}
+	}
+	r.Next.ServeHTTP(w, req)
+}
+
+func (r *UpgradeHandler) route(req *http.Request) *Route {
+	if r.Nb == nil || r.Nb.Router == nil {
+		return nil
+	}
+	return r.Nb.Router.MatchRoute(req.URL.Hostname())
+}
+
+func (r *UpgradeHandler) fail(w http.ResponseWriter, req *http.Request, err error) {
+	logger.Infof("upgrade %v: %v", req.URL, err)
+	if r.Pages == nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp := r.Pages.Response(req, err, r.route(req))
+	writeResponse(w, resp)
+}
+
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	copyBody(w, resp)
+}
+
+func copyBody(w http.ResponseWriter, resp *http.Response) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *UpgradeHandler) upgrade(w http.ResponseWriter, req *http.Request) {
+	hostname := req.URL.Hostname()
+
+	throttle := func(c net.Conn) net.Conn { return c }
+	dial := r.Dial
+	if r.Limits != nil {
+		dial = r.Limits.Dialer(r.Limits.peers.ClientOf(req))
+		wrap, lerr := r.Limits.Admit(req, hostname)
+		if lerr != nil {
+			writeResponse(w, limitResponse(req, lerr))
+			return
+		}
+		throttle = wrap
+	}
+
+	// the response policy sees the headers as the client sent them
+	orig := &http.Request{Header: req.Header}
+	out := req.WithContext(req.Context())
+	out.Header = cloneHeader(req.Header)
+	var policy *HeaderPolicy
+	if r.Headers != nil {
+		policy = r.Headers.Apply(out)
+	}
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization"} {
+		out.Header.Del(h)
+	}
+	out.RequestURI = ""
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(hostname, "80")
+	}
+	target, err := dial("tcp", addr)
+	if err != nil {
+		r.fail(w, req, err)
+		return
+	}
+	target = throttle(target)
+
+	target.SetDeadline(time.Now().Add(dialTimeout))
+	if err := out.Write(target); err != nil {
+		target.Close()
+		r.fail(w, req, err)
+		return
+	}
+	br := bufio.NewReader(target)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		target.Close()
+		r.fail(w, req, err)
+		return
+	}
+	target.SetDeadline(time.Time{})
+	if policy != nil {
+		policy.ApplyResponse(resp, orig, r.myID())
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the origin declined, relay its answer
+		writeResponse(w, resp)
+		target.Close()
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		target.Close()
+		http.Error(w, "upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	client, cbuf, err := hj.Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	if err := resp.Write(client); err != nil {
+		client.Close()
+		target.Close()
+		return
+	}
+
+	// hand over bytes already read on either side
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		client.Write(b)
+	}
+	if n := cbuf.Reader.Buffered(); n > 0 {
+		b, _ := cbuf.Reader.Peek(n)
+		target.Write(b)
+	}
+
+	idle := r.IdleTimeout
+	logger.Debugf("upgrade %v: %v idle timeout: %v", req.URL, resp.Header.Get("Upgrade"), idle)
+	pipe(client, target, idle)
+}
+
+func (r *UpgradeHandler) myID() string {
+	if r.Nb == nil || r.Nb.My == nil {
+		return ""
+	}
+	return r.Nb.My.ID
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// absoluteConn turns the origin-form request line of a client into the
+// absolute form proxies expect
+type absoluteConn struct {
+	net.Conn
+	host string
+	sent bool
+}
+
+func (c *absoluteConn) Write(p []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		p = bytes.Replace(p, []byte("GET /"), []byte("GET http://"+c.host+"/"), 1)
+	}
+	return c.Conn.Write(p)
+}
+
+func startTestProxy(t *testing.T, routes string, idle time.Duration) (string, func()) {
+	nb := NewNeighborhood(&Config{IdleTimeout: idle})
+	nb.My = &Node{ID: "QmTFdcQY12fjxv6kELzQA4zXBxiva8xcunrmTYZto8DFUk"}
+	nb.Router = NewRouteRegistry(nb.My.ID)
+	if err := nb.Router.ReadString(routes); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := NewPeerListener(l)
+	addr := l.Addr().String()
+	go http.Serve(peers, NewProxy(nb, peers, "http://"+addr))
+	return addr, func() { l.Close() }
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer echo.Close()
+	u, _ := url.Parse(echo.URL)
+
+	idle := 300 * time.Millisecond
+	proxyAddr, stop := startTestProxy(t, fmt.Sprintf("echo.home %v", u.Host), idle)
+	defer stop()
+
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := websocket.NewConfig("ws://echo.home/", "http://echo.home/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(config, &absoluteConn{Conn: c, host: "echo.home"})
+	if err != nil {
+		t.Fatalf("handshake through proxy: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// traffic keeps the connection open past the idle timeout
+	for i := 0; i < 6; i++ {
+		msg := fmt.Sprintf("hello %v", i)
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatalf("message %v: %v", i, err)
+		}
+		if got != msg {
+			t.Fatalf("expected %q, got %q", msg, got)
+		}
+		time.Sleep(idle / 3)
+	}
+
+	// an idle connection is closed
+	time.Sleep(3 * idle)
+	var got string
+	if err := websocket.Message.Receive(ws, &got); err == nil {
+		t.Fatalf("expected idle connection closed, got %q", got)
+	}
+}
+
+func TestWebSocketProxyRejected(t *testing.T) {
+	// origin without WebSocket support
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "no upgrade", http.StatusBadRequest)
+	}))
+	defer plain.Close()
+	u, _ := url.Parse(plain.URL)
+
+	proxyAddr, stop := startTestProxy(t, fmt.Sprintf("plain.home %v\ndown.home 127.0.0.1:1", u.Host), time.Second)
+	defer stop()
+
+	for host, status := range map[string]int{
+		"plain.home": http.StatusBadRequest,
+		"down.home":  http.StatusBadGateway,
+	} {
+		c, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "GET http://%v/ HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("%v: expected %v, got %v", host, status, resp.Status)
+		}
+	}
+}
+
+func TestStreamingProxy(t *testing.T) {
+	release := make(chan struct{})
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer events.Close()
+	defer close(release)
+	u, _ := url.Parse(events.URL)
+
+	proxyAddr, stop := startTestProxy(t, fmt.Sprintf("events.home %v", u.Host), time.Second)
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://events.home/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: first\n" {
+			t.Fatalf("unexpected event: %q", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("event was not streamed")
+	}
+}
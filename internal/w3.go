@@ -4,13 +4,17 @@ import (
 	"fmt"
 	"github.com/elazarl/goproxy"
 	"net/http"
+	"time"
 )
 
 //W3Proxy start a proxy to W3
 func W3Proxy(pid string, port int) {
 	address := fmt.Sprintf(":%v", port)
 	proxy := goproxy.NewProxyHttpServer()
-	proxy.NonproxyHandler = HealthHandlerFunc(fmt.Sprintf("http://127.0.0.1:%v", port))
+	hc := NewHealthChecker(15 * time.Second)
+	hc.Add("ipfs", true, checkIPFS)
+	hc.Add("listener", true, checkListener(port))
+	proxy.NonproxyHandler = hc.HealthHandlerFunc()
 
 	proxy.Verbose = true
 	proxy.OnResponse().DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {